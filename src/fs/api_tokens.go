@@ -0,0 +1,330 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API tokens let scripts reach some shares of a user, read-only or
+// read-write, without the PIN of the user. Like sessions, only a hash of
+// them is kept
+var apiTokensSchema = []string{
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL,
+		login TEXT NOT NULL,
+		is_demo INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		shares TEXT NOT NULL,
+		writable INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS api_tokens_user ON api_tokens (user_id, is_demo)`,
+}
+
+// API tokens start with this, to tell them from session tokens at a glance
+const apiTokenPrefix = "amahi_"
+
+// apiToken is an API token as the API shows it. The token itself is only
+// shown once, when it is created
+type apiToken struct {
+	ID         int64      `json:"id"`
+	Token      string     `json:"token,omitempty"`
+	Name       string     `json:"name"`
+	Shares     []string   `json:"shares"`
+	Writable   bool       `json:"writable"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	user       *HdaUser
+}
+
+// allows tells whether the token is scoped to the share, for writing if write
+func (token *apiToken) allows(share string, write bool) bool {
+	if write && !token.Writable {
+		return false
+	}
+	for _, name := range token.Shares {
+		if name == share {
+			return true
+		}
+	}
+	return false
+}
+
+func (token *apiToken) expired() bool {
+	return token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt)
+}
+
+func unixTime(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func (store *LocalStore) saveAPIToken(token *apiToken) error {
+	shares, _ := json.Marshal(token.Shares)
+	result, err := store.db.Exec(`INSERT INTO api_tokens
+		(token_hash, user_id, login, is_demo, name, shares, writable, created_at, expires_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token.Token), token.user.id, token.user.Login, token.user.IsDemo, token.Name, string(shares),
+		token.Writable, token.CreatedAt.Unix(), unixTime(token.ExpiresAt), 0)
+	if err != nil {
+		return err
+	}
+	token.ID, err = result.LastInsertId()
+	return err
+}
+
+const apiTokenColumns = "id, user_id, login, is_demo, name, shares, writable, created_at, expires_at, last_used_at"
+
+func scanAPIToken(row interface {
+	Scan(dest ...interface{}) error
+}) (*apiToken, error) {
+	token := &apiToken{user: new(HdaUser)}
+	var shares string
+	var createdAt, expiresAt, lastUsedAt int64
+	err := row.Scan(&token.ID, &token.user.id, &token.user.Login, &token.user.IsDemo, &token.Name, &shares,
+		&token.Writable, &createdAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(shares), &token.Shares)
+	token.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if expiresAt != 0 {
+		t := time.Unix(expiresAt, 0).UTC()
+		token.ExpiresAt = &t
+	}
+	if lastUsedAt != 0 {
+		t := time.Unix(lastUsedAt, 0).UTC()
+		token.LastUsedAt = &t
+	}
+	return token, nil
+}
+
+// apiToken returns the API token with the given hash, or nil
+func (store *LocalStore) apiToken(hash string) *apiToken {
+	token, err := scanAPIToken(store.db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ?", hash))
+	if err != nil {
+		return nil
+	}
+	return token
+}
+
+// apiTokenByID returns the API token with the given id, or nil
+func (store *LocalStore) apiTokenByID(id int64) *apiToken {
+	token, err := scanAPIToken(store.db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
+	if err != nil {
+		return nil
+	}
+	return token
+}
+
+// apiTokens returns the API tokens of a user, newest first
+func (store *LocalStore) apiTokens(user *HdaUser) ([]*apiToken, error) {
+	rows, err := store.db.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? AND is_demo = ? "+
+		"ORDER BY created_at DESC, id DESC", user.id, user.IsDemo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]*apiToken, 0)
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (store *LocalStore) touchAPIToken(id int64, lastUsedAt time.Time) {
+	store.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", lastUsedAt.Unix(), id)
+}
+
+// deleteAPIToken removes an API token of the user, it tells whether there was one
+func (store *LocalStore) deleteAPIToken(id int64, user *HdaUser) (bool, error) {
+	result, err := store.db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ? AND is_demo = ?",
+		id, user.id, user.IsDemo)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// apiTokenFor returns the API token of a request, or nil if it has none that
+// is still valid
+func (service *MercuryFsService) apiTokenFor(r *http.Request) *apiToken {
+	authToken := parseAuthToken(r)
+	if service.store == nil || !strings.HasPrefix(authToken, apiTokenPrefix) {
+		return nil
+	}
+	token := service.store.apiToken(hashToken(authToken))
+	if token == nil || token.expired() {
+		return nil
+	}
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > sessionTouchPeriod {
+		service.store.touchAPIToken(token.ID, now)
+	}
+	return token
+}
+
+// scopedAccess passes a request with an API token when the token is scoped
+// to its share and its user still has access to the share
+func (service *MercuryFsService) scopedAccess(w http.ResponseWriter, r *http.Request, token *apiToken, write bool, pass http.HandlerFunc) {
+	shareName := r.URL.Query().Get("s")
+	if !token.allows(shareName, write) {
+		http.Error(w, "Access Forbidden", http.StatusForbidden)
+		return
+	}
+	var access bool
+	var err error
+	if write {
+		access, err = token.user.HasWriteAccess(shareName)
+	} else {
+		access, err = token.user.HasReadAccess(shareName)
+	}
+	if !access {
+		if err == nil {
+			http.Error(w, "Access Forbidden", http.StatusForbidden)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	pass(w, r)
+}
+
+// serveAPITokens lists the API tokens of the user, without the tokens themselves
+func (service *MercuryFsService) serveAPITokens(writer http.ResponseWriter, request *http.Request) {
+	user := service.checkAuthHeader(writer, request)
+	if user == nil {
+		return
+	}
+	if service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	tokens, err := service.store.apiTokens(user)
+	if err != nil {
+		logging.Error("Error reading API tokens: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	data, _ := json.Marshal(tokens)
+	service.serveJSON(writer, request, string(data))
+}
+
+// createAPIToken makes an API token for the user, from a JSON body with its
+// "name", its "shares", whether it is "writable" and an optional "expires_in"
+// in seconds. The shares have to be ones the user can read, or write to for
+// a writable token
+func (service *MercuryFsService) createAPIToken(writer http.ResponseWriter, request *http.Request) {
+	user := service.checkAuthHeader(writer, request)
+	if user == nil {
+		return
+	}
+	defer request.Body.Close()
+	var data struct {
+		Name      string   `json:"name"`
+		Shares    []string `json:"shares"`
+		Writable  bool     `json:"writable"`
+		ExpiresIn int64    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&data); err != nil || data.Name == "" || len(data.Shares) == 0 || data.ExpiresIn < 0 {
+		http.Error(writer, "Bad Request", http.StatusBadRequest)
+		service.accessLog(logging, request, http.StatusBadRequest, 0)
+		return
+	}
+	if service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	for _, share := range data.Shares {
+		access, err := user.HasReadAccess(share)
+		if access && data.Writable {
+			access, err = user.HasWriteAccess(share)
+		}
+		if err != nil {
+			http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+			service.accessLog(logging, request, http.StatusInternalServerError, 0)
+			return
+		}
+		if !access {
+			http.Error(writer, "Access Forbidden", http.StatusForbidden)
+			service.accessLog(logging, request, http.StatusForbidden, 0)
+			return
+		}
+	}
+	token := &apiToken{
+		Token:     apiTokenPrefix + tokenGenerator() + tokenGenerator(),
+		Name:      data.Name,
+		Shares:    data.Shares,
+		Writable:  data.Writable,
+		CreatedAt: time.Now().UTC(),
+		user:      user,
+	}
+	if data.ExpiresIn > 0 {
+		t := token.CreatedAt.Add(time.Duration(data.ExpiresIn) * time.Second)
+		token.ExpiresAt = &t
+	}
+	if err := service.store.saveAPIToken(token); err != nil {
+		logging.Error("Error saving API token: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	audit(request, "token-created", auditSuccess, user.Login, "API token %q of %s for %s, writable %v",
+		token.Name, user.Login, strings.Join(token.Shares, ", "), token.Writable)
+	result, _ := json.Marshal(token)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusCreated)
+	writer.Write(result)
+	service.accessLog(logging, request, http.StatusCreated, len(result))
+	service.debugInfo.requestServed(int64(len(result)))
+}
+
+// revokeAPIToken removes the API token of the user with the given "id"
+func (service *MercuryFsService) revokeAPIToken(writer http.ResponseWriter, request *http.Request) {
+	user := service.checkAuthHeader(writer, request)
+	if user == nil {
+		return
+	}
+	id, err := strconv.ParseInt(request.URL.Query().Get("id"), 10, 64)
+	found := false
+	if err == nil && service.store != nil {
+		if found, err = service.store.deleteAPIToken(id, user); err != nil {
+			logging.Error("Error removing API token: %s", err.Error())
+		}
+	}
+	if !found {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	audit(request, "token-revoked", auditSuccess, user.Login, "API token %d of %s", id, user.Login)
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAPITokens(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+	if logging == nil {
+		// the handlers log their requests
+		initializeLogging(filepath.Join(os.TempDir(), "amahi-test", "test.log"), splitNone, false)
+	}
+	saved := adminAuth
+	adminAuth = &adminCredentials{anonymous: anonymousDeny}
+	defer func() { adminAuth = saved }()
+	users := NewHdaUsers(true)
+	service := &MercuryFsService{Users: users, store: store, debugInfo: new(debugInfo), info: new(HdaInfo)}
+	session, _ := users.queryUser("1234", "laptop", "app", false)
+
+	create := func(body string) (*apiToken, int) {
+		request := httptest.NewRequest("POST", "/tokens", strings.NewReader(body))
+		request.Header.Set("Authorization", session.AuthToken)
+		writer := httptest.NewRecorder()
+		service.createAPIToken(writer, request)
+		token := new(apiToken)
+		json.Unmarshal(writer.Body.Bytes(), token)
+		return token, writer.Code
+	}
+	if _, code := create(`{"name": "backup"}`); code != http.StatusBadRequest {
+		t.Errorf("Token without shares created: %d", code)
+	}
+	backup, code := create(`{"name": "backup", "shares": ["backups"], "writable": true}`)
+	if code != http.StatusCreated || !strings.HasPrefix(backup.Token, apiTokenPrefix) {
+		t.Fatalf("Creating a token gave %d %+v", code, backup)
+	}
+	reader, _ := create(`{"name": "reader", "shares": ["music"], "expires_in": 3600}`)
+
+	access := func(middleware func(http.HandlerFunc) http.HandlerFunc, token, share string) int {
+		request := httptest.NewRequest("GET", "/files?s="+share+"&p=/", nil)
+		request.Header.Set("Authorization", token)
+		writer := httptest.NewRecorder()
+		middleware(func(w http.ResponseWriter, r *http.Request) {})(writer, request)
+		return writer.Code
+	}
+	if code := access(service.shareWriteAccess, backup.Token, "backups"); code != http.StatusOK {
+		t.Errorf("Writable token cannot write: %d", code)
+	}
+	if code := access(service.shareReadAccess, backup.Token, "music"); code != http.StatusForbidden {
+		t.Errorf("Token reads out of its shares: %d", code)
+	}
+	if code := access(service.shareReadAccess, reader.Token, "music"); code != http.StatusOK {
+		t.Errorf("Read-only token cannot read: %d", code)
+	}
+	if code := access(service.shareWriteAccess, reader.Token, "music"); code != http.StatusForbidden {
+		t.Errorf("Read-only token can write: %d", code)
+	}
+	if code := access(service.authMiddleware, reader.Token, "music"); code != http.StatusUnauthorized {
+		t.Errorf("Token works beyond shares: %d", code)
+	}
+
+	store.db.Exec("UPDATE api_tokens SET expires_at = 1 WHERE id = ?", reader.ID)
+	if code := access(service.shareReadAccess, reader.Token, "music"); code != http.StatusUnauthorized {
+		t.Errorf("Expired token taken: %d", code)
+	}
+
+	request := httptest.NewRequest("GET", "/tokens", nil)
+	request.Header.Set("Authorization", session.AuthToken)
+	writer := httptest.NewRecorder()
+	service.serveAPITokens(writer, request)
+	if !strings.Contains(writer.Body.String(), `"backup"`) || strings.Contains(writer.Body.String(), backup.Token) {
+		t.Errorf("Tokens listed as %s", writer.Body.String())
+	}
+
+	request = httptest.NewRequest("DELETE", "/tokens?id="+strconv.FormatInt(backup.ID, 10), nil)
+	request.Header.Set("Authorization", session.AuthToken)
+	writer = httptest.NewRecorder()
+	service.revokeAPIToken(writer, request)
+	if writer.Code != http.StatusOK || access(service.shareWriteAccess, backup.Token, "backups") != http.StatusUnauthorized {
+		t.Errorf("Revoked token still works: %d", writer.Code)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime falls back to the mtime where we do not read the access time
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,826 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// largest embedded picture we are willing to load in memory
+const maxPictureSize = 16 << 20
+
+var errNoAudioTags = errors.New("no supported tags found")
+
+// audioTags holds the information embedded in the tags of an audio file
+type audioTags struct {
+	title       string
+	artist      string
+	albumArtist string
+	album       string
+	genre       string
+	year        int
+	track       int
+	disc        int
+	duration    time.Duration
+
+	picture     []byte
+	pictureMime string
+	// picture type as defined by ID3v2 APIC, 3 is the front cover
+	pictureType int
+}
+
+// setPicture keeps the picture unless we already have a front cover
+func (t *audioTags) setPicture(data []byte, mime string, pictureType int) {
+	if len(data) == 0 {
+		return
+	}
+	if len(t.picture) > 0 && (t.pictureType == 3 || pictureType != 3) {
+		return
+	}
+	t.picture = data
+	t.pictureMime = mime
+	t.pictureType = pictureType
+}
+
+// setText fills in a text field by its (lowercase, Vorbis comment style) name,
+// without overwriting values read before
+func (t *audioTags) setText(name, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value == "" {
+		return
+	}
+	set := func(field *string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	number := func(field *int) {
+		// "3/12" style values carry the total as well
+		if i := strings.IndexByte(value, '/'); i >= 0 {
+			value = value[:i]
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && *field == 0 {
+			*field = n
+		}
+	}
+	switch name {
+	case "title":
+		set(&t.title)
+	case "artist":
+		set(&t.artist)
+	case "albumartist", "album artist":
+		set(&t.albumArtist)
+	case "album":
+		set(&t.album)
+	case "genre":
+		set(&t.genre)
+	case "tracknumber":
+		number(&t.track)
+	case "discnumber":
+		number(&t.disc)
+	case "date", "year":
+		if len(value) > 4 {
+			value = value[:4]
+		}
+		number(&t.year)
+	}
+}
+
+// readAudioTags reads the ID3v2, FLAC, MP4 or Ogg tags of the given file, as
+// well as the duration of the audio
+func readAudioTags(path string) (*audioTags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tags := new(audioTags)
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		f.Seek(0, io.SeekStart)
+		start, err := readID3v2(f, tags)
+		if err != nil {
+			return nil, err
+		}
+		// FLAC files sometimes carry an ID3v2 tag in front of the stream
+		f.Seek(start, io.SeekStart)
+		marker := make([]byte, 4)
+		if _, err := io.ReadFull(f, marker); err == nil && string(marker) == "fLaC" {
+			return tags, readFlac(f, tags)
+		}
+		mp3Duration(f, start, tags)
+		return tags, nil
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		f.Seek(4, io.SeekStart)
+		return tags, readFlac(f, tags)
+	case string(header[4:8]) == "ftyp":
+		f.Seek(0, io.SeekStart)
+		return tags, readMp4(f, tags)
+	case bytes.HasPrefix(header, []byte("OggS")):
+		f.Seek(0, io.SeekStart)
+		return tags, readOgg(f, tags)
+	case header[0] == 0xff && header[1]&0xe0 == 0xe0:
+		// an mp3 without tags, we can still tell the duration
+		mp3Duration(f, 0, tags)
+		return tags, nil
+	}
+	return nil, errNoAudioTags
+}
+
+// syncsafe integers use only the lower 7 bits of each byte
+func syncsafe(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<7 | int(c&0x7f)
+	}
+	return n
+}
+
+// removeUnsync undoes the ID3v2 unsynchronisation scheme (0xff 0x00 -> 0xff)
+func removeUnsync(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// readID3v2 parses an ID3v2.2, 2.3 or 2.4 tag at the current position and
+// returns the position where the audio data starts
+func readID3v2(r io.ReadSeeker, tags *audioTags) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	version := header[3]
+	flags := header[5]
+	size := syncsafe(header[6:10])
+	end := int64(10 + size)
+	if flags&0x10 != 0 {
+		// footer present
+		end += 10
+	}
+	if version < 2 || version > 4 || size > 2*maxPictureSize {
+		return end, errNoAudioTags
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return end, err
+	}
+	if version < 4 && flags&0x80 != 0 {
+		body = removeUnsync(body)
+	}
+
+	pos := 0
+	if version > 2 && flags&0x40 != 0 && len(body) >= 4 {
+		// skip the extended header
+		if version == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(body[0:4]))
+		} else {
+			pos = syncsafe(body[0:4])
+		}
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for pos+headerLen <= len(body) {
+		id := string(body[pos : pos+idLen])
+		if id[0] == 0 {
+			// padding
+			break
+		}
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[pos+4 : pos+8]))
+			frameFlags = binary.BigEndian.Uint16(body[pos+8 : pos+10])
+		case 4:
+			frameSize = syncsafe(body[pos+4 : pos+8])
+			frameFlags = binary.BigEndian.Uint16(body[pos+8 : pos+10])
+		}
+		pos += headerLen
+		if frameSize < 0 || pos+frameSize > len(body) {
+			break
+		}
+		data := body[pos : pos+frameSize]
+		pos += frameSize
+
+		if version == 3 {
+			if frameFlags&0x00c0 != 0 {
+				// compressed or encrypted
+				continue
+			}
+			if frameFlags&0x0020 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+		}
+		if version == 4 {
+			if frameFlags&0x000c != 0 {
+				continue
+			}
+			if frameFlags&0x0040 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+			if frameFlags&0x0001 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+			if frameFlags&0x0002 != 0 || flags&0x80 != 0 {
+				data = removeUnsync(data)
+			}
+		}
+		tags.id3Frame(id, data)
+	}
+	return end, nil
+}
+
+// names of the ID3v2 text frames we care about, in the setText naming
+var id3TextFrames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "albumartist", "TP2": "albumartist",
+	"TALB": "album", "TAL": "album",
+	"TCON": "genre", "TCO": "genre",
+	"TRCK": "tracknumber", "TRK": "tracknumber",
+	"TPOS": "discnumber", "TPA": "discnumber",
+	"TDRC": "date", "TYER": "year", "TYE": "year",
+}
+
+// the genres defined by ID3v1, still referenced by number in ID3v2 and MP4
+var id3Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock",
+	"Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack",
+	"Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop",
+	"Instrumental Rock", "Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic",
+	"Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40",
+	"Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal", "Acid Punk",
+	"Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// id3Genre resolves "(13)", "13" or "(13)Pop" style genres to their names
+func id3Genre(genre string) string {
+	g := genre
+	if strings.HasPrefix(g, "(") {
+		if i := strings.IndexByte(g, ')'); i > 0 {
+			if rest := strings.TrimSpace(g[i+1:]); rest != "" {
+				return rest
+			}
+			g = g[1:i]
+		}
+	}
+	if n, err := strconv.Atoi(g); err == nil {
+		if n >= 0 && n < len(id3Genres) {
+			return id3Genres[n]
+		}
+		return ""
+	}
+	return genre
+}
+
+// id3Frame stores the contents of one ID3v2 frame
+func (t *audioTags) id3Frame(id string, data []byte) {
+	if name, ok := id3TextFrames[id]; ok && len(data) > 1 {
+		// multiple values are separated by a terminator, keep the first one
+		value, _ := id3String(data[0], data[1:])
+		if name == "genre" {
+			value = id3Genre(value)
+		}
+		t.setText(name, value)
+		return
+	}
+	switch id {
+	case "APIC":
+		if len(data) < 4 {
+			return
+		}
+		encoding := data[0]
+		i := bytes.IndexByte(data[1:], 0)
+		if i < 0 || 1+i+2 > len(data) {
+			return
+		}
+		mime := string(data[1 : 1+i])
+		rest := data[1+i+1:]
+		pictureType := int(rest[0])
+		_, n := id3String(encoding, rest[1:])
+		t.setPicture(rest[1+n:], mime, pictureType)
+	case "PIC":
+		if len(data) < 6 {
+			return
+		}
+		mime := "image/jpeg"
+		if bytes.EqualFold(data[1:4], []byte("PNG")) {
+			mime = "image/png"
+		}
+		pictureType := int(data[4])
+		_, n := id3String(data[0], data[5:])
+		t.setPicture(data[5+n:], mime, pictureType)
+	}
+}
+
+// id3String decodes a terminated string in the given ID3v2 text encoding and
+// returns it along with the number of bytes consumed, including the terminator
+func id3String(encoding byte, b []byte) (string, int) {
+	if encoding == 1 || encoding == 2 {
+		// UTF-16, terminated by two zero bytes on an even boundary
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return decodeUTF16(b[:i], encoding == 2), i + 2
+			}
+		}
+		return decodeUTF16(b, encoding == 2), len(b)
+	}
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return decodeLatin1(b, encoding), len(b)
+	}
+	return decodeLatin1(b[:i], encoding), i + 1
+}
+
+// decodeLatin1 converts ISO-8859-1 bytes to a string, leaving UTF-8 untouched
+func decodeLatin1(b []byte, encoding byte) string {
+	if encoding == 3 {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// decodeUTF16 converts UTF-16 text honoring a byte order mark if present
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xff && b[1] == 0xfe:
+			bigEndian = false
+			b = b[2:]
+		case b[0] == 0xfe && b[1] == 0xff:
+			bigEndian = true
+			b = b[2:]
+		}
+	}
+	runes := make([]rune, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		var u uint16
+		if bigEndian {
+			u = uint16(b[i])<<8 | uint16(b[i+1])
+		} else {
+			u = uint16(b[i+1])<<8 | uint16(b[i])
+		}
+		if u >= 0xd800 && u < 0xdc00 && i+3 < len(b) {
+			var l uint16
+			if bigEndian {
+				l = uint16(b[i+2])<<8 | uint16(b[i+3])
+			} else {
+				l = uint16(b[i+3])<<8 | uint16(b[i+2])
+			}
+			runes = append(runes, (rune(u)-0xd800)<<10+(rune(l)-0xdc00)+0x10000)
+			i += 2
+			continue
+		}
+		runes = append(runes, rune(u))
+	}
+	return string(runes)
+}
+
+// readFlac walks the FLAC metadata blocks that follow the "fLaC" marker
+func readFlac(r io.ReadSeeker, tags *audioTags) error {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		if (blockType == 0 || blockType == 4 || blockType == 6) && size <= maxPictureSize {
+			block := make([]byte, size)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return err
+			}
+			switch blockType {
+			case 0:
+				tags.flacStreamInfo(block)
+			case 4:
+				tags.vorbisComments(block)
+			case 6:
+				tags.flacPicture(block)
+			}
+		} else if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// flacStreamInfo computes the duration from the STREAMINFO block
+func (t *audioTags) flacStreamInfo(b []byte) {
+	if len(b) < 18 {
+		return
+	}
+	rate := int64(b[10])<<12 | int64(b[11])<<4 | int64(b[12])>>4
+	samples := int64(b[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(b[14:18]))
+	if rate > 0 {
+		t.duration = time.Duration(samples) * time.Second / time.Duration(rate)
+	}
+}
+
+// vorbisComments parses a Vorbis comment block, as found in FLAC and Ogg files
+func (t *audioTags) vorbisComments(b []byte) {
+	next := func() []byte {
+		if len(b) < 4 {
+			return nil
+		}
+		n := int(binary.LittleEndian.Uint32(b[0:4]))
+		if n < 0 || 4+n > len(b) {
+			b = nil
+			return nil
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v
+	}
+	// vendor string
+	next()
+	if len(b) < 4 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(b[0:4]))
+	b = b[4:]
+	for i := 0; i < count; i++ {
+		comment := next()
+		if comment == nil {
+			return
+		}
+		kv := strings.SplitN(string(comment), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(kv[0])
+		if key == "metadata_block_picture" {
+			if picture, err := base64.StdEncoding.DecodeString(kv[1]); err == nil {
+				t.flacPicture(picture)
+			}
+			continue
+		}
+		t.setText(key, kv[1])
+	}
+}
+
+// flacPicture parses a METADATA_BLOCK_PICTURE
+func (t *audioTags) flacPicture(b []byte) {
+	next := func(n int) []byte {
+		if n < 0 || n > len(b) {
+			return nil
+		}
+		v := b[:n]
+		b = b[n:]
+		return v
+	}
+	u32 := func() int {
+		v := next(4)
+		if v == nil {
+			return -1
+		}
+		return int(binary.BigEndian.Uint32(v))
+	}
+	pictureType := u32()
+	mime := string(next(u32()))
+	next(u32())
+	// width, height, depth and number of colors
+	next(16)
+	data := next(u32())
+	if pictureType < 0 || data == nil {
+		return
+	}
+	t.setPicture(data, mime, pictureType)
+}
+
+// readMp4 walks the MP4 atom tree looking for the iTunes-style metadata
+func readMp4(r io.ReadSeeker, tags *audioTags) error {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	r.Seek(0, io.SeekStart)
+	return mp4Atoms(r, 0, end, "", tags)
+}
+
+func mp4Atoms(r io.ReadSeeker, start, end int64, parent string, tags *audioTags) error {
+	pos := start
+	header := make([]byte, 8)
+	for pos+8 <= end {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		name := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			large := make([]byte, 8)
+			if _, err := io.ReadFull(r, large); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(large))
+			headerSize = 16
+		}
+		if size < headerSize || pos+size > end {
+			return nil
+		}
+		bodyStart, bodyEnd := pos+headerSize, pos+size
+
+		switch {
+		case name == "mvhd" && parent == "moov":
+			body := make([]byte, 32)
+			n, _ := io.ReadFull(r, body)
+			tags.mp4Duration(body[:n])
+		case name == "moov" || name == "udta" || name == "ilst":
+			if err := mp4Atoms(r, bodyStart, bodyEnd, name, tags); err != nil {
+				return err
+			}
+		case name == "meta":
+			// meta is a full box, skip version and flags
+			if err := mp4Atoms(r, bodyStart+4, bodyEnd, name, tags); err != nil {
+				return err
+			}
+		case parent == "ilst" && size-headerSize <= maxPictureSize:
+			body := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return err
+			}
+			tags.mp4Item(name, body)
+		}
+		pos += size
+	}
+	return nil
+}
+
+// mp4Duration reads the duration out of the movie header
+func (t *audioTags) mp4Duration(b []byte) {
+	var scale, duration uint64
+	switch {
+	case len(b) >= 20 && b[0] == 0:
+		scale = uint64(binary.BigEndian.Uint32(b[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	case len(b) >= 32 && b[0] == 1:
+		scale = uint64(binary.BigEndian.Uint32(b[20:24]))
+		duration = binary.BigEndian.Uint64(b[24:32])
+	}
+	if scale > 0 {
+		t.duration = time.Duration(duration) * time.Second / time.Duration(scale)
+	}
+}
+
+// names of the iTunes text items, in the setText naming
+var mp4TextItems = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"aART":    "albumartist",
+	"\xa9alb": "album",
+	"\xa9gen": "genre",
+	"\xa9day": "date",
+}
+
+// mp4Item stores the value found in the "data" atom of an ilst item
+func (t *audioTags) mp4Item(name string, body []byte) {
+	for len(body) >= 16 {
+		size := int(binary.BigEndian.Uint32(body[0:4]))
+		if size < 16 || size > len(body) {
+			return
+		}
+		if string(body[4:8]) == "data" {
+			dataType := binary.BigEndian.Uint32(body[8:12]) & 0xffffff
+			value := body[16:size]
+			if field, ok := mp4TextItems[name]; ok {
+				t.setText(field, string(value))
+			}
+			switch name {
+			case "trkn", "disk":
+				// two bytes of padding, then the number and the total
+				if len(value) >= 4 {
+					n := int(binary.BigEndian.Uint16(value[2:4]))
+					if name == "trkn" && t.track == 0 {
+						t.track = n
+					} else if name == "disk" && t.disc == 0 {
+						t.disc = n
+					}
+				}
+			case "gnre":
+				// ID3v1 genre, off by one
+				if len(value) >= 2 {
+					n := int(binary.BigEndian.Uint16(value[0:2])) - 1
+					if n >= 0 && n < len(id3Genres) {
+						t.setText("genre", id3Genres[n])
+					}
+				}
+			case "covr":
+				mime := "image/jpeg"
+				if dataType == 14 {
+					mime = "image/png"
+				}
+				// iTunes does not tell the picture type, assume front cover
+				t.setPicture(value, mime, 3)
+			}
+		}
+		body = body[size:]
+	}
+}
+
+// readOgg reads the Vorbis comments of an Ogg Vorbis or Opus stream, and
+// computes the duration from the granule position of the last page
+func readOgg(r io.ReadSeeker, tags *audioTags) error {
+	var packets [][]byte
+	var packet []byte
+	header := make([]byte, 27)
+	// the comments are in the second packet, which may span a few pages
+	for len(packets) < 2 {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		if string(header[0:4]) != "OggS" {
+			return errNoAudioTags
+		}
+		lacing := make([]byte, header[26])
+		if _, err := io.ReadFull(r, lacing); err != nil {
+			return err
+		}
+		for _, l := range lacing {
+			segment := make([]byte, l)
+			if _, err := io.ReadFull(r, segment); err != nil {
+				return err
+			}
+			packet = append(packet, segment...)
+			if len(packet) > maxPictureSize {
+				return errNoAudioTags
+			}
+			if l < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+
+	var rate, preSkip int64
+	identification, comments := packets[0], packets[1]
+	switch {
+	case bytes.HasPrefix(identification, []byte("\x01vorbis")) && len(identification) >= 16:
+		rate = int64(binary.LittleEndian.Uint32(identification[12:16]))
+		if bytes.HasPrefix(comments, []byte("\x03vorbis")) {
+			tags.vorbisComments(comments[7:])
+		}
+	case bytes.HasPrefix(identification, []byte("OpusHead")) && len(identification) >= 12:
+		// opus granule positions are always at 48kHz
+		rate = 48000
+		preSkip = int64(binary.LittleEndian.Uint16(identification[10:12]))
+		if bytes.HasPrefix(comments, []byte("OpusTags")) {
+			tags.vorbisComments(comments[8:])
+		}
+	default:
+		return errNoAudioTags
+	}
+
+	// look for the last page in the tail of the file
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil || rate == 0 {
+		return nil
+	}
+	start := end - 65536
+	if start < 0 {
+		start = 0
+	}
+	r.Seek(start, io.SeekStart)
+	tail, _ := ioutil.ReadAll(r)
+	if i := bytes.LastIndex(tail, []byte("OggS")); i >= 0 && i+14 <= len(tail) {
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6 : i+14]))
+		if granule > preSkip {
+			tags.duration = time.Duration(granule-preSkip) * time.Second / time.Duration(rate)
+		}
+	}
+	return nil
+}
+
+// bitrates in kbps for MPEG-1 and MPEG-2/2.5, indexed by layer then bitrate index
+var mp3Bitrates = [2][3][16]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+}
+
+var mp3SampleRates = [3]int{44100, 48000, 32000}
+
+// mp3Duration estimates the duration of an MPEG audio stream starting at
+// start, using the Xing/VBRI header if present or assuming a constant bitrate
+func mp3Duration(r io.ReadSeeker, start int64, tags *audioTags) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	r.Seek(start, io.SeekStart)
+	buf := make([]byte, 8192)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+
+	// find the first frame header
+	i := 0
+	for ; i+4 <= len(buf); i++ {
+		if buf[i] == 0xff && buf[i+1]&0xe0 == 0xe0 && buf[i+1]&0x18 != 0x08 && buf[i+1]&0x06 != 0 && buf[i+2]&0xf0 != 0xf0 && buf[i+2]&0x0c != 0x0c {
+			break
+		}
+	}
+	if i+4 > len(buf) {
+		return
+	}
+	h := buf[i:]
+	version := (h[1] >> 3) & 0x03 // 3 = MPEG-1, 2 = MPEG-2, 0 = MPEG-2.5
+	layer := 4 - int((h[1]>>1)&0x03)
+	v := 1
+	if version == 3 {
+		v = 0
+	}
+	bitrate := mp3Bitrates[v][layer-1][h[2]>>4] * 1000
+	rate := mp3SampleRates[(h[2]>>2)&0x03]
+	switch version {
+	case 2:
+		rate /= 2
+	case 0:
+		rate /= 4
+	}
+	samplesPerFrame := 1152
+	if layer == 1 {
+		samplesPerFrame = 384
+	} else if layer == 3 && version != 3 {
+		samplesPerFrame = 576
+	}
+
+	// offset of the Xing header depends on the side information size
+	mono := h[3]>>6 == 3
+	xing := 4 + 32
+	switch {
+	case version == 3 && mono:
+		xing = 4 + 17
+	case version != 3 && !mono:
+		xing = 4 + 17
+	case version != 3 && mono:
+		xing = 4 + 9
+	}
+	frames := 0
+	if xing+12 <= len(h) && (string(h[xing:xing+4]) == "Xing" || string(h[xing:xing+4]) == "Info") {
+		if binary.BigEndian.Uint32(h[xing+4:xing+8])&1 != 0 {
+			frames = int(binary.BigEndian.Uint32(h[xing+8 : xing+12]))
+		}
+	} else if 36+18 <= len(h) && string(h[36:40]) == "VBRI" {
+		frames = int(binary.BigEndian.Uint32(h[36+14 : 36+18]))
+	}
+
+	switch {
+	case frames > 0:
+		tags.duration = time.Duration(frames*samplesPerFrame) * time.Second / time.Duration(rate)
+	case bitrate > 0:
+		audioSize := end - start - int64(i)
+		tags.duration = time.Duration(audioSize*8) * time.Second / time.Duration(bitrate)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var testPicture = []byte("\x89PNG\r\n\x1a\nnot really a png")
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	f, err := ioutil.TempFile("", name)
+	if err != nil {
+		t.Fatalf("TempFile failed: %s", err.Error())
+	}
+	f.Write(data)
+	f.Close()
+	return f.Name()
+}
+
+func id3v23Frame(id string, data []byte) []byte {
+	b := new(bytes.Buffer)
+	b.WriteString(id)
+	binary.Write(b, binary.BigEndian, uint32(len(data)))
+	b.Write([]byte{0, 0})
+	b.Write(data)
+	return b.Bytes()
+}
+
+func id3v23Tag(frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	size := len(body)
+	b := new(bytes.Buffer)
+	b.WriteString("ID3")
+	b.Write([]byte{3, 0, 0})
+	b.Write([]byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)})
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestReadID3v2Picture(t *testing.T) {
+	apic := append([]byte("\x00image/png\x00\x03cover\x00"), testPicture...)
+	other := []byte("\x00image/jpeg\x00\x04back\x00other")
+	// UTF-16 title with a byte order mark
+	title := []byte("\x01\xff\xfeS\x00o\x00n\x00g\x00\x00\x00")
+	data := id3v23Tag(id3v23Frame("APIC", other), id3v23Frame("APIC", apic), id3v23Frame("TIT2", title),
+		id3v23Frame("TPE1", []byte("\x00Artist")), id3v23Frame("TRCK", []byte("\x003/12")),
+		id3v23Frame("TCON", []byte("\x00(17)")))
+	// one 128kbps 44.1kHz MPEG-1 layer III frame header, then silence
+	data = append(data, []byte{0xff, 0xfb, 0x90, 0x00}...)
+	data = append(data, make([]byte, 160000-4)...)
+	path := writeTestFile(t, "tags.mp3", data)
+	defer os.Remove(path)
+
+	tags, err := readAudioTags(path)
+	if err != nil {
+		t.Fatalf("readAudioTags failed: %s", err.Error())
+	}
+	if !bytes.Equal(tags.picture, testPicture) {
+		t.Errorf("Expected the front cover, got %q", tags.picture)
+	}
+	if tags.pictureMime != "image/png" {
+		t.Errorf("Wrong picture mime type: %s", tags.pictureMime)
+	}
+	if tags.title != "Song" || tags.artist != "Artist" || tags.track != 3 || tags.genre != "Rock" {
+		t.Errorf("Wrong text tags: %q %q %d %q", tags.title, tags.artist, tags.track, tags.genre)
+	}
+	if tags.duration.Seconds() < 9.9 || tags.duration.Seconds() > 10.1 {
+		t.Errorf("Expected a duration of 10s, got %s", tags.duration)
+	}
+}
+
+func TestReadFlacPicture(t *testing.T) {
+	block := new(bytes.Buffer)
+	binary.Write(block, binary.BigEndian, uint32(3))
+	binary.Write(block, binary.BigEndian, uint32(len("image/png")))
+	block.WriteString("image/png")
+	binary.Write(block, binary.BigEndian, uint32(0))
+	block.Write(make([]byte, 16))
+	binary.Write(block, binary.BigEndian, uint32(len(testPicture)))
+	block.Write(testPicture)
+
+	comments := new(bytes.Buffer)
+	binary.Write(comments, binary.LittleEndian, uint32(0))
+	binary.Write(comments, binary.LittleEndian, uint32(2))
+	for _, c := range []string{"ALBUM=Album", "TRACKNUMBER=7"} {
+		binary.Write(comments, binary.LittleEndian, uint32(len(c)))
+		comments.WriteString(c)
+	}
+
+	// 44.1kHz, 441000 samples
+	streamInfo := make([]byte, 34)
+	streamInfo[10], streamInfo[11], streamInfo[12] = 0x0a, 0xc4, 0x42
+	binary.BigEndian.PutUint32(streamInfo[14:18], 441000)
+
+	b := new(bytes.Buffer)
+	b.WriteString("fLaC")
+	b.Write([]byte{0, 0, 0, 34})
+	b.Write(streamInfo)
+	b.Write([]byte{4, 0, 0, byte(comments.Len())})
+	b.Write(comments.Bytes())
+	size := block.Len()
+	b.Write([]byte{0x80 | 6, byte(size >> 16), byte(size >> 8), byte(size)})
+	b.Write(block.Bytes())
+	path := writeTestFile(t, "tags.flac", b.Bytes())
+	defer os.Remove(path)
+
+	tags, err := readAudioTags(path)
+	if err != nil {
+		t.Fatalf("readAudioTags failed: %s", err.Error())
+	}
+	if !bytes.Equal(tags.picture, testPicture) {
+		t.Errorf("Wrong picture: %q", tags.picture)
+	}
+	if tags.album != "Album" || tags.track != 7 {
+		t.Errorf("Wrong text tags: %q %d", tags.album, tags.track)
+	}
+	if tags.duration.Seconds() != 10 {
+		t.Errorf("Expected a duration of 10s, got %s", tags.duration)
+	}
+}
+
+func mp4Atom(name string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint32(8+len(body)))
+	b.WriteString(name)
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestReadMp4Picture(t *testing.T) {
+	data := append([]byte{0, 0, 0, 14, 0, 0, 0, 0}, testPicture...)
+	ilst := mp4Atom("ilst", mp4Atom("covr", mp4Atom("data", data)))
+	meta := mp4Atom("meta", []byte{0, 0, 0, 0}, mp4Atom("hdlr", make([]byte, 25)), ilst)
+	file := append(mp4Atom("ftyp", []byte("M4A \x00\x00\x00\x00")), mp4Atom("mdat", make([]byte, 64))...)
+	file = append(file, mp4Atom("moov", mp4Atom("udta", meta))...)
+	path := writeTestFile(t, "tags.m4a", file)
+	defer os.Remove(path)
+
+	tags, err := readAudioTags(path)
+	if err != nil {
+		t.Fatalf("readAudioTags failed: %s", err.Error())
+	}
+	if !bytes.Equal(tags.picture, testPicture) {
+		t.Errorf("Wrong picture: %q", tags.picture)
+	}
+	if tags.pictureMime != "image/png" {
+		t.Errorf("Wrong picture mime type: %s", tags.pictureMime)
+	}
+}
@@ -0,0 +1,381 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// where the audit log goes unless audit.file says otherwise. An empty
+// audit.file sends the entries to the main log
+const AUDIT_FILE = "/var/log/amahi-anywhere-audit.log"
+
+// the size the audit log grows to before it is rotated, unless audit.max_size
+// says otherwise. The previous one is kept, with ".1" added to its name
+const defaultAuditMaxSize = 10 << 20
+
+// the longest line of the audit log we read
+const maxAuditLine = 1 << 20
+
+// the outcomes of audited events
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+// the most entries a query of the audit log answers with
+const (
+	auditQueryLimit    = 100
+	auditQueryMaxLimit = 1000
+)
+
+// auditEntry is a line of the audit log
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	User    string    `json:"user,omitempty"`
+	Origin  string    `json:"origin"`
+	Client  string    `json:"client"`
+	Outcome string    `json:"outcome"`
+	Share   string    `json:"share,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// auditWriter appends the entries to the audit log, one JSON object a line
+type auditWriter struct {
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	sync.Mutex
+}
+
+// auditLog is set up once the configuration is loaded
+var auditLog *auditWriter
+
+func initAuditLog() {
+	path := config.String("audit.file", AUDIT_FILE)
+	if path == "" {
+		return
+	}
+	w, err := openAuditLog(path, int64(config.Int("audit.max_size", defaultAuditMaxSize)))
+	if err != nil {
+		logging.Error("Error opening audit log %s, auditing to the main log: %s", path, err.Error())
+		return
+	}
+	auditLog = w
+}
+
+// openAuditLog opens the audit log at path for appending, to be rotated when
+// it reaches maxSize bytes, or never if maxSize is 0
+func openAuditLog(path string, maxSize int64) (*auditWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &auditWriter{path: path, file: file, maxSize: maxSize}
+	if fi, err := file.Stat(); err == nil {
+		w.size = fi.Size()
+	}
+	return w, nil
+}
+
+func (w *auditWriter) write(e *auditEntry) {
+	line, _ := json.Marshal(e)
+	w.Lock()
+	defer w.Unlock()
+	n, err := w.file.Write(append(line, '\n'))
+	if err != nil {
+		logging.Error("Error writing audit log: %s", err.Error())
+	}
+	w.size += int64(n)
+	if w.maxSize > 0 && w.size >= w.maxSize {
+		w.rotate()
+	}
+}
+
+// rotate moves the audit log to the name with ".1", in place of the previous
+// one, and starts a new one
+func (w *auditWriter) rotate() {
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		logging.Error("Error rotating audit log: %s", err.Error())
+		return
+	}
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		// keep writing to the rotated one
+		logging.Error("Error opening audit log %s: %s", w.path, err.Error())
+		return
+	}
+	w.file.Close()
+	w.file = file
+	w.size = 0
+}
+
+// clientAddress returns the address of the client. Requests through the relay
+// come from it, with the address of the client last in X-Forwarded-For. On
+// the LAN the header is whatever the client says, it is not taken
+func clientAddress(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && viaRelay(r) {
+		addresses := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addresses[len(addresses)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestOrigin tells whether a request came through the relay or on the LAN
+func requestOrigin(r *http.Request) string {
+	if viaRelay(r) {
+		return "relay"
+	}
+	return "local"
+}
+
+// audit records a security related event, such as a failed login, with the
+// user who did it, if known
+func audit(r *http.Request, event, outcome, user, format string, a ...interface{}) {
+	e := &auditEntry{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		User:    user,
+		Origin:  requestOrigin(r),
+		Client:  clientAddress(r),
+		Outcome: outcome,
+		Share:   r.URL.Query().Get("s"),
+		Path:    r.URL.Query().Get("p"),
+		Detail:  fmt.Sprintf(format, a...),
+	}
+	if auditLog == nil {
+		logging.Warning("AUDIT %s %s by %q from %s (%s): %s", e.Event, e.Outcome, e.User, e.Client, e.Origin, e.Detail)
+		return
+	}
+	auditLog.write(e)
+}
+
+// requester names who made a request for the audit log: the login of the
+// user, the admin, or nobody for anonymous requests
+func (service *MercuryFsService) requester(r *http.Request) string {
+	if hasAdminCredentials(r) {
+		return "admin"
+	}
+	if t := service.apiTokenFor(r); t != nil {
+		return t.user.Login + " (token " + t.Name + ")"
+	}
+	if user := service.Users.find(parseAuthToken(r)); user != nil {
+		if user.IsDemo {
+			return "demo"
+		}
+		return user.Login
+	}
+	return ""
+}
+
+// auditOutcome is the outcome of a request answered with status
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditDenied
+	case status >= 400:
+		return auditFailure
+	}
+	return auditSuccess
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// audited records the requests to a handler in the audit log, whether they
+// are answered or denied. It goes last in use, to see the denials too
+func (service *MercuryFsService) audited(event string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(pass http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			recorder := &statusRecorder{ResponseWriter: w}
+			pass(recorder, r)
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			detail := fmt.Sprintf("%s answered %d", r.Method, recorder.status)
+			if to := r.URL.Query().Get("to"); to != "" {
+				detail += ", to " + to
+			}
+			if r.MultipartForm != nil {
+				for _, f := range r.MultipartForm.File["file"] {
+					detail += ", file " + f.Filename
+				}
+			}
+			audit(r, event, auditOutcome(recorder.status), service.requester(r), "%s", detail)
+		}
+	}
+}
+
+// auditFilter picks entries of the audit log by the parameters of a query
+type auditFilter struct {
+	event, user, outcome, origin string
+	since, until                 time.Time
+}
+
+func (f *auditFilter) matches(e *auditEntry) bool {
+	return (f.event == "" || e.Event == f.event) &&
+		(f.user == "" || e.User == f.user) &&
+		(f.outcome == "" || e.Outcome == f.outcome) &&
+		(f.origin == "" || e.Origin == f.origin) &&
+		(f.since.IsZero() || !e.Time.Before(f.since)) &&
+		(f.until.IsZero() || e.Time.Before(f.until))
+}
+
+// query returns the latest entries that match, newest first. The log is
+// read from the end, the rotated one after, until there are enough of them
+// or the entries are older than the filter wants
+func (w *auditWriter) query(f *auditFilter, limit int) ([]*auditEntry, error) {
+	result := make([]*auditEntry, 0)
+	for _, path := range []string{w.path, w.path + ".1"} {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) && path != w.path {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		older := false
+		err = eachLineBackwards(file, func(line []byte) bool {
+			e := new(auditEntry)
+			if json.Unmarshal(line, e) != nil {
+				return true
+			}
+			if !f.since.IsZero() && e.Time.Before(f.since) {
+				older = true
+				return false
+			}
+			if f.matches(e) {
+				result = append(result, e)
+			}
+			return len(result) < limit
+		})
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if older || len(result) >= limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// eachLineBackwards calls fn with the lines of the file, the last one first,
+// until fn returns false. Lines longer than maxAuditLine are dropped in part
+func eachLineBackwards(file *os.File, fn func(line []byte) bool) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	const chunk = 64 * 1024
+	offset := fi.Size()
+	var rest []byte
+	for offset > 0 {
+		n := int64(chunk)
+		if n > offset {
+			n = offset
+		}
+		offset -= n
+		buf := make([]byte, n, n+int64(len(rest)))
+		if _, err := file.ReadAt(buf, offset); err != nil {
+			return err
+		}
+		lines := bytes.Split(append(buf, rest...), []byte{'\n'})
+		// the first line may start in the chunk before
+		rest = lines[0]
+		if len(rest) > maxAuditLine {
+			rest = nil
+		}
+		for i := len(lines) - 1; i > 0; i-- {
+			if len(lines[i]) > 0 && !fn(lines[i]) {
+				return nil
+			}
+		}
+	}
+	if len(rest) > 0 {
+		fn(rest)
+	}
+	return nil
+}
+
+// serveAudit answers the admin with the latest entries of the audit log, which
+// can be picked by "event", "user", "outcome", "origin" and the "since" and
+// "until" times (RFC 3339), up to "limit" of them
+func (service *MercuryFsService) serveAudit(writer http.ResponseWriter, request *http.Request) {
+	if auditLog == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	q := request.URL.Query()
+	f := &auditFilter{event: q.Get("event"), user: q.Get("user"), outcome: q.Get("outcome"), origin: q.Get("origin")}
+	var err error
+	if s := q.Get("since"); s != "" {
+		f.since, err = time.Parse(time.RFC3339, s)
+	}
+	if s := q.Get("until"); s != "" && err == nil {
+		f.until, err = time.Parse(time.RFC3339, s)
+	}
+	limit := auditQueryLimit
+	if s := q.Get("limit"); s != "" && err == nil {
+		limit, err = strconv.Atoi(s)
+		if limit < 1 || limit > auditQueryMaxLimit {
+			limit = auditQueryMaxLimit
+		}
+	}
+	if err != nil {
+		http.Error(writer, "Bad Request", http.StatusBadRequest)
+		service.accessLog(logging, request, http.StatusBadRequest, 0)
+		return
+	}
+	entries, err := auditLog.query(f, limit)
+	if err != nil {
+		logging.Error("Error reading audit log: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	data, _ := json.Marshal(entries)
+	service.serveJSON(writer, request, string(data))
+}
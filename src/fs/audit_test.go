@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amahi-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if logging == nil {
+		// the handlers log their requests
+		initializeLogging(filepath.Join(os.TempDir(), "amahi-test", "test.log"), splitNone, false)
+	}
+	path := filepath.Join(dir, "audit.log")
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	defer file.Close()
+	savedLog, savedAuth := auditLog, adminAuth
+	auditLog = &auditWriter{path: path, file: file}
+	adminAuth = &adminCredentials{token: "secret", anonymous: anonymousDeny}
+	defer func() { auditLog, adminAuth = savedLog, savedAuth }()
+
+	users := NewHdaUsers(true)
+	service := &MercuryFsService{Users: users, debugInfo: new(debugInfo), info: new(HdaInfo)}
+	session, _ := users.queryUser("1234", "phone", "app", false)
+
+	request := httptest.NewRequest("POST", "/auth", nil)
+	request = request.WithContext(context.WithValue(request.Context(), relayConnection{}, true))
+	request.Header.Set("X-Forwarded-For", "203.0.113.9")
+	audit(request, "pin-failed", auditFailure, "", "wrong PIN")
+	spoofed := httptest.NewRequest("POST", "/auth", nil)
+	spoofed.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if client := clientAddress(spoofed); client != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For taken on the LAN: %s", client)
+	}
+
+	deleted := use(func(w http.ResponseWriter, r *http.Request) {}, service.shareWriteAccess, service.audited("file-deleted"))
+	request = httptest.NewRequest("DELETE", "/files?s=docs&p=/a.txt", nil)
+	request.Header.Set("Authorization", session.AuthToken)
+	deleted(httptest.NewRecorder(), request)
+	deleted(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/files?s=docs&p=/b.txt", nil))
+
+	query := func(q string) []auditEntry {
+		request := httptest.NewRequest("GET", "/audit"+q, nil)
+		request.Header.Set("Authorization", "secret")
+		writer := httptest.NewRecorder()
+		use(service.serveAudit, service.adminOnly)(writer, request)
+		var entries []auditEntry
+		if err := json.Unmarshal(writer.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("Audit query %s gave %d %s", q, writer.Code, writer.Body.String())
+		}
+		return entries
+	}
+	entries := query("")
+	if len(entries) != 3 || entries[0].Path != "/b.txt" || entries[0].Outcome != auditDenied {
+		t.Fatalf("Audit log is %+v", entries)
+	}
+	if e := entries[1]; e.User != "demo" || e.Outcome != auditSuccess || e.Share != "docs" || e.Origin != "local" {
+		t.Errorf("Delete entry is %+v", e)
+	}
+	if e := entries[2]; e.Origin != "relay" || e.Client != "203.0.113.9" || e.Event != "pin-failed" {
+		t.Errorf("Login entry is %+v", e)
+	}
+	if entries = query("?event=file-deleted&limit=1"); len(entries) != 1 || entries[0].Path != "/b.txt" {
+		t.Errorf("Filtered audit log is %+v", entries)
+	}
+	if entries = query("?user=demo"); len(entries) != 1 {
+		t.Errorf("Audit log of a user is %+v", entries)
+	}
+
+	request = httptest.NewRequest("GET", "/audit", nil)
+	request.Header.Set("Authorization", session.AuthToken)
+	writer := httptest.NewRecorder()
+	use(service.serveAudit, service.adminOnly)(writer, request)
+	if writer.Code != http.StatusForbidden {
+		t.Errorf("Audit log served to a user: %d", writer.Code)
+	}
+	// while migrating to credentials, anonymous requests are still not the admin here
+	adminAuth = &adminCredentials{token: "secret", anonymous: anonymousLog}
+	writer = httptest.NewRecorder()
+	use(service.serveAudit, service.adminOnly)(writer, httptest.NewRequest("GET", "/audit", nil))
+	if writer.Code != http.StatusForbidden {
+		t.Errorf("Audit log served to an anonymous request: %d", writer.Code)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amahi-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	w, err := openAuditLog(path, 100*1024)
+	if err != nil {
+		t.Fatalf("openAuditLog failed: %s", err.Error())
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 4000; i++ {
+		event := "file-deleted"
+		if i == 0 || i == 3900 {
+			event = "pin-failed"
+		}
+		w.write(&auditEntry{Time: start.Add(time.Duration(i) * time.Second), Event: event, Detail: strconv.Itoa(i)})
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() >= 100*1024 {
+		t.Errorf("Audit log not rotated: %v", fi)
+	}
+	if !exists(path + ".1") {
+		t.Errorf("Rotated audit log not kept")
+	}
+
+	entries, err := w.query(&auditFilter{}, 3)
+	if err != nil || len(entries) != 3 || entries[0].Detail != "3999" || entries[2].Detail != "3997" {
+		t.Errorf("Latest entries are %+v (%v)", entries, err)
+	}
+	// across the rotation, but not from before the previous one
+	entries, _ = w.query(&auditFilter{event: "pin-failed"}, 10)
+	if len(entries) != 1 || entries[0].Detail != "3900" {
+		t.Errorf("Entries of an event are %+v", entries)
+	}
+	entries, _ = w.query(&auditFilter{since: start.Add(3995 * time.Second)}, 100)
+	if len(entries) != 5 {
+		t.Errorf("%d entries since a time", len(entries))
+	}
+}
@@ -1,14 +1,163 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// what is done with requests that carry no credentials, set by auth.anonymous
+const (
+	// they are answered with 401 Unauthorized
+	anonymousDeny = "deny"
+	// they are served as admin, and logged as they would be denied. This is
+	// the default, to find the clients that need credentials before denying
+	anonymousLog = "log"
+	// they are served as admin, as they used to be
+	anonymousAdmin = "admin"
+)
+
+// how far the time of a relay signed request can be from ours
+const adminSignatureWindow = 5 * time.Minute
+
+// adminCredentials is what makes a request come from the admin: the admin
+// token (auth.admin_token, usually set in the HDA database), or the headers
+// signed by the relay with the API key of the HDA
+type adminCredentials struct {
+	token     string
+	relayKey  []byte
+	anonymous string
+	// the nonces of the relay signed requests taken, until their time is
+	// out of the window, so that no signed request is taken twice
+	nonces map[string]time.Time
+	sync.Mutex
+}
+
+// adminAuth is set up once the configuration is loaded
+var adminAuth = &adminCredentials{anonymous: anonymousLog}
+
+func initAdminAuth(apiKey string) {
+	policy := config.String("auth.anonymous", anonymousLog)
+	if policy != anonymousDeny && policy != anonymousLog && policy != anonymousAdmin {
+		logging.Warning("Unknown policy for anonymous requests %s, using %s", policy, anonymousLog)
+		policy = anonymousLog
+	}
+	adminAuth = &adminCredentials{
+		token:     config.String("auth.admin_token", ""),
+		relayKey:  []byte(apiKey),
+		anonymous: policy,
+	}
+	if policy == anonymousDeny && adminAuth.token == "" {
+		logging.Warning("No admin token set, only requests signed by the relay are admin")
+	}
+}
+
+// relaySignature signs a request for the admin: the relay sends the time in
+// X-Admin-Timestamp, a value it never sends again in X-Admin-Nonce, and this
+// in X-Admin-Signature
+func (a *adminCredentials) relaySignature(timestamp, nonce, method, uri string) string {
+	mac := hmac.New(sha256.New, a.relayKey)
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + method + "\n" + uri))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *adminCredentials) relaySigned(r *http.Request) bool {
+	timestamp, nonce, sig := r.Header.Get("X-Admin-Timestamp"), r.Header.Get("X-Admin-Nonce"), r.Header.Get("X-Admin-Signature")
+	if timestamp == "" || nonce == "" || sig == "" || len(a.relayKey) == 0 {
+		return false
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	signedAt := time.Unix(t, 0)
+	if d := time.Since(signedAt); d > adminSignatureWindow || d < -adminSignatureWindow {
+		return false
+	}
+	expected := a.relaySignature(timestamp, nonce, r.Method, r.URL.RequestURI())
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return false
+	}
+	return a.takeNonce(nonce, signedAt)
+}
+
+// takeNonce records the nonce of a signed request, it tells whether it was
+// not taken before
+func (a *adminCredentials) takeNonce(nonce string, signedAt time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	for n, at := range a.nonces {
+		if now.Sub(at) > adminSignatureWindow {
+			delete(a.nonces, n)
+		}
+	}
+	if _, taken := a.nonces[nonce]; taken {
+		return false
+	}
+	if a.nonces == nil {
+		a.nonces = make(map[string]time.Time)
+	}
+	a.nonces[nonce] = signedAt
+	return true
+}
+
+// adminCheck is what is known of the admin credentials of a request. They are
+// checked once, as the nonce of a relay signature can only be taken once, and
+// an anonymous request is logged once however many times it is checked
+type adminCheck struct {
+	checked sync.Once
+	admin   bool
+	logged  sync.Once
+}
+
+// adminCheckKey is the key of the adminCheck in the context of a request
+type adminCheckKey struct{}
+
+// withAdminCheck readies a request for checking its admin credentials
+func withAdminCheck(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminCheckKey{}, new(adminCheck)))
+}
+
+// adminCheckOf returns the adminCheck of a request. Requests that were not
+// readied for it are checked from scratch each time
+func adminCheckOf(r *http.Request) *adminCheck {
+	if check, ok := r.Context().Value(adminCheckKey{}).(*adminCheck); ok {
+		return check
+	}
+	return new(adminCheck)
+}
+
+// hasAdminCredentials tells whether a request has the admin token or is
+// signed by the relay, whatever auth.anonymous says
+func hasAdminCredentials(r *http.Request) bool {
+	check := adminCheckOf(r)
+	check.checked.Do(func() {
+		token := parseAuthToken(r)
+		check.admin = (adminAuth.token != "" && hmac.Equal([]byte(token), []byte(adminAuth.token))) || adminAuth.relaySigned(r)
+	})
+	return check.admin
+}
+
+// logAnonymous logs a request that would be denied, once for the request
+func (a *adminCredentials) logAnonymous(r *http.Request) {
+	adminCheckOf(r).logged.Do(func() {
+		logging.Warning("Anonymous request %s %s from %s would be denied with auth.anonymous = deny",
+			r.Method, r.URL.Path, r.RemoteAddr)
+	})
+}
+
+// use wraps a handler in middleware, the last one runs first. The access
+// checks go after restrictCache, so that what is in a share is not told
+// to anyone who cannot read it
 func use(h http.HandlerFunc, middleware ...func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
 	for _, m := range middleware {
 		h = m(h)
@@ -24,9 +173,39 @@ func parseAuthToken(r *http.Request) (authToken string) {
 	return
 }
 
+// isAdmin tells whether a request is served as the admin: it has admin
+// credentials, or it is anonymous and auth.anonymous lets it through
 func isAdmin(r *http.Request) bool {
-	// if Authorization header is not present, this is admin user
-	return parseAuthToken(r) == ""
+	if hasAdminCredentials(r) {
+		return true
+	}
+	if parseAuthToken(r) != "" {
+		// a user
+		return false
+	}
+	switch adminAuth.anonymous {
+	case anonymousAdmin:
+		return true
+	case anonymousLog:
+		adminAuth.logAnonymous(r)
+		return true
+	}
+	return false
+}
+
+// adminOnly lets through the requests with admin credentials only. The
+// endpoints behind it never served anonymous requests, so auth.anonymous does
+// not apply to them
+func (service *MercuryFsService) adminOnly(pass http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasAdminCredentials(r) {
+			audit(r, "admin-denied", auditDenied, service.requester(r), "%s %s", r.Method, r.URL.Path)
+			http.Error(w, "Access Forbidden", http.StatusForbidden)
+			service.accessLog(logging, r, http.StatusForbidden, 0)
+			return
+		}
+		pass(w, r)
+	}
 }
 
 func (service *MercuryFsService) authenticate(writer http.ResponseWriter, request *http.Request) {
@@ -46,12 +225,27 @@ func (service *MercuryFsService) authenticate(writer http.ResponseWriter, reques
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	// PINs are short, guessing them is slowed down
+	client := clientAddress(request)
+	if wait, ok := service.pins.allow(client); !ok {
+		audit(request, "pin-blocked", auditDenied, "", "PIN attempt while locked out for %s", wait)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(writer, "Too Many Attempts", http.StatusTooManyRequests)
+		return
+	}
+	// the device name is optional, it helps users tell their sessions apart
+	device, _ := data["device"].(string)
+	// clients that renew their access token ask for a refresh token
+	refresh, _ := data["refresh"].(bool)
 	// query user for the given pin from the list of all users
-	authToken, err := service.Users.queryUser(pin)
+	user, err := service.Users.lookupUser(pin)
 	switch {
 	case err == sql.ErrNoRows: // if no such user exits, send 401 Unauthorized
-		//log("No user with pin: %s", pin)
-		logging.Error("No user with pin: %s", pin)
+		wait := service.pins.failed(client)
+		audit(request, "pin-failed", auditFailure, "", "wrong PIN, next attempt in %s", wait)
+		if wait > 0 {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		}
 		http.Error(writer, "Authentication Failed", http.StatusUnauthorized)
 		break
 	case err != nil: // if some other error, send 500 Internal Server Error
@@ -60,17 +254,80 @@ func (service *MercuryFsService) authenticate(writer http.ResponseWriter, reques
 		logging.Error(err.Error())
 		break
 	default: // if no error, send proper auth token for that user
-		respJson := fmt.Sprintf("{\"auth_token\": \"%s\"}", *authToken)
-		writer.WriteHeader(http.StatusOK)
-		size := int64(len(respJson))
-		writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-		writer.Header().Set("Content-Type", "application/json")
-		writer.Write([]byte(respJson))
+		// the second step, for users with a second factor
+		if e := service.totpRequired(request, user); e != nil {
+			// asking for the code counts as a failed attempt, or the answer
+			// would tell right PINs apart for free
+			code, _ := data["totp"].(string)
+			if code == "" {
+				if wait := service.pins.failed(client); wait > 0 {
+					writer.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				}
+				totpRequired(writer)
+				return
+			}
+			if !service.store.checkTotp(request, user, e, code) {
+				wait := service.pins.failed(client)
+				audit(request, "totp-failed", auditFailure, user.Login, "wrong code, next attempt in %s", wait)
+				if wait > 0 {
+					writer.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				}
+				totpRequired(writer)
+				return
+			}
+		}
+		service.pins.succeeded(client)
+		writeTokens(writer, service.Users.newSession(user, device, request.Header.Get("User-Agent"), refresh))
+		audit(request, "login", auditSuccess, user.Login, "on %q", device)
+	}
+}
+
+// totpRequired asks for the code of the second factor, in the "totp" field
+// along with the PIN
+func totpRequired(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusUnauthorized)
+	writer.Write([]byte(`{"totp_required": true}`))
+}
+
+func writeTokens(writer http.ResponseWriter, tokens *sessionTokens) {
+	respJson, _ := json.Marshal(tokens)
+	size := int64(len(respJson))
+	writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(respJson)
+}
+
+// refreshSession answers a refresh token with a new access token and a new
+// refresh token. A refresh token used twice ends its session
+func (service *MercuryFsService) refreshSession(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	var data struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&data); err != nil || data.RefreshToken == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	tokens, user, err := service.Users.refresh(data.RefreshToken)
+	switch err {
+	case nil:
+		writeTokens(writer, tokens)
+	case errRefreshTokenReused:
+		audit(request, "refresh-reused", auditDenied, user.Login, "used refresh token of the session on %q, session ended", user.Device)
+		http.Error(writer, "Authentication Failed", http.StatusUnauthorized)
+	default:
+		http.Error(writer, "Authentication Failed", http.StatusUnauthorized)
 	}
 }
 
 func (service *MercuryFsService) logout(w http.ResponseWriter, r *http.Request) {
 	authToken := parseAuthToken(r)
+	if user := service.Users.find(authToken); user != nil {
+		audit(r, "logout", auditSuccess, user.Login, "on %q", user.Device)
+	}
 	service.Users.remove(authToken)
 	w.WriteHeader(http.StatusOK)
 }
@@ -85,10 +342,52 @@ func (service *MercuryFsService) checkAuthHeader(w http.ResponseWriter, r *http.
 	return
 }
 
+// userKey identifies the requester in the local store: "user:<id>" for HDA
+// users, "demo" for the demo user and "admin" for the admin.
+// It does not answer the request, ok is false when the token is not valid
+func (service *MercuryFsService) userKey(r *http.Request) (key string, ok bool) {
+	if isAdmin(r) {
+		return "admin", true
+	}
+	user := service.Users.find(parseAuthToken(r))
+	if user == nil {
+		return "", false
+	}
+	if user.IsDemo {
+		return "demo", true
+	}
+	return "user:" + strconv.Itoa(user.id), true
+}
+
+// readableShares returns the names of the shares the requester can read, or nil
+// when there is no restriction. When ok is false the request was already answered
+func (service *MercuryFsService) readableShares(w http.ResponseWriter, r *http.Request) (names []string, ok bool) {
+	if isAdmin(r) {
+		return nil, true
+	}
+	user := service.checkAuthHeader(w, r)
+	if user == nil {
+		return nil, false
+	}
+	if service.Shares.rootDir != "" || user.IsDemo {
+		return nil, true
+	}
+	shares, err := user.AvailableShares()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	names = make([]string, 0)
+	for i := range shares {
+		names = append(names, shares[i].name)
+	}
+	return names, true
+}
+
 func (service *MercuryFsService) authMiddleware(pass http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if isAdmin(r) {
-			// auth header is not present, pass as this is admin user
+			// the admin
 			pass(w, r)
 		} else {
 			// auth header is present, pass only if a user exists for the given auth_token
@@ -102,9 +401,15 @@ func (service *MercuryFsService) authMiddleware(pass http.HandlerFunc) http.Hand
 
 func (service *MercuryFsService) shareReadAccess(pass http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if isAdmin(r) {
-			// auth header is not present, pass as this is admin user
+		if service.hasValidSignature(r) {
+			// signed link to this very file, e.g. from a playlist
 			pass(w, r)
+		} else if isAdmin(r) {
+			// the admin
+			pass(w, r)
+		} else if token := service.apiTokenFor(r); token != nil {
+			// scoped to some shares
+			service.scopedAccess(w, r, token, false, pass)
 		} else {
 			user := service.checkAuthHeader(w, r)
 			// if user is nil, we have already responded with 401 Unauthorized, so return
@@ -132,12 +437,22 @@ func (service *MercuryFsService) restrictCache(pass http.HandlerFunc) http.Handl
 	return func(w http.ResponseWriter, r *http.Request) {
 		share := r.URL.Query().Get("s")
 		path := r.URL.Query().Get("p")
-		fullPath, _ := service.fullPathToFile(share, path)
+		fullPath, err := service.fullPathToFile(share, path)
+		if err == errOutsideShare || err == errSymlinkDenied {
+			http.Error(w, "Access Forbidden", http.StatusForbidden)
+			return
+		}
 
 		if strings.Contains(fullPath, ".fscache") {
 			http.Error(w, "Cannot access cache via /files", http.StatusForbidden)
 			return
 		}
+		// hidden files are not there, as far as clients know
+		hidden := hiddenIn(share)
+		if hidden.hides(path) || (r.URL.Query().Get("to") != "" && hidden.hides(r.URL.Query().Get("to"))) {
+			http.NotFound(w, r)
+			return
+		}
 
 		pass(w, r)
 	}
@@ -146,8 +461,11 @@ func (service *MercuryFsService) restrictCache(pass http.HandlerFunc) http.Handl
 func (service *MercuryFsService) shareWriteAccess(pass http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if isAdmin(r) {
-			// auth header is not present, pass as this is admin user
+			// the admin
 			pass(w, r)
+		} else if token := service.apiTokenFor(r); token != nil {
+			// scoped to some shares, for writing if it says so
+			service.scopedAccess(w, r, token, true, pass)
 		} else {
 			user := service.checkAuthHeader(w, r)
 			// if user is nil, we have already responded with 401 Unauthorized, so return
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIsAdmin(t *testing.T) {
+	saved := adminAuth
+	defer func() { adminAuth = saved }()
+
+	adminAuth = &adminCredentials{token: "secret", relayKey: []byte("api-key"), anonymous: anonymousDeny}
+	if isAdmin(httptest.NewRequest("GET", "/files?s=a&p=/", nil)) {
+		t.Errorf("Anonymous request is admin")
+	}
+	request := httptest.NewRequest("GET", "/files?s=a&p=/", nil)
+	request.Header.Set("Authorization", "secret")
+	if !isAdmin(request) {
+		t.Errorf("Admin token not taken")
+	}
+	request.Header.Set("Authorization", "user-token")
+	if isAdmin(request) {
+		t.Errorf("User token is admin")
+	}
+
+	// signed by the relay
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := func(method, uri, timestamp, nonce, signedURI string) *http.Request {
+		request := withAdminCheck(httptest.NewRequest(method, uri, nil))
+		request.Header.Set("X-Admin-Timestamp", timestamp)
+		request.Header.Set("X-Admin-Nonce", nonce)
+		request.Header.Set("X-Admin-Signature", adminAuth.relaySignature(timestamp, nonce, method, signedURI))
+		return request
+	}
+	request = signed("DELETE", "/files?s=a&p=/x", now, "n1", "/files?s=a&p=/x")
+	if !isAdmin(request) || !isAdmin(request) {
+		t.Errorf("Relay signed request is not admin")
+	}
+	if isAdmin(signed("DELETE", "/files?s=a&p=/x", now, "n1", "/files?s=a&p=/x")) {
+		t.Errorf("Replayed signed request taken")
+	}
+	if isAdmin(signed("DELETE", "/files?s=a&p=/y", now, "n2", "/files?s=a&p=/x")) {
+		t.Errorf("Signature of another request taken")
+	}
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if isAdmin(signed("GET", "/shares", old, "n3", "/shares")) {
+		t.Errorf("Old signature taken")
+	}
+
+	// while migrating, and as it used to be
+	for _, policy := range []string{anonymousLog, anonymousAdmin} {
+		adminAuth = &adminCredentials{anonymous: policy}
+		if !isAdmin(httptest.NewRequest("GET", "/shares", nil)) {
+			t.Errorf("Anonymous request is not admin with policy %s", policy)
+		}
+		if hasAdminCredentials(httptest.NewRequest("GET", "/audit", nil)) {
+			t.Errorf("Anonymous request has admin credentials with policy %s", policy)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var bookSchema = []string{
+	`CREATE TABLE IF NOT EXISTS books (
+		share TEXT NOT NULL,
+		path TEXT NOT NULL,
+		mtime INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		info TEXT NOT NULL,
+		PRIMARY KEY (share, path))`,
+}
+
+// BookLibrary indexes the e-books in the shares tagged as books, with the
+// metadata of the EPUBs
+type BookLibrary struct {
+	store  *LocalStore
+	shares *HdaShares
+}
+
+func NewBookLibrary(store *LocalStore, shares *HdaShares) (*BookLibrary, error) {
+	err := store.createTables(bookSchema...)
+	if err != nil {
+		return nil, err
+	}
+	return &BookLibrary{store: store, shares: shares}, nil
+}
+
+// scanShare brings the library up to date with the contents of the share,
+// only reading the books that changed since the last scan
+func (library *BookLibrary) scanShare(share *HdaShare) {
+	logging.Info("Scanning books in share %s", share.name)
+	known := make(map[string][2]int64)
+	rows, err := library.store.db.Query("SELECT path, mtime, size FROM books WHERE share = ?", share.name)
+	if err != nil {
+		logging.Error("Error reading book library: %s", err.Error())
+		return
+	}
+	for rows.Next() {
+		var path string
+		var mtime, size int64
+		rows.Scan(&path, &mtime, &size)
+		known[path] = [2]int64{mtime, size}
+	}
+	rows.Close()
+
+	root := filepath.Clean(share.path)
+	hidden := hiddenIn(share.name)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && hidden.entry(strings.TrimPrefix(filepath.Dir(path), root), info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !isBook(path) {
+			return nil
+		}
+		relativePath := strings.TrimPrefix(path, root)
+		if old, ok := known[relativePath]; !ok || old[0] != info.ModTime().Unix() || old[1] != info.Size() {
+			library.index(share.name, relativePath, path, info)
+		}
+		delete(known, relativePath)
+		return nil
+	})
+
+	// whatever was not found anymore is gone
+	for relativePath := range known {
+		library.store.db.Exec("DELETE FROM books WHERE share = ? AND path = ?", share.name, relativePath)
+	}
+	logging.Info("Done scanning books in share %s", share.name)
+}
+
+// index reads the metadata of one book into the library. Only EPUBs have
+// metadata we can read, the others are listed by name
+func (library *BookLibrary) index(share, relativePath, fullPath string, info os.FileInfo) {
+	data := []byte("null")
+	if getContentType(fullPath) == "application/epub+zip" {
+		book, _, err := readEpub(fullPath)
+		if err != nil {
+			debug(3, "Error reading EPUB %s: %s", fullPath, err)
+		} else {
+			data, _ = json.Marshal(book)
+		}
+	}
+	q := "INSERT OR REPLACE INTO books (share, path, mtime, size, info) VALUES (?, ?, ?, ?, ?)"
+	_, err := library.store.db.Exec(q, share, relativePath, info.ModTime().Unix(), info.Size(), string(data))
+	if err != nil {
+		logging.Error("Error indexing %s: %s", fullPath, err.Error())
+	}
+}
+
+// update indexes a file or directory that was created or written to
+func (library *BookLibrary) update(fullPath string) {
+	if library == nil {
+		return
+	}
+	share, relativePath := library.shares.ForPath(fullPath)
+	if share == nil || !isBookShare(share) || strings.Contains(fullPath, ".fscache") {
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		if isBook(fullPath) && !hiddenIn(share.name).hides(relativePath) && !strings.Contains(relativePath, "/.") {
+			library.index(share.name, relativePath, fullPath, info)
+		}
+		return
+	}
+	hidden := hiddenIn(share.name)
+	filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && isBook(path) && !strings.Contains(path, "/.") &&
+			!hidden.hides(relativePath+strings.TrimPrefix(path, fullPath)) {
+			library.index(share.name, relativePath+strings.TrimPrefix(path, fullPath), path, info)
+		}
+		return nil
+	})
+}
+
+// remove drops a file, or everything under a directory, from the library
+func (library *BookLibrary) remove(fullPath string) {
+	if library == nil {
+		return
+	}
+	share, relativePath := library.shares.ForPath(fullPath)
+	if share == nil || !isBookShare(share) {
+		return
+	}
+	prefix := strings.TrimSuffix(relativePath, "/") + "/"
+	q := "DELETE FROM books WHERE share = ? AND (path = ? OR substr(path, 1, length(?)) = ?)"
+	_, err := library.store.db.Exec(q, share.name, relativePath, prefix, prefix)
+	if err != nil {
+		logging.Error("Error removing %s from the book library: %s", fullPath, err.Error())
+	}
+}
+
+// books returns the books of the given shares
+func (library *BookLibrary) books(shares []string) ([]*bookEntry, error) {
+	books := make([]*bookEntry, 0)
+	if len(shares) == 0 {
+		return books, nil
+	}
+	placeholders := make([]string, 0)
+	args := make([]interface{}, 0)
+	for _, name := range shares {
+		placeholders = append(placeholders, "?")
+		args = append(args, name)
+	}
+	rows, err := library.store.db.Query("SELECT share, path, info FROM books WHERE share IN ("+
+		strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		b := new(bookEntry)
+		var info sql.NullString
+		if err = rows.Scan(&b.Share, &b.Path, &info); err != nil {
+			return nil, err
+		}
+		b.Name = filepath.Base(b.Path)
+		b.File = endpointFor("/files", b.Share, b.Path)
+		json.Unmarshal([]byte(info.String), &b.Book)
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// serveBooks lists the e-books in the shares tagged as books that the
+// requester can read, with their metadata and covers
+func (service *MercuryFsService) serveBooks(writer http.ResponseWriter, request *http.Request) {
+	readable, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	if service.Books == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	allowed := make(map[string]bool)
+	for _, name := range readable {
+		allowed[name] = true
+	}
+	service.Shares.updateShares()
+	shares := make([]string, 0)
+	for _, share := range service.Shares.Shares {
+		if isBookShare(share) && (readable == nil || allowed[share.name]) {
+			shares = append(shares, share.name)
+		}
+	}
+	books, err := service.Books.books(shares)
+	if err != nil {
+		logging.Error("Error querying book library: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	for _, book := range books {
+		if fullPath, err := service.fullPathToFile(book.Share, book.Path); err == nil && exists(thumbnailPathFor(fullPath)) {
+			book.Cover = endpointFor("/cache", book.Share, book.Path)
+		}
+	}
+	sort.SliceStable(books, func(i, j int) bool {
+		return strings.ToLower(books[i].sortKey()) < strings.ToLower(books[j].sortKey())
+	})
+	result, _ := json.Marshal(books)
+	service.serveJSON(writer, request, string(result))
+}
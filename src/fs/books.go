@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/disintegration/imaging"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// biggest OPF or cover we read out of an EPUB
+const maxEpubEntrySize = 16 << 20
+
+var errNoOPF = errors.New("no OPF package in EPUB")
+
+// bookInfo is the metadata of an e-book, as kept in the books cache
+type bookInfo struct {
+	Title       string   `json:"title"`
+	Authors     []string `json:"authors"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex string   `json:"series_index,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+}
+
+// the parts of the OPF package document we use
+type opfPackage struct {
+	Metadata struct {
+		Titles     []string `xml:"http://purl.org/dc/elements/1.1/ title"`
+		Creators   []string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+		Languages  []string `xml:"http://purl.org/dc/elements/1.1/ language"`
+		Publishers []string `xml:"http://purl.org/dc/elements/1.1/ publisher"`
+		Meta       []struct {
+			Name     string `xml:"name,attr"`
+			Content  string `xml:"content,attr"`
+			Property string `xml:"property,attr"`
+			Refines  string `xml:"refines,attr"`
+			ID       string `xml:"id,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+}
+
+type bookEntry struct {
+	Share string    `json:"share"`
+	Path  string    `json:"path"`
+	Name  string    `json:"name"`
+	File  string    `json:"file"`
+	Cover string    `json:"cover,omitempty"`
+	Book  *bookInfo `json:"book,omitempty"`
+}
+
+func isBookShare(share *HdaShare) bool {
+	return strings.Contains(strings.ToLower(share.tags), "books")
+}
+
+func isBook(name string) bool {
+	contentType := getContentType(name)
+	return contentType == "application/epub+zip" || contentType == "application/x-mobipocket"
+}
+
+// bookInfoPathFor returns where the metadata of the given e-book is kept
+func bookInfoPathFor(path string) string {
+	return fscache.pathFor("books", path, ".json", false)
+}
+
+func readZipEntry(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > maxEpubEntrySize {
+		return nil, errors.New("entry too big: " + f.Name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(io.LimitReader(r, maxEpubEntrySize))
+}
+
+// readEpub reads the metadata and the cover image of an EPUB
+func readEpub(epubPath string) (*bookInfo, []byte, error) {
+	z, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer z.Close()
+	files := make(map[string]*zip.File)
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+
+	// the container points to the package document
+	f := files["META-INF/container.xml"]
+	if f == nil {
+		return nil, nil, errNoOPF
+	}
+	data, err := readZipEntry(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err = xml.Unmarshal(data, &container); err != nil {
+		return nil, nil, err
+	}
+	opfPath := ""
+	for _, r := range container.Rootfiles {
+		if r.MediaType == "" || r.MediaType == "application/oebps-package+xml" {
+			opfPath = r.FullPath
+			break
+		}
+	}
+	if f = files[opfPath]; f == nil {
+		return nil, nil, errNoOPF
+	}
+	if data, err = readZipEntry(f); err != nil {
+		return nil, nil, err
+	}
+	var opf opfPackage
+	if err = xml.Unmarshal(data, &opf); err != nil {
+		return nil, nil, err
+	}
+
+	info, coverID := opf.bookInfo()
+	// hrefs are relative to the package document
+	coverHref := ""
+	for _, item := range opf.Manifest {
+		if item.ID == coverID || strings.Contains(" "+item.Properties+" ", " cover-image ") {
+			coverHref = item.Href
+			break
+		}
+	}
+	if coverHref == "" {
+		for _, item := range opf.Manifest {
+			if strings.HasPrefix(item.MediaType, "image/") && strings.Contains(strings.ToLower(item.ID+item.Href), "cover") {
+				coverHref = item.Href
+				break
+			}
+		}
+	}
+	var cover []byte
+	if coverHref != "" {
+		if unescaped, err := url.PathUnescape(coverHref); err == nil {
+			coverHref = unescaped
+		}
+		name := path.Join(path.Dir(opfPath), coverHref)
+		if f = files[name]; f != nil {
+			cover, _ = readZipEntry(f)
+		}
+	}
+	return info, cover, nil
+}
+
+// bookInfo picks the metadata out of the package, along with the manifest id
+// of the cover (EPUB 2 style) if there is one
+func (opf *opfPackage) bookInfo() (*bookInfo, string) {
+	m := &opf.Metadata
+	info := &bookInfo{Authors: make([]string, 0)}
+	if len(m.Titles) > 0 {
+		info.Title = strings.TrimSpace(m.Titles[0])
+	}
+	for _, creator := range m.Creators {
+		if creator = strings.TrimSpace(creator); creator != "" {
+			info.Authors = append(info.Authors, creator)
+		}
+	}
+	if len(m.Languages) > 0 {
+		info.Language = strings.TrimSpace(m.Languages[0])
+	}
+	if len(m.Publishers) > 0 {
+		info.Publisher = strings.TrimSpace(m.Publishers[0])
+	}
+	coverID := ""
+	seriesID := ""
+	for _, meta := range m.Meta {
+		switch {
+		case meta.Name == "cover":
+			coverID = meta.Content
+		// calibre
+		case meta.Name == "calibre:series":
+			info.Series = strings.TrimSpace(meta.Content)
+		case meta.Name == "calibre:series_index":
+			info.SeriesIndex = strings.TrimSpace(meta.Content)
+		// EPUB 3
+		case meta.Property == "belongs-to-collection" && info.Series == "":
+			info.Series = strings.TrimSpace(meta.Value)
+			seriesID = meta.ID
+		}
+	}
+	for _, meta := range m.Meta {
+		if seriesID != "" && meta.Refines == "#"+seriesID && meta.Property == "group-position" {
+			info.SeriesIndex = strings.TrimSpace(meta.Value)
+		}
+	}
+	return info, coverID
+}
+
+// epubCacher keeps the metadata of an EPUB in the books cache, and makes a
+// thumbnail of its cover
+func epubCacher(epubPath string, thumbnailPath string) error {
+	info, cover, err := readEpub(epubPath)
+	if err != nil {
+		logging.Error(`Error reading EPUB at location: "%s". Error is: "%s"`, epubPath, err.Error())
+		return err
+	}
+	infoPath := bookInfoPathFor(epubPath)
+	if infoPath == "" {
+		return errNoCacheKey
+	}
+	os.MkdirAll(filepath.Dir(infoPath), os.ModePerm)
+	data, _ := json.Marshal(info)
+	if err = ioutil.WriteFile(infoPath, data, 0644); err != nil {
+		logging.Error(`Error saving book metadata for file at location: "%s". Error is: "%s"`, epubPath, err.Error())
+		return err
+	}
+	if len(cover) == 0 {
+		debug(5, "No cover in %s", epubPath)
+		return nil
+	}
+	img, err := imaging.Decode(bytes.NewReader(cover))
+	if err != nil {
+		debug(3, "Error decoding cover of %s: %s", epubPath, err)
+		return err
+	}
+	return saveThumbnail(img, epubPath, thumbnailPath)
+}
+
+// cachedBookInfo returns the metadata kept in the cache for an e-book, if any
+func cachedBookInfo(bookPath string) *bookInfo {
+	data, err := ioutil.ReadFile(bookInfoPathFor(bookPath))
+	if err != nil {
+		return nil
+	}
+	info := new(bookInfo)
+	if json.Unmarshal(data, info) != nil {
+		return nil
+	}
+	return info
+}
+
+// sortKey orders books by author, series and title, with the ones we know
+// nothing about last
+func (b *bookEntry) sortKey() string {
+	if b.Book == nil {
+		return "\uffff" + b.Name
+	}
+	author := ""
+	if len(b.Book.Authors) > 0 {
+		author = b.Book.Authors[0]
+	}
+	return author + "\x00" + b.Book.Series + "\x00" + b.Book.SeriesIndex + "\x00" + b.Book.Title
+}
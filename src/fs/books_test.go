@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testContainer = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+const testOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>The Hobbit</dc:title>
+    <dc:creator>J. R. R. Tolkien</dc:creator>
+    <dc:language>en</dc:language>
+    <meta property="belongs-to-collection" id="c01">Middle-earth</meta>
+    <meta refines="#c01" property="group-position">1</meta>
+    <meta name="cover" content="cover-img"/>
+  </metadata>
+  <manifest>
+    <item id="cover-img" href="images/cover%20art.png" media-type="image/png"/>
+    <item id="text" href="text.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+</package>`
+
+// testEpub returns an EPUB with the metadata of testOPF and the given cover
+func testEpub(cover []byte) []byte {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"mimetype":                   []byte("application/epub+zip"),
+		"META-INF/container.xml":     []byte(testContainer),
+		"OEBPS/content.opf":          []byte(testOPF),
+		"OEBPS/images/cover art.png": cover,
+	} {
+		w, _ := z.Create(name)
+		w.Write(data)
+	}
+	z.Close()
+	return buf.Bytes()
+}
+
+func TestReadEpub(t *testing.T) {
+	var cover bytes.Buffer
+	png.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 60, 90)))
+
+	path := writeTestFile(t, "book.epub", testEpub(cover.Bytes()))
+	defer os.Remove(path)
+
+	info, picture, err := readEpub(path)
+	if err != nil {
+		t.Fatalf("readEpub failed: %s", err.Error())
+	}
+	if info.Title != "The Hobbit" || len(info.Authors) != 1 || info.Authors[0] != "J. R. R. Tolkien" {
+		t.Errorf("Title and authors read as %+v", info)
+	}
+	if info.Language != "en" || info.Series != "Middle-earth" || info.SeriesIndex != "1" {
+		t.Errorf("Language and series read as %+v", info)
+	}
+	if !bytes.Equal(picture, cover.Bytes()) {
+		t.Errorf("Cover not found")
+	}
+}
+
+func TestBookLibrary(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "Books", "Tolkién"), 0755)
+	os.MkdirAll(filepath.Join(dir, "Books", ".trash"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "Books", "Tolkién", "hobbit.epub"), testEpub(nil), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Books", "manual.mobi"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Books", ".trash", "old.epub"), testEpub(nil), 0644)
+	shares, _ := NewHdaShares(dir)
+	library, err := NewBookLibrary(store, shares)
+	if err != nil {
+		t.Fatalf("NewBookLibrary failed: %s", err.Error())
+	}
+	share := shares.Get("Books")
+	library.scanShare(share)
+
+	books, err := library.books([]string{"Books"})
+	if err != nil || len(books) != 2 {
+		t.Fatalf("Books indexed: %+v, %v", books, err)
+	}
+	for _, b := range books {
+		switch b.Path {
+		case "/Tolkién/hobbit.epub":
+			if b.Book == nil || b.Book.Title != "The Hobbit" {
+				t.Errorf("Metadata of %s is %+v", b.Path, b.Book)
+			}
+		case "/manual.mobi":
+			if b.Book != nil {
+				t.Errorf("Metadata of %s is %+v", b.Path, b.Book)
+			}
+		default:
+			t.Errorf("Book %s indexed", b.Path)
+		}
+	}
+
+	library.remove(filepath.Join(dir, "Books", "Tolkién"))
+	if books, _ = library.books([]string{"Books"}); len(books) != 1 || books[0].Path != "/manual.mobi" {
+		t.Errorf("Books after removing a directory: %+v", books)
+	}
+	library.update(filepath.Join(dir, "Books", "Tolkién", "hobbit.epub"))
+	if books, _ = library.books([]string{"Books"}); len(books) != 2 {
+		t.Errorf("Books after an update: %+v", books)
+	}
+}
@@ -1,20 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"github.com/disintegration/imaging"
+	"image"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// names of the pictures used as album art when a track has none embedded
+var folderArtNames = []string{"folder.jpg", "cover.jpg", "folder.jpeg", "cover.jpeg", "folder.png", "cover.png"}
+
+var errNoAlbumArt = errors.New("no album art found")
+
+var errNoCacheKey = errors.New("cannot tell the cache key")
+
+// thumbnailPathFor returns where the thumbnail of the given file is kept
+func thumbnailPathFor(path string) string {
+	return fscache.pathFor("thumbnails", path, "", false)
+}
+
 func thumbnailer(imagePath string, savePath string) error {
 	img, err := imaging.Open(imagePath)
 	if err != nil {
 		logging.Error(`Error opening file at location: "%s" as image. Error is: "%s"`, imagePath, err.Error())
 		return err
 	}
-	imgX := img.Bounds().Max.X
-	imgY := img.Bounds().Max.Y
+	return saveThumbnail(img, imagePath, savePath)
+}
+
+// saveThumbnail scales img down and saves it at savePath. The thumbnail keeps
+// the name of the original file, so when that is not an image we store a JPEG
+func saveThumbnail(img image.Image, sourcePath string, savePath string) error {
+	imgX := img.Bounds().Dx()
+	imgY := img.Bounds().Dy()
+	if imgX+imgY == 0 {
+		return errors.New("empty image")
+	}
 
 	thumbX := (imgX * 100 * 2) / (imgX + imgY)
 	thumbY := (imgY * 100 * 2) / (imgX + imgY)
@@ -22,50 +47,105 @@ func thumbnailer(imagePath string, savePath string) error {
 	thumb := imaging.Thumbnail(img, thumbX, thumbY, imaging.Box)
 
 	os.MkdirAll(filepath.Dir(savePath), os.ModePerm)
-	err = imaging.Save(thumb, savePath)
+	var err error
+	if _, ferr := imaging.FormatFromFilename(savePath); ferr == nil {
+		err = imaging.Save(thumb, savePath)
+	} else {
+		var f *os.File
+		f, err = os.Create(savePath)
+		if err == nil {
+			err = imaging.Encode(f, thumb, imaging.JPEG)
+			f.Close()
+		}
+	}
 	if err != nil {
-		logging.Error(`Error saving image thumbnail for file at location: "%s". Error is: "%s"`, imagePath, err.Error())
+		logging.Error(`Error saving image thumbnail for file at location: "%s". Error is: "%s"`, sourcePath, err.Error())
 		return err
 	}
 
 	return nil
 }
 
-func fillCache(root string) error {
-	filepath.Walk(root, fillCacheWalkFunc)
-	return nil
+// albumArtThumbnailer makes a thumbnail out of the cover art embedded in an
+// audio file, or out of the folder.jpg/cover.jpg found next to it
+func albumArtThumbnailer(audioPath string, savePath string) error {
+	tags, err := readAudioTags(audioPath)
+	if err == nil && len(tags.picture) > 0 {
+		img, err := imaging.Decode(bytes.NewReader(tags.picture))
+		if err == nil {
+			return saveThumbnail(img, audioPath, savePath)
+		}
+		debug(3, "Error decoding embedded album art of %s: %s", audioPath, err)
+	}
+
+	cover := folderArt(filepath.Dir(audioPath))
+	if cover == "" {
+		debug(5, "No album art for %s", audioPath)
+		return errNoAlbumArt
+	}
+	img, err := imaging.Open(cover)
+	if err != nil {
+		logging.Error(`Error opening album art at location: "%s". Error is: "%s"`, cover, err.Error())
+		return err
+	}
+	return saveThumbnail(img, audioPath, savePath)
 }
 
-func fillCacheWalkFunc(path string, info os.FileInfo, err error) error {
-	defer func() {
-		if v := recover(); v != nil {
-			logging.Fatal("Panic while creating thumbnail: %s", v)
+// folderArt returns the path to the album art picture in dir, if any
+func folderArt(dir string) string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, name := range folderArtNames {
+		for _, fi := range fis {
+			if !fi.IsDir() && strings.ToLower(fi.Name()) == name {
+				return filepath.Join(dir, fi.Name())
+			}
 		}
-	}()
+	}
+	return ""
+}
 
-	if strings.Contains(path, ".fscache") {
+// needsCache tells whether the thumbnail (or book metadata) of a file is
+// missing or out of date, and can be made
+func needsCache(path string, info os.FileInfo) bool {
+	contentType := getContentType(path)
+	if contentType == "application/epub+zip" {
+		// not all books have a cover, the metadata tells if it is up to date
+		return !fscache.fresh(bookInfoPathFor(path), info)
+	}
+	if len(thumbnails.providersFor(contentType)) == 0 || thumbnails.failed(path, info) {
+		return false
+	}
+	return !fscache.fresh(thumbnailPathFor(path), info)
+}
+
+// cacheFile makes the cache of a file, if it needs it
+func cacheFile(path string, info os.FileInfo) error {
+	if !needsCache(path, info) {
 		return nil
 	}
-	if ! info.IsDir() {
-		parentDir := filepath.Dir(path)
-		filename := filepath.Base(path)
-
-		thumbnailDirPath := filepath.Join(parentDir, ".fscache/thumbnails")
-		thumbnailPath := filepath.Join(thumbnailDirPath, filename)
-		thumbnailInfo, err := os.Stat(thumbnailPath)
-		if os.IsNotExist(err) || info.ModTime().After(thumbnailInfo.ModTime()) {
-			contentType := getContentType(path)
-			if strings.Contains(contentType, "image") {
-				thumbnailer(path, thumbnailPath)
-			}
+	// the key of the file is worked out here, away from the listings, as it
+	// may mean reading all of it. Then an identical file may have been cached
+	thumbnailPath := fscache.pathFor("thumbnails", path, "", true)
+	if thumbnailPath == "" {
+		return errNoCacheKey
+	}
+	if getContentType(path) == "application/epub+zip" {
+		if fscache.fresh(bookInfoPathFor(path), info) {
+			return nil
 		}
-	} else {
-		watcher.Add(path)
+		return epubCacher(path, thumbnailPath)
 	}
-	return nil
+	if fscache.fresh(thumbnailPath, info) {
+		return nil
+	}
+	return thumbnails.thumbnail(path, thumbnailPath, getContentType(path), info)
 }
 
 func removeCache(root string) error {
+	cacheJobs.drop(root)
 	filepath.Walk(root, removeCacheWalkFunc)
 	return nil
 }
@@ -74,18 +154,21 @@ func removeCacheWalkFunc(path string, info os.FileInfo, err error) error {
 	if strings.Contains(path, ".fscache") {
 		return nil
 	}
-	parentDir := filepath.Dir(path)
-	filename := filepath.Base(path)
-
-	thumbnailDirPath := filepath.Join(parentDir, ".fscache/thumbnails")
-	thumbnailPath := filepath.Join(thumbnailDirPath, filename)
-	_, err = os.Stat(thumbnailPath)
-	if ! os.IsNotExist(err) {
-		err := os.Remove(thumbnailPath)
-		if err != nil {
-			logging.Error(`Error while deleting cache file. Error: "%s"`, err.Error())
+	// a central cache may share the thumbnail with other files, it is
+	// evicted in time
+	if !fscache.central() {
+		thumbnailPath := thumbnailPathFor(path)
+		_, err = os.Stat(thumbnailPath)
+		if ! os.IsNotExist(err) {
+			err := os.Remove(thumbnailPath)
+			if err != nil {
+				logging.Error(`Error while deleting cache file. Error: "%s"`, err.Error())
+			}
 		}
+		os.Remove(bookInfoPathFor(path))
 	}
+	fscache.forget(path)
+	thumbnails.clearFailure(path)
 	err = watcher.Remove(path)
 	if err != nil {
 		logging.Error("Error while removing file from watcher: %s", err)
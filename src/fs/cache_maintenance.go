@@ -0,0 +1,433 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// orphans listed in a report, the rest are only counted
+const maxReportedOrphans = 100
+
+var errMaintenanceRunning = errors.New("a cache maintenance is running")
+
+// cacheReport tells how a rebuild, verify or purge of the cache went, or is
+// going
+type cacheReport struct {
+	Operation   string     `json:"operation"`
+	Roots       []string   `json:"roots"`
+	Running     bool       `json:"running"`
+	Files       int        `json:"files"`
+	Queued      int        `json:"queued"`
+	Missing     int        `json:"missing"`
+	Orphans     int        `json:"orphans"`
+	OrphanPaths []string   `json:"orphan_paths"`
+	Removed     int        `json:"removed"`
+	Errors      int        `json:"errors"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	mutex       sync.Mutex
+}
+
+func newCacheReport(operation string, roots []string) *cacheReport {
+	return &cacheReport{Operation: operation, Roots: roots, Running: true, OrphanPaths: make([]string, 0), Started: time.Now()}
+}
+
+func (r *cacheReport) update(f func(r *cacheReport)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f(r)
+}
+
+func (r *cacheReport) orphan(path string) {
+	r.update(func(r *cacheReport) {
+		r.Orphans++
+		if len(r.OrphanPaths) < maxReportedOrphans {
+			r.OrphanPaths = append(r.OrphanPaths, path)
+		}
+	})
+}
+
+func (r *cacheReport) removed(err error) {
+	r.update(func(r *cacheReport) {
+		if err == nil {
+			r.Removed++
+		} else {
+			r.Errors++
+		}
+	})
+}
+
+func (r *cacheReport) finish() {
+	r.update(func(r *cacheReport) {
+		now := time.Now()
+		r.Running = false
+		r.Finished = &now
+	})
+}
+
+func (r *cacheReport) toJson() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// the maintenance the API started last, only one runs at a time
+var maintenance struct {
+	report *cacheReport
+	sync.Mutex
+}
+
+// walkSourceFiles calls f on the files under the roots, leaving the caches out
+func walkSourceFiles(roots []string, f func(path string, fi os.FileInfo)) {
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if fi.IsDir() {
+				if fi.Name() == ".fscache" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				f(path, fi)
+			}
+			return nil
+		})
+	}
+}
+
+// removeFileCache removes the thumbnail and the book metadata of a file
+func removeFileCache(path string) error {
+	var err error
+	for _, cachePath := range []string{thumbnailPathFor(path), bookInfoPathFor(path)} {
+		if cachePath == "" {
+			continue
+		}
+		if e := os.Remove(cachePath); e != nil && !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	return err
+}
+
+// rebuildCache drops the cache of the files under the roots, and queues them
+// to be cached again
+func rebuildCache(roots []string, queue *cacheQueue, report *cacheReport) {
+	walkSourceFiles(roots, func(path string, fi os.FileInfo) {
+		err := removeFileCache(path)
+		thumbnails.clearFailure(path)
+		queued := needsCache(path, fi)
+		if queued {
+			queue.add(path, priorityEvent)
+		}
+		report.update(func(r *cacheReport) {
+			r.Files++
+			if err != nil {
+				r.Errors++
+			}
+			if queued {
+				r.Queued++
+			}
+		})
+	})
+}
+
+// verifyCache counts the files whose cache is missing, and finds the cached
+// files whose source is gone, removing them with fix. A central cache is
+// shared by all the shares, so orphans are only looked for in it when the
+// roots are whole
+func verifyCache(roots []string, whole, fix bool, report *cacheReport) {
+	keys := make(map[string]bool)
+	walkSourceFiles(roots, func(path string, fi os.FileInfo) {
+		missing := needsCache(path, fi)
+		if fscache.central() {
+			if key := fscache.key(path, false); key != "" {
+				keys[key] = true
+			}
+		}
+		report.update(func(r *cacheReport) {
+			r.Files++
+			if missing {
+				r.Missing++
+			}
+		})
+	})
+
+	check := func(cachePath string, orphan bool) {
+		if !orphan {
+			return
+		}
+		report.orphan(cachePath)
+		if fix {
+			report.removed(os.Remove(cachePath))
+		}
+	}
+	if fscache.central() {
+		if !whole {
+			return
+		}
+		filepath.Walk(fscache.dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				check(path, !keys[strings.TrimSuffix(fi.Name(), ".json")])
+			}
+			return nil
+		})
+		if fix {
+			fscache.dropStaleKeys()
+		}
+		return
+	}
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() || fi.Name() != ".fscache" {
+				return nil
+			}
+			dir := filepath.Dir(path)
+			for _, kind := range []string{"thumbnails", "books"} {
+				fis, _ := ioutil.ReadDir(filepath.Join(path, kind))
+				for _, cached := range fis {
+					name := cached.Name()
+					if kind == "books" {
+						name = strings.TrimSuffix(name, ".json")
+					}
+					check(filepath.Join(path, kind, cached.Name()), !exists(filepath.Join(dir, name)))
+				}
+			}
+			return filepath.SkipDir
+		})
+	}
+}
+
+// purgeCache removes the cache of everything under the roots. With whole set
+// the roots are all the shares, and a central cache is emptied
+func purgeCache(roots []string, whole bool, report *cacheReport) {
+	if fscache.central() && whole {
+		for _, kind := range []string{"thumbnails", "books"} {
+			report.removed(os.RemoveAll(filepath.Join(fscache.dir, kind)))
+		}
+		fscache.dropKeys()
+	} else if fscache.central() {
+		walkSourceFiles(roots, func(path string, fi os.FileInfo) {
+			report.update(func(r *cacheReport) { r.Files++ })
+			report.removed(removeFileCache(path))
+		})
+	} else {
+		for _, root := range roots {
+			filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+				if err == nil && fi.IsDir() && fi.Name() == ".fscache" {
+					report.removed(os.RemoveAll(path))
+					return filepath.SkipDir
+				}
+				return nil
+			})
+		}
+	}
+	for _, root := range roots {
+		thumbnails.clearFailures(root)
+	}
+}
+
+// cacheRoots returns the folders (or file) to work on: the given path of a
+// share, or all the shares when no share is given, which is then whole
+func cacheRoots(shares *HdaShares, shareName, path string) (roots []string, whole bool, err error) {
+	shares.updateShares()
+	if shareName == "" {
+		for _, share := range shares.Shares {
+			if share.path != "" {
+				roots = append(roots, filepath.Clean(share.GetPath()))
+			}
+		}
+		return roots, true, nil
+	}
+	share := shares.Get(shareName)
+	if share == nil {
+		return nil, false, fmt.Errorf("share %s not found", shareName)
+	}
+	root, err := resolveInShare(share.GetPath(), path, symlinkPolicy(shareName))
+	if err != nil {
+		return nil, false, fmt.Errorf("path %s: %s", path, err.Error())
+	}
+	if !exists(root) {
+		return nil, false, fmt.Errorf("%s not found", root)
+	}
+	return []string{root}, false, nil
+}
+
+// runCacheMaintenance runs an operation on the roots, waiting for it. A
+// rebuild only queues the files, their progress is in the queue status
+func runCacheMaintenance(operation string, roots []string, whole, fix bool, queue *cacheQueue, report *cacheReport) {
+	defer report.finish()
+	switch operation {
+	case "rebuild":
+		rebuildCache(roots, queue, report)
+	case "verify":
+		verifyCache(roots, whole, fix, report)
+	case "purge":
+		purgeCache(roots, whole, report)
+	}
+	logging.Info("Cache %s of %s done: %s", operation, strings.Join(roots, ", "), report.toJson())
+}
+
+// startCacheMaintenance runs an operation in the background, unless one is
+// running already
+func startCacheMaintenance(operation string, roots []string, whole, fix bool) (*cacheReport, error) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if r := maintenance.report; r != nil {
+		r.mutex.Lock()
+		running := r.Running
+		r.mutex.Unlock()
+		if running {
+			return r, errMaintenanceRunning
+		}
+	}
+	report := newCacheReport(operation, roots)
+	maintenance.report = report
+	go runCacheMaintenance(operation, roots, whole, fix, cacheJobs, report)
+	return report, nil
+}
+
+// serveCacheMaintenance starts a rebuild, verify or purge of the cache of a
+// path ("s" and "p" parameters) or of all the shares. It answers right away,
+// the report of how it goes is at GET /cache/maintenance
+func (service *MercuryFsService) serveCacheMaintenance(writer http.ResponseWriter, request *http.Request) {
+	operation := mux.Vars(request)["operation"]
+	q := request.URL.Query()
+	roots, whole, err := cacheRoots(service.Shares, q.Get("s"), q.Get("p"))
+	if err != nil {
+		debug(2, "Cache %s: %s", operation, err.Error())
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	report, err := startCacheMaintenance(operation, roots, whole, q.Get("fix") == "true")
+	status := http.StatusAccepted
+	if err != nil {
+		status = http.StatusConflict
+	}
+	audit(request, "cache-"+operation, auditOutcome(status), "admin", "fix %v", q.Get("fix") == "true")
+	result := report.toJson()
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write([]byte(result))
+	service.accessLog(logging, request, status, len(result))
+	service.debugInfo.requestServed(int64(len(result)))
+}
+
+// serveCacheMaintenanceReport returns the report of the last maintenance
+func (service *MercuryFsService) serveCacheMaintenanceReport(writer http.ResponseWriter, request *http.Request) {
+	maintenance.Lock()
+	report := maintenance.report
+	maintenance.Unlock()
+	if report == nil {
+		service.serveJSON(writer, request, "null")
+		return
+	}
+	service.serveJSON(writer, request, report.toJson())
+}
+
+// cacheCommand runs "cache rebuild|verify|purge" from the command line, and
+// returns the exit code
+func cacheCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "rebuild" && args[0] != "verify" && args[0] != "purge") {
+		fmt.Println("usage: cache rebuild|verify|purge [-r dir] [-s share] [-p path] [-fix]")
+		return 2
+	}
+	operation := args[0]
+	flags := flag.NewFlagSet("cache "+operation, flag.ContinueOnError)
+	rootDir := flags.String("r", "", "Use the directories in this directory as shares, instead of the registered HDA shares")
+	shareName := flags.String("s", "", "share to work on, all of them if not given")
+	path := flags.String("p", "", "path in the share to work on")
+	fix := flags.Bool("fix", false, "remove the orphans found by verify")
+	if flags.Parse(args[1:]) != nil {
+		return 2
+	}
+	// the service keeps cache keys and thumbnail failures in memory, which
+	// would not match the store and the cache once we are done
+	if pid := runningPid(PID_FILE); pid != "" {
+		fmt.Printf("The service is running (PID %s): stop it, or use the /cache API instead\n", pid)
+		return 1
+	}
+
+	initializeLogging(LOGFILE, splitFile, true)
+	config = loadConfig(CONFIG_FILE, *rootDir == "")
+	initThumbnailProviders()
+	initCacheStore()
+	store, err := NewLocalStore(LOCAL_DB_FILE)
+	if err != nil {
+		fmt.Printf("Error opening local database %s: %s\n", LOCAL_DB_FILE, err.Error())
+		return 1
+	}
+	defer store.Close()
+	thumbnails.setStore(store)
+	fscache.setStore(store)
+
+	shares, err := NewHdaShares(*rootDir)
+	if err != nil {
+		fmt.Printf("Error reading the shares: %s\n", err.Error())
+		return 1
+	}
+	roots, whole, err := cacheRoots(shares, *shareName, *path)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return 1
+	}
+
+	queue := newCacheQueue()
+	report := newCacheReport(operation, roots)
+	done := make(chan bool)
+	go func() {
+		runCacheMaintenance(operation, roots, whole, *fix, queue, report)
+		close(done)
+	}()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			fmt.Println(report.toJson())
+		}
+	}
+	fmt.Println(report.toJson())
+
+	// the rebuild is done here, rather than left to the service
+	if operation == "rebuild" && report.Queued > 0 {
+		queue.start(shares)
+		for {
+			s := queue.status()
+			fmt.Printf("%d queued, %d being cached, %d done, %d failed\n", s.Queued, s.Active, s.Done, s.Failed)
+			if s.Queued == 0 && s.Active == 0 {
+				break
+			}
+			time.Sleep(2 * time.Second)
+		}
+	}
+	if report.Errors > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheMaintenance(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "amahi-shares")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	registry := newThumbnailRegistry()
+	registry.register(funcProvider{"image", func(path, savePath string) error {
+		os.MkdirAll(filepath.Dir(savePath), 0755)
+		return ioutil.WriteFile(savePath, []byte("thumbnail"), 0644)
+	}}, []string{"image/"}, builtinPriority, time.Minute)
+	saved := thumbnails
+	thumbnails = registry
+	defer func() { thumbnails = saved }()
+
+	photos := filepath.Join(rootDir, "photos")
+	os.MkdirAll(filepath.Join(photos, ".fscache/thumbnails"), 0755)
+	ioutil.WriteFile(filepath.Join(photos, "a.jpg"), []byte("picture"), 0644)
+	ioutil.WriteFile(filepath.Join(photos, "b.jpg"), []byte("picture"), 0644)
+	ioutil.WriteFile(filepath.Join(photos, ".fscache/thumbnails/a.jpg"), []byte("thumbnail"), 0644)
+	ioutil.WriteFile(filepath.Join(photos, ".fscache/thumbnails/gone.jpg"), []byte("thumbnail"), 0644)
+
+	shares, _ := NewHdaShares(rootDir)
+	if _, _, err := cacheRoots(shares, "music", ""); err == nil {
+		t.Errorf("Roots of a missing share")
+	}
+	roots, whole, err := cacheRoots(shares, "", "")
+	if err != nil || !whole || len(roots) != 1 || roots[0] != photos {
+		t.Fatalf("Roots are %v (%v, %v)", roots, whole, err)
+	}
+
+	report := newCacheReport("verify", roots)
+	runCacheMaintenance("verify", roots, whole, false, nil, report)
+	if report.Running || report.Files != 2 || report.Missing != 1 || report.Orphans != 1 || report.Removed != 0 {
+		t.Errorf("Verify report is %s", report.toJson())
+	}
+	report = newCacheReport("verify", roots)
+	runCacheMaintenance("verify", roots, whole, true, nil, report)
+	if report.Removed != 1 || exists(filepath.Join(photos, ".fscache/thumbnails/gone.jpg")) {
+		t.Errorf("Verify did not fix orphans: %s", report.toJson())
+	}
+
+	queue := newCacheQueue()
+	report = newCacheReport("rebuild", roots)
+	runCacheMaintenance("rebuild", roots, whole, false, queue, report)
+	if report.Queued != 2 || queue.status().Queued != 2 || exists(filepath.Join(photos, ".fscache/thumbnails/a.jpg")) {
+		t.Errorf("Rebuild report is %s", report.toJson())
+	}
+	for queue.status().Queued > 0 {
+		queue.finish(queue.run(queue.next()))
+	}
+	if !exists(filepath.Join(photos, ".fscache/thumbnails/b.jpg")) {
+		t.Errorf("Rebuild made no thumbnails")
+	}
+
+	report = newCacheReport("purge", roots)
+	runCacheMaintenance("purge", roots, whole, false, nil, report)
+	if report.Removed != 1 || exists(filepath.Join(photos, ".fscache")) {
+		t.Errorf("Purge report is %s", report.toJson())
+	}
+}
+
+func TestRunningPid(t *testing.T) {
+	pidFile := writeTestFile(t, "pid", []byte(strconv.Itoa(os.Getpid())+"\n"))
+	defer os.Remove(pidFile)
+	if pid := runningPid(pidFile); pid != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Running process not found: %q", pid)
+	}
+	ioutil.WriteFile(pidFile, []byte("999999999"), 0644)
+	if pid := runningPid(pidFile); pid != "" {
+		t.Errorf("Stale PID file taken: %q", pid)
+	}
+	if pid := runningPid(pidFile + ".missing"); pid != "" {
+		t.Errorf("Missing PID file taken: %q", pid)
+	}
+}
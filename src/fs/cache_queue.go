@@ -0,0 +1,352 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priorities of cache jobs, higher first
+const (
+	// the walks of whole shares, at start up
+	priorityScan = iota
+	// files and folders that changed
+	priorityEvent
+	// files a client just listed
+	priorityListed
+)
+
+const defaultCacheNiceness = 10
+
+// cacheJob is a file to make the cache of, or a folder to look into
+type cacheJob struct {
+	path     string
+	priority int
+	seq      uint64
+	index    int
+	// the file or folder changed, and the libraries index it again
+	changed bool
+}
+
+// libraryIndexer is a library of some of the files in the shares, e.g. the
+// music library, which follows the files that change
+type libraryIndexer interface {
+	update(fullPath string)
+}
+
+// cacheJobHeap orders jobs by priority, and in the order they came within one
+type cacheJobHeap []*cacheJob
+
+func (h cacheJobHeap) Len() int { return len(h) }
+
+func (h cacheJobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h cacheJobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *cacheJobHeap) Push(x interface{}) {
+	job := x.(*cacheJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *cacheJobHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	job.index = -1
+	return job
+}
+
+// cacheStatus is what the API tells about the cache generation
+type cacheStatus struct {
+	Workers int       `json:"workers"`
+	Queued  int       `json:"queued"`
+	Listed  int       `json:"listed"`
+	Active  int       `json:"active"`
+	Done    int64     `json:"done"`
+	Failed  int64     `json:"failed"`
+	Since   time.Time `json:"since"`
+}
+
+// cacheQueue makes thumbnails and other cached data in the background, with
+// a few workers running at a lower CPU priority, so that the fsnotify events
+// are never held up by a big folder
+type cacheQueue struct {
+	jobs    cacheJobHeap
+	pending map[string]*cacheJob
+	seq     uint64
+	active  int
+	done    int64
+	failed  int64
+	workers int
+	nice    int
+	since   time.Time
+	// the shares the files are in, for their hidden files
+	shares *HdaShares
+	// the libraries to update with the files that change
+	libraries []libraryIndexer
+	ready  *sync.Cond
+	sync.Mutex
+}
+
+// cacheJobs is started once the configuration is loaded
+var cacheJobs = newCacheQueue()
+
+func newCacheQueue() *cacheQueue {
+	q := &cacheQueue{pending: make(map[string]*cacheJob), since: time.Now()}
+	q.ready = sync.NewCond(&q.Mutex)
+	return q
+}
+
+// add queues a job for the path, or raises the priority of the one queued
+func (q *cacheQueue) add(path string, priority int) {
+	q.Lock()
+	defer q.Unlock()
+	q.push(path, priority)
+}
+
+// changed queues a job for a file or folder that was created or written to,
+// so that the libraries index it on a worker rather than on the fsnotify loop
+func (q *cacheQueue) changed(path string) {
+	q.Lock()
+	defer q.Unlock()
+	q.push(path, priorityEvent).changed = true
+}
+
+func (q *cacheQueue) push(path string, priority int) *cacheJob {
+	if job, ok := q.pending[path]; ok {
+		if priority > job.priority {
+			job.priority = priority
+			heap.Fix(&q.jobs, job.index)
+		}
+		return job
+	}
+	q.seq++
+	job := &cacheJob{path: path, priority: priority, seq: q.seq}
+	heap.Push(&q.jobs, job)
+	q.pending[path] = job
+	q.ready.Signal()
+	return job
+}
+
+// index has the libraries follow the files that change
+func (q *cacheQueue) index(libraries ...libraryIndexer) {
+	q.Lock()
+	defer q.Unlock()
+	q.libraries = append(q.libraries, libraries...)
+}
+
+// drop forgets the jobs queued for the path and what is under it
+func (q *cacheQueue) drop(path string) {
+	q.Lock()
+	defer q.Unlock()
+	prefix := path + string(filepath.Separator)
+	for p, job := range q.pending {
+		if p == path || strings.HasPrefix(p, prefix) {
+			heap.Remove(&q.jobs, job.index)
+			delete(q.pending, p)
+		}
+	}
+}
+
+// next waits for the most urgent job
+func (q *cacheQueue) next() *cacheJob {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.jobs) == 0 {
+		q.ready.Wait()
+	}
+	job := heap.Pop(&q.jobs).(*cacheJob)
+	delete(q.pending, job.path)
+	q.active++
+	return job
+}
+
+func (q *cacheQueue) finish(ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	q.active--
+	q.done++
+	if !ok {
+		q.failed++
+	}
+}
+
+func (q *cacheQueue) status() *cacheStatus {
+	q.Lock()
+	defer q.Unlock()
+	s := &cacheStatus{Workers: q.workers, Queued: len(q.jobs), Active: q.active, Done: q.done, Failed: q.failed, Since: q.since}
+	for _, job := range q.jobs {
+		if job.priority == priorityListed {
+			s.Listed++
+		}
+	}
+	return s
+}
+
+// start runs the workers, as set by cache.workers (half the CPUs by default)
+// and cache.nice (the niceness they run at, 10 by default), for the files
+// of the shares
+func (q *cacheQueue) start(shares *HdaShares) {
+	workers := config.Int("cache.workers", (runtime.NumCPU()+1)/2)
+	if workers < 1 {
+		workers = 1
+	}
+	q.Lock()
+	q.workers = workers
+	q.shares = shares
+	q.nice = config.Int("cache.nice", defaultCacheNiceness)
+	q.Unlock()
+	logging.Info("Starting %d cache workers at niceness %d", workers, q.nice)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+// niceThread makes the calling goroutine run at the niceness of the workers,
+// on a thread of its own. The thread is thrown away when the goroutine ends,
+// and the commands it starts inherit the niceness
+func (q *cacheQueue) niceThread() {
+	q.Lock()
+	nice := q.nice
+	q.Unlock()
+	if nice == 0 {
+		return
+	}
+	runtime.LockOSThread()
+	if err := setThreadNiceness(nice); err != nil {
+		debug(3, "Error setting niceness of cache thread: %s", err.Error())
+	}
+}
+
+func (q *cacheQueue) work() {
+	q.niceThread()
+	for {
+		job := q.next()
+		q.finish(q.run(job))
+	}
+}
+
+// run makes the cache of a file, or looks into a folder: it is watched, and
+// the files in it that need caching are queued, along with the subfolders
+func (q *cacheQueue) run(job *cacheJob) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			logging.Error("Panic while caching %s: %s", job.path, v)
+			ok = false
+		}
+	}()
+
+	if strings.Contains(job.path, ".fscache") {
+		return true
+	}
+	hidden, dir := q.hiddenFor(job.path)
+	if hidden != nil && dir != "/" && (hidden.hides(dir) || hidden.entry(filepath.Dir(dir), filepath.Base(dir))) {
+		// e.g. created in a folder that is not hidden
+		return true
+	}
+	info, err := os.Stat(job.path)
+	if err != nil {
+		// gone already
+		return true
+	}
+	if job.changed {
+		q.Lock()
+		libraries := q.libraries
+		q.Unlock()
+		for _, library := range libraries {
+			library.update(job.path)
+		}
+	}
+	if !info.IsDir() {
+		return cacheFile(job.path, info) == nil
+	}
+	if watcher != nil {
+		watcher.Add(job.path)
+	}
+	fis, err := ioutil.ReadDir(job.path)
+	if err != nil {
+		debug(2, "Error reading folder %s for caching: %s", job.path, err.Error())
+		return false
+	}
+	for _, fi := range fis {
+		if fi.Name() == ".fscache" {
+			fscache.migrateFolder(job.path)
+			continue
+		}
+		if hidden != nil && hidden.entry(dir, fi.Name()) {
+			continue
+		}
+		path := filepath.Join(job.path, fi.Name())
+		if fi.IsDir() || needsCache(path, fi) {
+			q.add(path, job.priority)
+		}
+	}
+	return true
+}
+
+// hiddenFor returns the hidden files of the share a path is in, and the path
+// in the share, or nil when the share is not known
+func (q *cacheQueue) hiddenFor(path string) (*hiddenFiles, string) {
+	q.Lock()
+	shares := q.shares
+	q.Unlock()
+	if shares == nil {
+		return nil, ""
+	}
+	share, relativePath := shares.ForPath(path)
+	if share == nil {
+		return nil, ""
+	}
+	return hiddenIn(share.name), relativePath
+}
+
+// prioritize queues the files of a listing of the folder at path in the
+// share that have no cache yet, ahead of everything else
+func (q *cacheQueue) prioritize(fullPath, share, path string, fis []os.FileInfo) {
+	hidden := hiddenIn(share)
+	for _, fi := range fis {
+		if fi.IsDir() || hidden.entry(path, fi.Name()) {
+			continue
+		}
+		path := filepath.Join(fullPath, fi.Name())
+		if needsCache(path, fi) {
+			q.add(path, priorityListed)
+		}
+	}
+}
+
+// serveCacheStatus tells how far the cache generation is
+func (service *MercuryFsService) serveCacheStatus(writer http.ResponseWriter, request *http.Request) {
+	if !isAdmin(request) && service.checkAuthHeader(writer, request) == nil {
+		return
+	}
+	result, _ := json.Marshal(cacheJobs.status())
+	service.serveJSON(writer, request, string(result))
+}
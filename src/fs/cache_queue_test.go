@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheQueueOrder(t *testing.T) {
+	q := newCacheQueue()
+	q.add("/share/a", priorityScan)
+	q.add("/share/b", priorityScan)
+	q.add("/share/c", priorityEvent)
+	q.add("/share/dir/d", priorityScan)
+	q.add("/share/dir/e", priorityScan)
+	q.add("/share/b", priorityListed)
+	q.add("/share/c", priorityScan)
+	q.drop("/share/dir")
+
+	if s := q.status(); s.Queued != 3 || s.Listed != 1 {
+		t.Errorf("Status is %+v", s)
+	}
+	for _, expected := range []string{"/share/b", "/share/c", "/share/a"} {
+		job := q.next()
+		q.finish(true)
+		if job.path != expected {
+			t.Errorf("Job for %s, expected %s", job.path, expected)
+		}
+	}
+	if s := q.status(); s.Queued != 0 || s.Done != 3 {
+		t.Errorf("Status is %+v", s)
+	}
+}
+
+func TestCacheQueueRun(t *testing.T) {
+	registry := newThumbnailRegistry()
+	registry.register(funcProvider{"image", thumbnailer}, []string{"image/"}, builtinPriority, time.Minute)
+	saved := thumbnails
+	thumbnails = registry
+	defer func() { thumbnails = saved }()
+
+	dir, err := ioutil.TempDir("", "amahi-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	os.MkdirAll(filepath.Join(dir, "photos"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "photos", "a.png"), picture.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+
+	q := newCacheQueue()
+	q.add(dir, priorityScan)
+	for q.status().Queued > 0 {
+		q.finish(q.run(q.next()))
+	}
+	// the folder, the subfolder and the picture; text files have no thumbnails
+	if s := q.status(); s.Done != 3 || s.Failed != 0 {
+		t.Errorf("Status is %+v", s)
+	}
+	if !exists(thumbnailPathFor(filepath.Join(dir, "photos", "a.png"))) {
+		t.Errorf("No thumbnail made")
+	}
+
+	// once cached, listing the folder queues nothing
+	fis, _ := ioutil.ReadDir(filepath.Join(dir, "photos"))
+	q.prioritize(filepath.Join(dir, "photos"), "", "/photos", fis)
+	if s := q.status(); s.Queued != 0 {
+		t.Errorf("Cached file queued again: %+v", s)
+	}
+}
+
+type testIndexer []string
+
+func (indexer *testIndexer) update(fullPath string) {
+	*indexer = append(*indexer, fullPath)
+}
+
+func TestCacheQueueChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amahi-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "album"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "album", "a.mp3"), []byte("data"), 0644)
+
+	indexer := new(testIndexer)
+	q := newCacheQueue()
+	q.index(indexer)
+	q.add(dir, priorityScan)
+	q.changed(filepath.Join(dir, "album"))
+	q.changed(filepath.Join(dir, "gone.mp3"))
+	for q.status().Queued > 0 {
+		q.finish(q.run(q.next()))
+	}
+	// only what changed, and is still there, and not the files found in it
+	if len(*indexer) != 1 || (*indexer)[0] != filepath.Join(dir, "album") {
+		t.Errorf("Libraries updated with %v", *indexer)
+	}
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheMaxSizeMB = 2048
+	// the cache is trimmed down to this share of the maximum size
+	cacheEvictTarget = 0.9
+	cacheEvictPeriod = 15 * time.Minute
+	// how often the access time of a cached file is kept up to date
+	cacheTouchPeriod = time.Hour
+)
+
+var cacheKeysSchema = []string{
+	`CREATE TABLE IF NOT EXISTS cache_keys (
+		path TEXT PRIMARY KEY,
+		mtime INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		hash TEXT NOT NULL)`,
+}
+
+// cacheStore is where thumbnails and book metadata are kept. By default it
+// is a .fscache folder in every folder of the shares. With cache.dir set, it
+// is that one folder instead, where each file is named after a key of the
+// original: a hash of its path, mtime and size, or with cache.key = content a
+// hash of what is in it, so that identical files share their cache. The
+// central cache is kept under cache.max_size_mb, dropping what was used least
+// recently
+type cacheStore struct {
+	dir       string
+	byContent bool
+	maxSize   int64
+	// content keys, kept in the local store when there is one
+	store *LocalStore
+	keys  map[string]cacheKey
+	sync.Mutex
+}
+
+type cacheKey struct {
+	mtime int64
+	size  int64
+	hash  string
+}
+
+// fscache is set up once the configuration is loaded
+var fscache = newCacheStore("", false, 0)
+
+func newCacheStore(dir string, byContent bool, maxSize int64) *cacheStore {
+	return &cacheStore{dir: dir, byContent: byContent, maxSize: maxSize, keys: make(map[string]cacheKey)}
+}
+
+func initCacheStore() {
+	dir := config.String("cache.dir", "")
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logging.Error("Cannot create cache folder %s, using .fscache folders: %s", dir, err.Error())
+			dir = ""
+		}
+	}
+	fscache = newCacheStore(dir, config.String("cache.key", "path") == "content",
+		int64(config.Int("cache.max_size_mb", defaultCacheMaxSizeMB))<<20)
+}
+
+// central tells whether the cache is in one folder rather than in the shares
+func (c *cacheStore) central() bool {
+	return c.dir != ""
+}
+
+// setStore keeps the content keys in the local store, so files are not read
+// again after restarts
+func (c *cacheStore) setStore(store *LocalStore) error {
+	if err := store.createTables(cacheKeysSchema...); err != nil {
+		return err
+	}
+	c.Lock()
+	c.store = store
+	c.Unlock()
+	return nil
+}
+
+// pathFor returns where the cache of the given kind ("thumbnails" or "books")
+// of a file is kept, or "" when it cannot tell. Content keys are only worked
+// out when compute is set, as that reads the whole file: listings must not
+func (c *cacheStore) pathFor(kind, path, ext string, compute bool) string {
+	if !c.central() {
+		return filepath.Join(filepath.Dir(path), ".fscache", kind, filepath.Base(path)+ext)
+	}
+	key := c.key(path, compute)
+	if key == "" {
+		return ""
+	}
+	return filepath.Join(c.dir, kind, key[:2], key+ext)
+}
+
+func (c *cacheStore) key(path string, compute bool) string {
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() {
+		return ""
+	}
+	if !c.byContent {
+		return sha1string(fmt.Sprintf("%s\x00%d\x00%d", path, fi.ModTime().UnixNano(), fi.Size()))
+	}
+	mtime, size := fi.ModTime().UnixNano(), fi.Size()
+	if k, ok := c.knownKey(path); ok && k.mtime == mtime && k.size == size {
+		return k.hash
+	}
+	if !compute {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	sum := sha1.New()
+	if _, err = io.Copy(sum, f); err != nil {
+		debug(2, "Error reading %s for its cache key: %s", path, err.Error())
+		return ""
+	}
+	hash := fmt.Sprintf("%x", sum.Sum(nil))
+	c.saveKey(path, cacheKey{mtime, size, hash})
+	return hash
+}
+
+func (c *cacheStore) knownKey(path string) (cacheKey, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.store == nil {
+		k, ok := c.keys[path]
+		return k, ok
+	}
+	var k cacheKey
+	err := c.store.db.QueryRow("SELECT mtime, size, hash FROM cache_keys WHERE path = ?", path).Scan(&k.mtime, &k.size, &k.hash)
+	if err != nil && err != sql.ErrNoRows {
+		debug(2, "Error reading cache key of %s: %s", path, err.Error())
+	}
+	return k, err == nil
+}
+
+func (c *cacheStore) saveKey(path string, k cacheKey) {
+	c.Lock()
+	defer c.Unlock()
+	if c.store == nil {
+		c.keys[path] = k
+		return
+	}
+	c.store.db.Exec("INSERT OR REPLACE INTO cache_keys (path, mtime, size, hash) VALUES (?, ?, ?, ?)",
+		path, k.mtime, k.size, k.hash)
+}
+
+// forget drops the content key of a file that is gone
+func (c *cacheStore) forget(path string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.keys, path)
+	if c.store != nil {
+		c.store.db.Exec("DELETE FROM cache_keys WHERE path = ?", path)
+	}
+}
+
+// dropKeys forgets all the content keys, when the central cache is emptied
+func (c *cacheStore) dropKeys() {
+	c.Lock()
+	defer c.Unlock()
+	c.keys = make(map[string]cacheKey)
+	if c.store != nil {
+		c.store.db.Exec("DELETE FROM cache_keys")
+	}
+}
+
+// dropStaleKeys forgets the content keys of files that are gone or changed
+func (c *cacheStore) dropStaleKeys() {
+	c.Lock()
+	keys := make(map[string]cacheKey)
+	for path, k := range c.keys {
+		keys[path] = k
+	}
+	store := c.store
+	c.Unlock()
+	if store != nil {
+		rows, err := store.db.Query("SELECT path, mtime, size FROM cache_keys")
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			var path string
+			var k cacheKey
+			rows.Scan(&path, &k.mtime, &k.size)
+			keys[path] = k
+		}
+		rows.Close()
+	}
+	for path, k := range keys {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().UnixNano() != k.mtime || fi.Size() != k.size {
+			c.forget(path)
+		}
+	}
+}
+
+// fresh tells whether the cached file is there and up to date with info. The
+// key of a central cache changes with the file, so there it only has to exist
+func (c *cacheStore) fresh(cachePath string, info os.FileInfo) bool {
+	if cachePath == "" {
+		return false
+	}
+	cacheInfo, err := os.Stat(cachePath)
+	if err != nil {
+		return false
+	}
+	return c.central() || !info.ModTime().After(cacheInfo.ModTime())
+}
+
+// touch records that a file of the central cache was used. The access time
+// is set, rather than the mtime, which is what the clients see
+func (c *cacheStore) touch(cachePath string, fi os.FileInfo) {
+	if !c.central() || time.Since(accessTime(fi)) < cacheTouchPeriod {
+		return
+	}
+	os.Chtimes(cachePath, time.Now(), fi.ModTime())
+}
+
+// evict removes the least recently used files of the central cache when it
+// is over its size
+func (c *cacheStore) evict() {
+	type cached struct {
+		path  string
+		size  int64
+		atime time.Time
+	}
+	files := make([]cached, 0)
+	total := int64(0)
+	filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files = append(files, cached{path, fi.Size(), accessTime(fi)})
+			total += fi.Size()
+		}
+		return nil
+	})
+	if total <= c.maxSize {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].atime.Before(files[j].atime) })
+	target := int64(float64(c.maxSize) * cacheEvictTarget)
+	removed := 0
+	for _, f := range files {
+		if total <= target {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+			removed++
+		}
+	}
+	logging.Info("Evicted %d files from the cache in %s", removed, c.dir)
+}
+
+func (c *cacheStore) evictLoop() {
+	if !c.central() {
+		return
+	}
+	for {
+		c.evict()
+		time.Sleep(cacheEvictPeriod)
+	}
+}
+
+// migrateFolder moves the .fscache of a folder into the central cache, when
+// cache.migrate is on (the default), and removes it
+func (c *cacheStore) migrateFolder(dir string) {
+	if !c.central() || !config.Bool("cache.migrate", true) {
+		return
+	}
+	local := filepath.Join(dir, ".fscache")
+	for _, kind := range []string{"thumbnails", "books"} {
+		fis, err := ioutil.ReadDir(filepath.Join(local, kind))
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			old := filepath.Join(local, kind, fi.Name())
+			name, ext := fi.Name(), ""
+			if kind == "books" {
+				ext = ".json"
+				name = strings.TrimSuffix(name, ext)
+			}
+			target := c.pathFor(kind, filepath.Join(dir, name), ext, true)
+			if target != "" && !exists(target) {
+				if err := moveCacheFile(old, target); err != nil {
+					debug(2, "Error moving %s into the cache: %s", old, err.Error())
+					continue
+				}
+			}
+			os.Remove(old)
+		}
+		os.Remove(filepath.Join(local, kind))
+	}
+	if err := os.Remove(local); err == nil {
+		debug(3, "Moved %s into the cache", local)
+	}
+}
+
+// moveCacheFile moves a file, which may be to another file system
+func moveCacheFile(from, to string) error {
+	os.MkdirAll(filepath.Dir(to), 0755)
+	if os.Rename(from, to) == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(to, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
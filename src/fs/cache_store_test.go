@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCacheDirs(t *testing.T) (string, string, func()) {
+	shareDir, err := ioutil.TempDir("", "amahi-share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir, err := ioutil.TempDir("", "amahi-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shareDir, cacheDir, func() {
+		os.RemoveAll(shareDir)
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func TestCacheStorePaths(t *testing.T) {
+	shareDir, cacheDir, cleanup := testCacheDirs(t)
+	defer cleanup()
+	a := filepath.Join(shareDir, "a.jpg")
+	b := filepath.Join(shareDir, "b.jpg")
+	ioutil.WriteFile(a, []byte("same"), 0644)
+	ioutil.WriteFile(b, []byte("same"), 0644)
+
+	local := newCacheStore("", false, 0)
+	if p := local.pathFor("thumbnails", a, "", false); p != filepath.Join(shareDir, ".fscache/thumbnails/a.jpg") {
+		t.Errorf("Local thumbnail path is %s", p)
+	}
+
+	byPath := newCacheStore(cacheDir, false, 0)
+	p := byPath.pathFor("thumbnails", a, "", false)
+	if !strings.HasPrefix(p, filepath.Join(cacheDir, "thumbnails")) || p == byPath.pathFor("thumbnails", b, "", false) {
+		t.Errorf("Path keyed thumbnail path is %s", p)
+	}
+	os.Chtimes(a, time.Now(), time.Now().Add(time.Hour))
+	if p == byPath.pathFor("thumbnails", a, "", false) {
+		t.Errorf("Path key did not change with the file")
+	}
+	if p := byPath.pathFor("books", filepath.Join(shareDir, "missing"), ".json", false); p != "" {
+		t.Errorf("Path for missing file is %s", p)
+	}
+
+	byContent := newCacheStore(cacheDir, true, 0)
+	if p := byContent.pathFor("thumbnails", a, "", false); p != "" {
+		t.Errorf("Content key worked out for a listing: %s", p)
+	}
+	p = byContent.pathFor("thumbnails", a, "", true)
+	if p == "" || p != byContent.pathFor("thumbnails", b, "", true) {
+		t.Errorf("Identical files do not share their thumbnail: %s", p)
+	}
+	if p != byContent.pathFor("thumbnails", a, "", false) {
+		t.Errorf("Content key not remembered")
+	}
+}
+
+func TestCacheStoreMigrate(t *testing.T) {
+	shareDir, cacheDir, cleanup := testCacheDirs(t)
+	defer cleanup()
+	file := filepath.Join(shareDir, "a.jpg")
+	ioutil.WriteFile(file, []byte("picture"), 0644)
+	os.MkdirAll(filepath.Join(shareDir, ".fscache/thumbnails"), 0755)
+	ioutil.WriteFile(filepath.Join(shareDir, ".fscache/thumbnails/a.jpg"), []byte("thumbnail"), 0644)
+	ioutil.WriteFile(filepath.Join(shareDir, ".fscache/thumbnails/gone.jpg"), []byte("thumbnail"), 0644)
+
+	c := newCacheStore(cacheDir, false, 0)
+	c.migrateFolder(shareDir)
+	if data, _ := ioutil.ReadFile(c.pathFor("thumbnails", file, "", false)); string(data) != "thumbnail" {
+		t.Errorf("Thumbnail not moved, found %q", data)
+	}
+	if exists(filepath.Join(shareDir, ".fscache")) {
+		t.Errorf(".fscache not removed")
+	}
+}
+
+func TestCacheStoreEvict(t *testing.T) {
+	_, cacheDir, cleanup := testCacheDirs(t)
+	defer cleanup()
+	c := newCacheStore(cacheDir, false, 2500)
+	for i, name := range []string{"old", "used", "new"} {
+		path := filepath.Join(cacheDir, "thumbnails", name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, make([]byte, 1000), 0644)
+		when := time.Now().Add(time.Duration(i-10) * time.Hour)
+		os.Chtimes(path, when, when)
+	}
+	fi, _ := os.Stat(filepath.Join(cacheDir, "thumbnails", "old"))
+	c.touch(filepath.Join(cacheDir, "thumbnails", "old"), fi)
+
+	c.evict()
+	if !exists(filepath.Join(cacheDir, "thumbnails", "old")) || exists(filepath.Join(cacheDir, "thumbnails", "used")) {
+		t.Errorf("Evicted the wrong files")
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix of the rows of the HDA settings table that configure this service
+const configSettingsPrefix = "amahi-anywhere."
+
+// Config holds the runtime options of the service. They are read from
+// CONFIG_FILE, with "key = value" lines, and from the HDA settings table,
+// where they are named with configSettingsPrefix and take precedence
+type Config struct {
+	values map[string]string
+	sync.RWMutex
+}
+
+// the options in effect, empty (i.e. all defaults) until loadConfig is called
+var config = &Config{values: make(map[string]string)}
+
+func loadConfig(path string, fromDatabase bool) *Config {
+	c := &Config{values: make(map[string]string)}
+	c.readFile(path)
+	if fromDatabase {
+		c.readDatabase()
+	}
+	return c
+}
+
+func (c *Config) readFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Error("Error reading configuration %s: %s", path, err.Error())
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			logging.Warning("Ignoring configuration line: %s", line)
+			continue
+		}
+		c.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+}
+
+func (c *Config) readDatabase() {
+	dbconn, err := sql.Open("mysql", MYSQL_CREDENTIALS)
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+	defer dbconn.Close()
+	q := "SELECT name, value FROM settings WHERE name LIKE ?"
+	rows, err := dbconn.Query(q, configSettingsPrefix+"%")
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		rows.Scan(&name, &value)
+		c.set(strings.TrimPrefix(name, configSettingsPrefix), strings.TrimSpace(value))
+	}
+}
+
+func (c *Config) set(key, value string) {
+	c.Lock()
+	c.values[key] = value
+	c.Unlock()
+}
+
+func (c *Config) get(key string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
+func (c *Config) String(key, def string) string {
+	if value, ok := c.get(key); ok {
+		return value
+	}
+	return def
+}
+
+func (c *Config) Int(key string, def int) int {
+	if value, ok := c.get(key); ok {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		logging.Warning("Configuration %s is not a number: %s", key, value)
+	}
+	return def
+}
+
+func (c *Config) Bool(key string, def bool) bool {
+	if value, ok := c.get(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+		logging.Warning("Configuration %s is not true or false: %s", key, value)
+	}
+	return def
+}
+
+// Duration reads values like "90s", "10m" or "24h"
+func (c *Config) Duration(key string, def time.Duration) time.Duration {
+	if value, ok := c.get(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		logging.Warning("Configuration %s is not a duration: %s", key, value)
+	}
+	return def
+}
+
+// List reads comma separated values
+func (c *Config) List(key string, def []string) []string {
+	value, ok := c.get(key)
+	if !ok {
+		return def
+	}
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
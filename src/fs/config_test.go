@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestFile(t, "config", []byte(`# comment
+hls.transcoder = ffmpeg -i {input} {dir}/index.m3u8
+hls.max_sessions = 4
+hls.idle_timeout=90s
+hidden = .*, Thumbs.db ,
+broken line
+`))
+	defer os.Remove(path)
+
+	c := loadConfig(path, false)
+	if s := c.String("hls.transcoder", ""); s != "ffmpeg -i {input} {dir}/index.m3u8" {
+		t.Errorf("String read %q", s)
+	}
+	if n := c.Int("hls.max_sessions", 2); n != 4 {
+		t.Errorf("Int read %d", n)
+	}
+	if d := c.Duration("hls.idle_timeout", time.Minute); d != 90*time.Second {
+		t.Errorf("Duration read %s", d)
+	}
+	if l := c.List("hidden", nil); len(l) != 2 || l[0] != ".*" || l[1] != "Thumbs.db" {
+		t.Errorf("List read %q", l)
+	}
+	if b := c.Bool("missing", true); !b {
+		t.Errorf("Bool did not default")
+	}
+}
@@ -21,11 +21,15 @@ import (
 )
 
 type fileInfo struct {
-	name     string
-	mimeType string
-	mtime    time.Time
-	size     int64
-	cache    fileCacheInfo
+	name      string
+	mimeType  string
+	mtime     time.Time
+	size      int64
+	cache     fileCacheInfo
+	subtitles []subtitleInfo
+	playback  *playbackPosition
+	tags      []string
+	book      *bookInfo
 }
 
 type fileCacheInfo struct {
@@ -62,11 +66,9 @@ func (f *fileCacheInfo) invalidateCache() {
 }
 
 func (f *fileCacheInfo) fillCache(filePath, share, path string) {
-	parentDir := filepath.Dir(filePath)
 	filename := filepath.Base(filePath)
 
-	thumbnailDirPath := filepath.Join(parentDir, ".fscache/thumbnails")
-	thumbnailPath := filepath.Join(thumbnailDirPath, filename)
+	thumbnailPath := thumbnailPathFor(filePath)
 	thumbnailInfo, err := os.Stat(thumbnailPath)
 	if os.IsNotExist(err) {
 		f.status = false
@@ -96,14 +98,38 @@ func (f *fileCacheInfo) toJson() string {
 
 func (f *fileInfo) toJson() string {
 	name, _ := json.Marshal(f.name)
-	return fmt.Sprintf(`{"name": %s, "mime_type": "%s", "mtime": "%s", "size": %d, "cache": %s}`,
-		string(name), f.mimeType, f.mtime.Format(http.TimeFormat), f.size, f.cache.toJson())
+	extra := ""
+	if strings.HasPrefix(f.mimeType, "video") {
+		subtitles, _ := json.Marshal(f.subtitles)
+		extra += fmt.Sprintf(`, "subtitles": %s`, string(subtitles))
+	}
+	if strings.HasPrefix(f.mimeType, "audio") || strings.HasPrefix(f.mimeType, "video") {
+		playback, _ := json.Marshal(f.playback)
+		extra += fmt.Sprintf(`, "playback": %s`, string(playback))
+	}
+	if f.book != nil {
+		book, _ := json.Marshal(f.book)
+		extra += fmt.Sprintf(`, "book": %s`, string(book))
+	}
+	if f.tags != nil {
+		tags, _ := json.Marshal(f.tags)
+		extra += fmt.Sprintf(`, "tags": %s`, string(tags))
+	}
+	return fmt.Sprintf(`{"name": %s, "mime_type": "%s", "mtime": "%s", "size": %d, "cache": %s%s}`,
+		string(name), f.mimeType, f.mtime.Format(http.TimeFormat), f.size, f.cache.toJson(), extra)
 }
 
 func directoryFileInfos(fis []os.FileInfo, fullPath, share, path string) []fileInfo {
 	fileInfos := make([]fileInfo, 0)
+	hidden := hiddenIn(share)
+	names := make([]string, 0, len(fis))
 	for i := range fis {
-		if fis[i].Name()[0] == '.' {
+		if !hidden.entry(path, fis[i].Name()) {
+			names = append(names, fis[i].Name())
+		}
+	}
+	for i := range fis {
+		if hidden.entry(path, fis[i].Name()) {
 			continue
 		}
 		fileInfo := fileInfo{
@@ -117,6 +143,11 @@ func directoryFileInfos(fis []os.FileInfo, fullPath, share, path string) []fileI
 		} else {
 			fileInfo.mimeType = getContentType(fis[i].Name())
 			fileInfo.size = fis[i].Size()
+			if strings.HasPrefix(fileInfo.mimeType, "video") {
+				fileInfo.subtitles = sidecarSubtitles(fileInfo.name, names, share, path)
+			} else if fileInfo.mimeType == "application/epub+zip" {
+				fileInfo.book = cachedBookInfo(filepath.Join(fullPath, fileInfo.name))
+			}
 		}
 		fileInfos = append(fileInfos, fileInfo)
 	}
@@ -128,13 +159,20 @@ func directoryFileInfos(fis []os.FileInfo, fullPath, share, path string) []fileI
 	return fileInfos
 }
 
-func dirToJSON(osFile *os.File, fullPath, share, path string) (string, error) {
+// dirToJSON lists the directory, after letting each annotator add what it
+// knows about the entries (e.g. things specific to the requester)
+func dirToJSON(osFile *os.File, fullPath, share, path string, annotators ...func([]fileInfo)) (string, error) {
 	fis, err := osFile.Readdir(0)
 	if err != nil {
 		return "", err
 	}
 
 	fileInfos := directoryFileInfos(fis, fullPath, share, path)
+	// what the client is looking at is cached first
+	cacheJobs.prioritize(fullPath, share, path, fis)
+	for _, annotate := range annotators {
+		annotate(fileInfos)
+	}
 
 	if len(fileInfos) == 0 {
 		return "[]", nil
@@ -158,6 +196,8 @@ func getContentType(fileName string) string {
 		".ogx":  "application/ogg",
 		".anx":  "application/annodex",
 		".txt":  "text/plain",
+		".log":  "text/plain",
+		".md":   "text/markdown",
 		".jpg":  "image/jpeg",
 		".jpeg": "image/jpeg",
 		".tif":  "image/tiff",
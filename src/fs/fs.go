@@ -53,6 +53,11 @@ var watcher *fsnotify.Watcher
 
 func main() {
 
+	// maintenance commands run alongside the service
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(cacheCommand(os.Args[2:]))
+	}
+
 	defer panicHandler()
 
 	setup()
@@ -112,6 +117,13 @@ func main() {
 
 	initializeLogging(LOGFILE, splitFile, noBuffer)
 
+	// the HDA database is not there when serving a plain directory
+	config = loadConfig(CONFIG_FILE, rootDir == "")
+	initThumbnailProviders()
+	initCacheStore()
+	initAdminAuth(apiKey)
+	initAuditLog()
+
 	metadata, err := metadata.Init(100000, METADATA_FILE, TMDB_API_KEY, TVRAGE_API_KEY, TVDB_API_KEY)
 	if err != nil {
 		fmt.Printf("Error initializing metadata library\n")
@@ -130,10 +142,49 @@ func main() {
 
 	go service.Shares.startMetadataPrefill(metadata)
 
+	store, err := NewLocalStore(LOCAL_DB_FILE)
+	if err != nil {
+		fmt.Printf("Error opening local database %s: %s\n", LOCAL_DB_FILE, err.Error())
+		os.Remove(PID_FILE)
+		os.Exit(1)
+	}
+	defer store.Close()
+	service.store = store
+	service.urlKey = store.secret("url-signing-key")
+	if err = thumbnails.setStore(store); err != nil {
+		logging.Error("Error reading thumbnail failures: %s", err.Error())
+	}
+	if err = service.Users.setStore(store); err != nil {
+		logging.Error("Error reading sessions: %s", err.Error())
+	}
+	if err = fscache.setStore(store); err != nil {
+		logging.Error("Error setting up cache keys: %s", err.Error())
+	}
+
+	service.Music, err = NewMusicLibrary(store, service.Shares)
+	if err != nil {
+		fmt.Printf("Error initializing music library\n")
+		os.Remove(PID_FILE)
+		os.Exit(1)
+	}
+	go service.Shares.startMusicScan(service.Music)
+
+	service.Books, err = NewBookLibrary(store, service.Shares)
+	if err != nil {
+		fmt.Printf("Error initializing book library\n")
+		os.Remove(PID_FILE)
+		os.Exit(1)
+	}
+	go service.Shares.startBookScan(service.Books)
+
 	watcher, _ = fsnotify.NewWatcher()
 	defer watcher.Close()
 
-	go service.Shares.createThumbnailCache()
+	cacheJobs.index(service.Music, service.Books)
+	cacheJobs.start(service.Shares)
+	go service.Shares.createThumbnailCache(service.Music, service.Books)
+	go service.Transcoder.cleanupLoop()
+	go fscache.evictLoop()
 
 	//log("Amahi Anywhere service v%s", VERSION)
 	logging.Info("Amahi Anywhere service v%s", VERSION)
@@ -281,6 +332,20 @@ func setup() error {
 	return ioutil.WriteFile(PID_FILE, []byte(strconv.Itoa(os.Getpid())), 0666)
 }
 
+// runningPid returns the PID in the PID file, if that process is alive.
+// note: this works on systems with /proc/
+func runningPid(pidFile string) string {
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return ""
+	}
+	pid := strings.TrimSpace(string(data))
+	if pid == "" || !exists(fmt.Sprintf("/proc/%s/stat", pid)) {
+		return ""
+	}
+	return pid
+}
+
 func checkPidFile() {
 	if !exists(PID_FILE) {
 		return
@@ -137,6 +137,34 @@ func (shares *HdaShares) Get(shareName string) *HdaShare {
 	return nil
 }
 
+// ForPath returns the share holding the file at fullPath, along with the
+// path of the file relative to the share, as used in the "p" parameter
+func (shares *HdaShares) ForPath(fullPath string) (*HdaShare, string) {
+	shares.RLock()
+	defer shares.RUnlock()
+	var found *HdaShare
+	root := ""
+	for i := range shares.Shares {
+		path := filepath.Clean(shares.Shares[i].path)
+		if shares.Shares[i].path == "" || (fullPath != path && !strings.HasPrefix(fullPath, path+"/")) {
+			continue
+		}
+		// nested shares: the deepest one wins
+		if found == nil || len(path) > len(root) {
+			found = shares.Shares[i]
+			root = path
+		}
+	}
+	if found == nil {
+		return nil, ""
+	}
+	relativePath := strings.TrimPrefix(fullPath, root)
+	if relativePath == "" {
+		relativePath = "/"
+	}
+	return found, relativePath
+}
+
 func SharesJson(shares []*HdaShare) string {
 	if len(shares) < 1 {
 		return "[]"
@@ -198,7 +226,33 @@ func (shares *HdaShares) startMetadataPrefill(library *metadata.Library) {
 	}
 }
 
-func (shares *HdaShares) createThumbnailCache() {
+// start a scan of the shares tagged as music into the music library
+func (shares *HdaShares) startMusicScan(library *MusicLibrary) {
+	// start it up after some time, to prevent overloads
+	time.Sleep(15 * time.Second)
+	for i := range shares.Shares {
+		path := shares.Shares[i].path
+		tags := strings.ToLower(shares.Shares[i].tags)
+		if path == "" || !strings.Contains(tags, "music") {
+			continue
+		}
+		library.scanShare(shares.Shares[i])
+	}
+}
+
+// start a scan of the shares tagged as books into the book library
+func (shares *HdaShares) startBookScan(library *BookLibrary) {
+	// start it up after some time, to prevent overloads
+	time.Sleep(20 * time.Second)
+	for i := range shares.Shares {
+		if shares.Shares[i].path == "" || !isBookShare(shares.Shares[i]) {
+			continue
+		}
+		library.scanShare(shares.Shares[i])
+	}
+}
+
+func (shares *HdaShares) createThumbnailCache(library *MusicLibrary, books *BookLibrary) {
 	time.Sleep(2 * time.Second)
 	go func() {
 		for {
@@ -210,9 +264,11 @@ func (shares *HdaShares) createThumbnailCache() {
 				logging.Info("FSNOTIFY EVENT: `%s`, NAME: `%s`", op, event.Name)
 				switch {
 				case op == "CREATE" || op == "WRITE":
-					fillCache(event.Name)
+					cacheJobs.changed(event.Name)
 				case op == "REMOVE" || op == "RENAME":
 					removeCache(event.Name)
+					library.remove(event.Name)
+					books.remove(event.Name)
 				}
 
 				// watch for errors
@@ -230,6 +286,6 @@ func (shares *HdaShares) createThumbnailCache() {
 		if path == "" {
 			continue
 		}
-		fillCache(path)
+		cacheJobs.add(path, priorityScan)
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 	"crypto/rand"
+	"errors"
 )
 
 type HdaUser struct {
@@ -13,19 +14,76 @@ type HdaUser struct {
 	Login         string    `json:"login"`
 	Name          string    `json:"name"`
 	UpdatedAt     time.Time `json:"updated_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	Device        string    `json:"device"`
+	UserAgent     string    `json:"user_agent"`
 	LastRequestAt time.Time `json:"last_request_at"`
 	LastCheckedAt time.Time `json:"last_checked_at"`
 	IsDemo        bool      `json:"is_demo"`
+
+	// the id of the session, the hash of its first token
+	session string
+	// the hash of the token that lets the requests in, which is the id for
+	// sessions without a refresh token
+	accessHash      string
+	accessExpiresAt time.Time
+	refreshHash     string
+	usedRefreshHash string
+}
+
+// refreshable tells whether the session has a refresh token, the sessions
+// without one have tokens that do not expire on their own
+func (user *HdaUser) refreshable() bool {
+	return user.refreshHash != ""
 }
 
+// sessionTokens is what a login or a refresh answers. Sessions without a
+// refresh token only have the auth_token
+type sessionTokens struct {
+	AuthToken    string `json:"auth_token"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+var (
+	errUnknownRefreshToken = errors.New("unknown refresh token")
+	errRefreshTokenReused  = errors.New("refresh token used again")
+)
+
+// HdaUsers are the sessions of the users, by hash of their access token. They
+// are kept in the local store once it is open, so they survive restarts, and
+// expire after being idle for auth.session_idle or at auth.session_max.
+// Access tokens last auth.access_ttl and are renewed with the refresh token.
+// While auth.legacy_tokens is on, clients that do not ask for a refresh token
+// get a token that lasts as long as the session, as they used to
 type HdaUsers struct {
-	IsDemo bool
-	Users  map[string]*HdaUser
+	IsDemo       bool
+	Users        map[string]*HdaUser
+	store        *LocalStore
+	idleTimeout  time.Duration
+	maxAge       time.Duration
+	accessTTL    time.Duration
+	legacyTokens bool
 	sync.RWMutex
 }
 
 func NewHdaUsers(isDemo bool) *HdaUsers {
-	return &HdaUsers{IsDemo: isDemo, Users: make(map[string]*HdaUser)}
+	return &HdaUsers{
+		IsDemo:       isDemo,
+		Users:        make(map[string]*HdaUser),
+		idleTimeout:  config.Duration("auth.session_idle", 30*24*time.Hour),
+		maxAge:       config.Duration("auth.session_max", 180*24*time.Hour),
+		accessTTL:    config.Duration("auth.access_ttl", time.Hour),
+		legacyTokens: config.Bool("auth.legacy_tokens", true),
+	}
+}
+
+// setStore keeps the sessions in the local store, and drops the expired ones
+func (users *HdaUsers) setStore(store *LocalStore) error {
+	users.Lock()
+	users.store = store
+	users.Unlock()
+	return store.deleteExpiredSessions(users.idleTimeout, users.maxAge)
 }
 
 func tokenGenerator() string {
@@ -34,7 +92,18 @@ func tokenGenerator() string {
 	return fmt.Sprintf("%x", b)
 }
 
-func (users *HdaUsers) queryUser(pin string) (*string, error) {
+// queryUser logs in the user with the given PIN. Clients ask for a refresh
+// token, which they get anyway once auth.legacy_tokens is off
+func (users *HdaUsers) queryUser(pin, device, userAgent string, refresh bool) (*sessionTokens, error) {
+	user, err := users.lookupUser(pin)
+	if err != nil {
+		return nil, err
+	}
+	return users.newSession(user, device, userAgent, refresh), nil
+}
+
+// lookupUser returns the user with the given PIN, sql.ErrNoRows if none
+func (users *HdaUsers) lookupUser(pin string) (*HdaUser, error) {
 	user := new(HdaUser)
 	if users.IsDemo {
 		user.IsDemo = true
@@ -56,58 +125,164 @@ func (users *HdaUsers) queryUser(pin string) (*string, error) {
 			return nil, err
 		}
 	}
-	authToken := users.updateUserIfExists(user)
-	if authToken != "" {
-		return &authToken, nil
-	} else {
-		authToken = tokenGenerator()
-		user.LastCheckedAt = time.Now()
-		users.Lock()
-		users.Users[authToken] = user
-		users.Unlock()
+	return user, nil
+}
+
+// newSession starts a session for a user found by lookupUser
+func (users *HdaUsers) newSession(user *HdaUser, device, userAgent string, refresh bool) *sessionTokens {
+	// every login is a session of its own, as tokens are only kept hashed
+	tokens := &sessionTokens{AuthToken: tokenGenerator()}
+	user.session = hashToken(tokens.AuthToken)
+	user.accessHash = user.session
+	user.Device = device
+	user.UserAgent = userAgent
+	user.CreatedAt = time.Now()
+	user.LastRequestAt = user.CreatedAt
+	user.LastCheckedAt = user.CreatedAt
+	if refresh || !users.legacyTokens {
+		users.issueRefreshToken(user, tokens)
 	}
-	return &authToken, nil
+	users.Lock()
+	users.Users[user.accessHash] = user
+	store := users.store
+	users.Unlock()
+	if store != nil {
+		if err := store.saveSession(user); err != nil {
+			logging.Error("Error saving session: %s", err.Error())
+		}
+	}
+	return tokens
 }
 
-func (users *HdaUsers) updateUserIfExists(newUser *HdaUser) (authToken string) {
-	for authToken, user := range users.Users {
-		if user.id == newUser.id {
-			newUser.LastCheckedAt = time.Now()
-			users.Lock()
-			user = newUser
-			users.Unlock()
-			return authToken
+// issueRefreshToken gives the session a refresh token, and makes its access
+// token expire
+func (users *HdaUsers) issueRefreshToken(user *HdaUser, tokens *sessionTokens) {
+	tokens.RefreshToken = tokenGenerator()
+	tokens.ExpiresIn = int(users.accessTTL.Seconds())
+	user.accessExpiresAt = time.Now().Add(users.accessTTL)
+	user.refreshHash = hashToken(tokens.RefreshToken)
+}
+
+// refresh replaces the access and refresh tokens of the session of the given
+// refresh token. A refresh token works once: when one that was replaced comes
+// back, either the client or someone who stole it used it already, so the
+// session is ended and errRefreshTokenReused returned with its user
+func (users *HdaUsers) refresh(refreshToken string) (*sessionTokens, *HdaUser, error) {
+	if refreshToken == "" {
+		return nil, nil, errUnknownRefreshToken
+	}
+	hash := hashToken(refreshToken)
+	users.Lock()
+	defer users.Unlock()
+	var user *HdaUser
+	for _, u := range users.Users {
+		if u.refreshHash == hash || u.usedRefreshHash == hash {
+			user = u
+			break
 		}
 	}
-	return
+	if user == nil && users.store != nil {
+		user = users.store.sessionByRefresh(hash)
+	}
+	if user == nil {
+		return nil, nil, errUnknownRefreshToken
+	}
+	if user.usedRefreshHash == hash {
+		users.forget(user)
+		return nil, user, errRefreshTokenReused
+	}
+	if users.expired(user) {
+		users.forget(user)
+		return nil, nil, errUnknownRefreshToken
+	}
+	delete(users.Users, user.accessHash)
+	tokens := &sessionTokens{AuthToken: tokenGenerator()}
+	user.accessHash = hashToken(tokens.AuthToken)
+	user.usedRefreshHash = user.refreshHash
+	users.issueRefreshToken(user, tokens)
+	user.LastRequestAt = time.Now()
+	users.Users[user.accessHash] = user
+	if users.store != nil {
+		if err := users.store.saveSessionTokens(user); err != nil {
+			logging.Error("Error saving session: %s", err.Error())
+		}
+		users.store.touchSession(user.session, user.LastRequestAt)
+	}
+	return tokens, user, nil
+}
+
+// expired tells whether the session was idle or lasted for too long
+func (users *HdaUsers) expired(user *HdaUser) bool {
+	now := time.Now()
+	return now.Sub(user.LastRequestAt) > users.idleTimeout || now.Sub(user.CreatedAt) > users.maxAge
 }
 
 func (users *HdaUsers) find(authToken string) *HdaUser {
+	if authToken == "" {
+		return nil
+	}
+	key := hashToken(authToken)
 	users.Lock()
 	defer users.Unlock()
-	user := users.Users[authToken]
-	if !(user == nil || user.IsDemo) {
+	user := users.Users[key]
+	if user == nil && users.store != nil {
+		// from before a restart
+		if user = users.store.sessionByAccess(key); user != nil {
+			users.Users[key] = user
+		}
+	}
+	if user == nil {
+		return nil
+	}
+	if users.expired(user) || (!user.refreshable() && !users.legacyTokens) {
+		users.forget(user)
+		return nil
+	}
+	now := time.Now()
+	if user.refreshable() && now.After(user.accessExpiresAt) {
+		// the client gets a new one with its refresh token
+		return nil
+	}
+	if !user.IsDemo {
 		if time.Now().Sub(user.LastCheckedAt) > time.Minute*5 {
-			isValid, err := users.revalidateSession(authToken, user)
-			if isValid || (!isValid && err != nil) {
-				user.LastRequestAt = time.Now()
-			} else {
-				user = nil
+			isValid, err := users.revalidateSession(user)
+			if !isValid && err == nil {
+				return nil
 			}
 		}
 	}
+	if users.store != nil && now.Sub(user.LastRequestAt) > sessionTouchPeriod {
+		users.store.touchSession(user.session, now)
+	}
+	user.LastRequestAt = now
 	return user
 }
 
 func (users *HdaUsers) remove(authToken string) {
-	if authToken != "" {
-		users.Lock()
-		delete(users.Users, authToken)
-		users.Unlock()
+	if authToken == "" {
+		return
+	}
+	key := hashToken(authToken)
+	users.Lock()
+	defer users.Unlock()
+	user := users.Users[key]
+	if user == nil && users.store != nil {
+		user = users.store.sessionByAccess(key)
+	}
+	if user != nil {
+		users.forget(user)
+	}
+}
+
+// forget drops a session, with the users locked
+func (users *HdaUsers) forget(user *HdaUser) {
+	delete(users.Users, user.accessHash)
+	if users.store != nil {
+		users.store.deleteSession(user.session)
 	}
 }
 
-func (users *HdaUsers) revalidateSession(authToken string, user *HdaUser) (isValid bool, err error) {
+func (users *HdaUsers) revalidateSession(user *HdaUser) (isValid bool, err error) {
 	dbconn, err := sql.Open("mysql", MYSQL_CREDENTIALS)
 	if err != nil {
 		//log(err.Error())
@@ -121,8 +296,8 @@ func (users *HdaUsers) revalidateSession(authToken string, user *HdaUser) (isVal
 	if err != nil {
 		return
 	}
-	if updatedAt != user.UpdatedAt {
-		delete(users.Users, authToken)
+	if !updatedAt.Equal(user.UpdatedAt) {
+		users.forget(user)
 		return
 	}
 	user.LastCheckedAt = time.Now()
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// the files hidden in every share unless shares.hidden says otherwise, on top
+// of the ones whose name starts with "."
+var defaultHiddenFiles = []string{"Thumbs.db", "desktop.ini", "@eaDir", "lost+found"}
+
+// hiddenFiles are the glob patterns of the files hidden in a share, from
+// shares.hidden and shares.<name>.hidden, in the config file or the HDA
+// settings. A pattern with a "/" is for a path from the root of the share,
+// e.g. "/backups/*.tmp", others are for names anywhere in it, e.g. "*.part".
+// Hidden files are left out of listings and libraries, and cannot be reached
+type hiddenFiles struct {
+	names []string
+	paths []string
+}
+
+func hiddenIn(shareName string) *hiddenFiles {
+	patterns := config.List("shares.hidden", defaultHiddenFiles)
+	h := new(hiddenFiles)
+	for _, p := range append(patterns[:len(patterns):len(patterns)], config.List("shares."+shareName+".hidden", nil)...) {
+		if _, err := path.Match(p, ""); err != nil {
+			logging.Warning("Ignoring bad pattern of hidden files %q for share %s", p, shareName)
+			continue
+		}
+		if strings.Contains(p, "/") {
+			h.paths = append(h.paths, "/"+strings.TrimPrefix(p, "/"))
+		} else {
+			h.names = append(h.names, p)
+		}
+	}
+	return h
+}
+
+// entry tells whether the entry with the given name, in the directory at dir
+// in the share, is hidden. Names starting with "." always are
+func (h *hiddenFiles) entry(dir, name string) bool {
+	if name == "" || name[0] == '.' {
+		return true
+	}
+	for _, p := range h.names {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	if len(h.paths) == 0 {
+		return false
+	}
+	full := path.Join("/", dir, name)
+	for _, p := range h.paths {
+		if ok, _ := path.Match(p, full); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hides tells whether the file at relativePath in the share, or one of the
+// directories it is in, is hidden by a pattern. Names starting with "." are
+// left to the callers, as some of them are reachable
+func (h *hiddenFiles) hides(relativePath string) bool {
+	dir := "/"
+	for _, name := range strings.Split(path.Clean("/"+relativePath), "/") {
+		if name == "" {
+			continue
+		}
+		if name[0] != '.' && h.entry(dir, name) {
+			return true
+		}
+		dir = path.Join(dir, name)
+	}
+	return false
+}
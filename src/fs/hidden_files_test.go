@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHiddenFiles(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{values: map[string]string{
+		"shares.photos.hidden": "*.tmp, /backups/old*",
+	}}
+
+	photos := hiddenIn("photos")
+	for p, hidden := range map[string]bool{
+		"/a.jpg":                  false,
+		"/Thumbs.db":              true,
+		"/2019/@eaDir/a.jpg":      true,
+		"/2019/upload.tmp":        true,
+		"/backups/old-2018/a.jpg": true,
+		"/2019/backups/old/a.jpg": false,
+		"/lost+found":             true,
+		"/.hidden/but-reachable":  false,
+		"/backups/new/a.jpg":      false,
+		"/2019/not-a-tmp.tmp.jpg": false,
+	} {
+		if photos.hides(p) != hidden {
+			t.Errorf("%s hidden is not %v", p, hidden)
+		}
+	}
+	if hiddenIn("music").hides("/upload.tmp") {
+		t.Errorf("Pattern of a share used for another")
+	}
+	if !photos.entry("/", ".DS_Store") || photos.entry("/2019", "a.jpg") {
+		t.Errorf("Listing entries hidden wrong")
+	}
+
+	config = &Config{values: map[string]string{"shares.hidden": ""}}
+	if hiddenIn("photos").hides("/Thumbs.db") {
+		t.Errorf("Default patterns not replaced")
+	}
+}
+
+func TestHiddenFilesBlocked(t *testing.T) {
+	shareDir, cleanup := testShareWithLinks(t)
+	defer cleanup()
+	shares, _ := NewHdaShares(shareDir)
+	service := &MercuryFsService{Shares: shares}
+	restricted := service.restrictCache(func(w http.ResponseWriter, r *http.Request) {})
+	for uri, status := range map[string]int{
+		"/files?s=music&p=/album/song.mp3":            http.StatusOK,
+		"/files?s=music&p=/album/Thumbs.db":           http.StatusNotFound,
+		"/files?s=music&p=/@eaDir/x":                  http.StatusNotFound,
+		"/files?s=music&p=/album/a.mp3&to=/Thumbs.db": http.StatusNotFound,
+		"/files?s=music&p=/../secret":                 http.StatusForbidden,
+	} {
+		writer := httptest.NewRecorder()
+		restricted(writer, httptest.NewRequest("GET", uri, nil))
+		if writer.Code != status {
+			t.Errorf("%s answered %d, not %d", uri, writer.Code, status)
+		}
+	}
+
+	// nothing is told before access is checked
+	saved := adminAuth
+	adminAuth = &adminCredentials{anonymous: anonymousDeny}
+	defer func() { adminAuth = saved }()
+	service.Users = NewHdaUsers(false)
+	service.debugInfo = new(debugInfo)
+	files := use(func(w http.ResponseWriter, r *http.Request) {}, service.restrictCache, service.shareReadAccess)
+	for _, uri := range []string{"/files?s=music&p=/album/Thumbs.db", "/files?s=music&p=/../secret", "/files?s=music&p=/album/song.mp3"} {
+		writer := httptest.NewRecorder()
+		files(writer, httptest.NewRequest("GET", uri, nil))
+		if writer.Code != http.StatusUnauthorized {
+			t.Errorf("%s answered %d to an anonymous request", uri, writer.Code)
+		}
+	}
+}
+
+func TestHiddenFilesNotInPlaylists(t *testing.T) {
+	shareDir, cleanup := testShareWithLinks(t)
+	defer cleanup()
+	shares, _ := NewHdaShares(shareDir)
+	service := &MercuryFsService{Shares: shares, urlKey: newURLKey(), Users: NewHdaUsers(false),
+		debugInfo: new(debugInfo), info: new(HdaInfo)}
+	saved := adminAuth
+	adminAuth = &adminCredentials{anonymous: anonymousAdmin}
+	defer func() { adminAuth = saved }()
+
+	writer := httptest.NewRecorder()
+	service.servePlaylist(writer, httptest.NewRequest("GET", "/music/playlist", nil), "music", []*playlistEntry{
+		{Share: "music", Path: "/album/song.mp3"},
+		{Share: "music", Path: "/@eaDir/song.mp3"},
+	})
+	if body := writer.Body.String(); !strings.Contains(body, "song.mp3") || strings.Contains(body, "eaDir") {
+		t.Errorf("Playlist is %q", body)
+	}
+
+	writer = httptest.NewRecorder()
+	body := `{"files": [{"s": "music", "p": "/album/Thumbs.db"}]}`
+	service.filesPlaylist(writer, httptest.NewRequest("POST", "/playlist", strings.NewReader(body)))
+	if writer.Code != http.StatusNotFound {
+		t.Errorf("Playlist of a hidden file answered %d", writer.Code)
+	}
+}
+
+func TestHiddenFilesNotCached(t *testing.T) {
+	registry := newThumbnailRegistry()
+	registry.register(funcProvider{"image", thumbnailer}, []string{"image/"}, builtinPriority, time.Minute)
+	savedThumbnails := thumbnails
+	thumbnails = registry
+	defer func() { thumbnails = savedThumbnails }()
+	shareDir, cleanup := testShareWithLinks(t)
+	defer cleanup()
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	album := filepath.Join(shareDir, "music", "album")
+	os.MkdirAll(filepath.Join(album, "@eaDir"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(album, "@eaDir", "cover.png"), picture.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(album, "cover.png"), picture.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(album, "movie.mp4"), []byte("movie"), 0644)
+	ioutil.WriteFile(filepath.Join(album, "movie.srt"), []byte("1"), 0644)
+	ioutil.WriteFile(filepath.Join(album, "Thumbs.db"), []byte("x"), 0644)
+	shares, _ := NewHdaShares(shareDir)
+
+	q := newCacheQueue()
+	q.shares = shares
+	q.add(album, priorityScan)
+	for q.status().Queued > 0 {
+		q.finish(q.run(q.next()))
+	}
+	if !exists(thumbnailPathFor(filepath.Join(album, "cover.png"))) {
+		t.Errorf("No thumbnail made")
+	}
+	if exists(thumbnailPathFor(filepath.Join(album, "@eaDir", "cover.png"))) {
+		t.Errorf("Thumbnail made of a hidden file")
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{values: map[string]string{"shares.music.hidden": "*.srt"}}
+	fis, _ := ioutil.ReadDir(album)
+	if subtitles := sidecarSubtitles("movie.mp4", []string{"movie.srt"}, "music", "/album"); len(subtitles) != 1 {
+		t.Fatalf("Subtitle not found: %+v", subtitles)
+	}
+	for _, info := range directoryFileInfos(fis, album, "music", "/album") {
+		if len(info.subtitles) != 0 || info.name == "movie.srt" {
+			t.Errorf("Hidden subtitles listed: %+v", info)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default transcoder: H.264/AAC segments of about 6 seconds. {input} is the
+// video file and {dir} the directory where the playlist and segments go
+const defaultTranscoder = "ffmpeg -nostdin -loglevel error -i {input} -map 0:v:0 -map 0:a:0? " +
+	"-c:v libx264 -preset veryfast -c:a aac -ac 2 -f hls -hls_time 6 -hls_playlist_type event " +
+	"-hls_segment_filename {dir}/segment%05d.ts {dir}/index.m3u8"
+
+const hlsPlaylistName = "index.m3u8"
+
+var errTranscoderBusy = errors.New("too many transcoding sessions")
+
+// hlsSession is one transcoding of a video into an HLS playlist and segments
+type hlsSession struct {
+	id         string
+	dir        string
+	cmd        *exec.Cmd
+	running    bool
+	failed     bool
+	lastAccess time.Time
+	// closed when the transcoder exits
+	done chan struct{}
+}
+
+// HlsTranscoder runs the external transcoder and keeps the segments it makes
+// around, so the same video is not transcoded again while it is in the cache.
+// They go in hls.dir, next to the local store by default
+type HlsTranscoder struct {
+	command     []string
+	dir         string
+	maxSessions int
+	idleTimeout time.Duration
+	cacheTTL    time.Duration
+	sessions    map[string]*hlsSession
+	sync.Mutex
+}
+
+func NewHlsTranscoder() *HlsTranscoder {
+	return &HlsTranscoder{
+		command:     strings.Fields(config.String("hls.transcoder", defaultTranscoder)),
+		dir:         config.String("hls.dir", filepath.Join(filepath.Dir(LOCAL_DB_FILE), "hls")),
+		maxSessions: config.Int("hls.max_sessions", 2),
+		idleTimeout: config.Duration("hls.idle_timeout", 5*time.Minute),
+		cacheTTL:    config.Duration("hls.cache_ttl", 24*time.Hour),
+		sessions:    make(map[string]*hlsSession),
+	}
+}
+
+// available tells whether the transcoder command is installed
+func (t *HlsTranscoder) available() bool {
+	if len(t.command) == 0 {
+		return false
+	}
+	_, err := exec.LookPath(t.command[0])
+	return err == nil
+}
+
+func (s *hlsSession) playlistPath() string {
+	return filepath.Join(s.dir, hlsPlaylistName)
+}
+
+// complete tells whether a previous transcoding left a full playlist behind
+func (s *hlsSession) complete() bool {
+	f, err := os.Open(s.playlistPath())
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "#EXT-X-ENDLIST" {
+			return true
+		}
+	}
+	return false
+}
+
+// a changed file gets a different id, and is transcoded again
+func hlsSessionId(fullPath string, fi os.FileInfo) string {
+	return sha1string(fullPath + fi.ModTime().UTC().Format(time.RFC3339Nano))
+}
+
+// lookup returns the running or finished session of a video, if any
+func (t *HlsTranscoder) lookup(fullPath string, fi os.FileInfo) *hlsSession {
+	id := hlsSessionId(fullPath, fi)
+	t.Lock()
+	defer t.Unlock()
+	s := t.sessions[id]
+	if s == nil {
+		return nil
+	}
+	s.lastAccess = time.Now()
+	return s
+}
+
+// session returns the session for a video, starting the transcoder if the
+// segments are not in the cache already
+func (t *HlsTranscoder) session(fullPath string, fi os.FileInfo) (*hlsSession, error) {
+	id := hlsSessionId(fullPath, fi)
+
+	t.Lock()
+	defer t.Unlock()
+	s := t.sessions[id]
+	if s != nil && !s.failed {
+		s.lastAccess = time.Now()
+		return s, nil
+	}
+	s = &hlsSession{id: id, dir: filepath.Join(t.dir, id), lastAccess: time.Now(), done: make(chan struct{})}
+	if s.complete() {
+		close(s.done)
+		t.sessions[id] = s
+		return s, nil
+	}
+
+	running := 0
+	for _, other := range t.sessions {
+		if other.running {
+			running++
+		}
+	}
+	if running >= t.maxSessions {
+		return nil, errTranscoderBusy
+	}
+
+	os.RemoveAll(s.dir)
+	// the segments are only for the service to serve
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	args := make([]string, len(t.command))
+	for i, arg := range t.command {
+		args[i] = strings.NewReplacer("{input}", fullPath, "{dir}", s.dir).Replace(arg)
+	}
+	s.cmd = exec.Command(args[0], args[1:]...)
+	if err := s.cmd.Start(); err != nil {
+		os.RemoveAll(s.dir)
+		return nil, err
+	}
+	logging.Info("Started transcoding %s into %s", fullPath, s.dir)
+	s.running = true
+	t.sessions[id] = s
+
+	go func() {
+		err := s.cmd.Wait()
+		t.Lock()
+		s.running = false
+		if err != nil {
+			debug(2, "Transcoder for %s exited: %s", fullPath, err)
+			s.failed = true
+		}
+		t.Unlock()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// waitForPlaylist waits until the transcoder wrote the first segment
+func (s *hlsSession) waitForPlaylist(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		if fi, err := os.Stat(s.playlistPath()); err == nil && fi.Size() > 0 {
+			return true
+		}
+		select {
+		case <-s.done:
+			return exists(s.playlistPath())
+		case <-deadline:
+			return false
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// cleanup stops transcoders nobody has asked about in a while and removes
+// the segments of sessions past the cache TTL
+func (t *HlsTranscoder) cleanup() {
+	t.Lock()
+	defer t.Unlock()
+	for id, s := range t.sessions {
+		idle := time.Since(s.lastAccess)
+		if s.running && idle > t.idleTimeout {
+			logging.Info("Stopping idle transcoding in %s", s.dir)
+			s.cmd.Process.Kill()
+			// an interrupted session can't be reused
+			s.failed = true
+		}
+		if !s.running && (s.failed || idle > t.cacheTTL) {
+			os.RemoveAll(s.dir)
+			delete(t.sessions, id)
+		}
+	}
+
+	// leftovers from before a restart
+	fis, _ := ioutil.ReadDir(t.dir)
+	for _, fi := range fis {
+		if _, ok := t.sessions[fi.Name()]; !ok && time.Since(fi.ModTime()) > t.cacheTTL {
+			os.RemoveAll(filepath.Join(t.dir, fi.Name()))
+		}
+	}
+}
+
+func (t *HlsTranscoder) cleanupLoop() {
+	for {
+		time.Sleep(time.Minute)
+		t.cleanup()
+	}
+}
+
+// directPlay redirects to the file itself, for when we cannot transcode
+func (service *MercuryFsService) directPlay(writer http.ResponseWriter, request *http.Request) {
+	target := "/files?" + request.URL.RawQuery
+	http.Redirect(writer, request, target, http.StatusTemporaryRedirect)
+	service.accessLog(logging, request, http.StatusTemporaryRedirect, 0)
+}
+
+// serveHls serves the HLS playlist of a video, starting a transcoder for it if
+// needed. The segment links in it are signed, as players do not send credentials
+func (service *MercuryFsService) serveHls(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	fullPath, err := service.fullPathToFile(share, path)
+	if err != nil {
+		debug(2, "File not found: %s", err)
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	fi, err := os.Stat(fullPath)
+	if err != nil || fi.IsDir() || !isPlayable(fullPath) {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+
+	transcoder := service.Transcoder
+	if transcoder == nil || !transcoder.available() {
+		debug(3, "No transcoder available, direct play of %s", fullPath)
+		service.directPlay(writer, request)
+		return
+	}
+	session, err := transcoder.session(fullPath, fi)
+	if err != nil {
+		logging.Warning("Could not transcode %s, falling back to direct play: %s", fullPath, err.Error())
+		service.directPlay(writer, request)
+		return
+	}
+	if !session.waitForPlaylist(30 * time.Second) {
+		logging.Warning("Transcoder did not produce a playlist for %s, falling back to direct play", fullPath)
+		service.directPlay(writer, request)
+		return
+	}
+
+	f, err := os.Open(session.playlistPath())
+	if err != nil {
+		service.directPlay(writer, request)
+		return
+	}
+	defer f.Close()
+	base, grant := baseURL(request), service.linkGrant(request)
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && line[0] != '#' {
+			// a segment, point it to our endpoint
+			line = base + service.signedEndpointFor("/hls/segment", share, path, grant) + "&f=" + url.QueryEscape(filepath.Base(line))
+		}
+		lines = append(lines, line)
+	}
+	playlist := strings.Join(lines, "\n") + "\n"
+	size := int64(len(playlist))
+	writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writer.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	writer.Header().Set("Cache-Control", "no-cache, private")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte(playlist))
+	service.debugInfo.requestServed(size)
+	service.accessLog(logging, request, http.StatusOK, int(size))
+}
+
+// serveHlsSegment serves one segment of a transcoding session
+func (service *MercuryFsService) serveHlsSegment(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+	segment := filepath.Base(q.Query().Get("f"))
+
+	fullPath, err := service.fullPathToFile(share, path)
+	fi, serr := os.Stat(fullPath)
+	if err != nil || serr != nil || service.Transcoder == nil || segment == hlsPlaylistName {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	session := service.Transcoder.lookup(fullPath, fi)
+	if session == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	segmentPath := filepath.Join(session.dir, segment)
+	osFile, err := os.Open(segmentPath)
+	if err != nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	defer osFile.Close()
+	sfi, _ := osFile.Stat()
+	writer.Header().Set("Content-Type", "video/mp2t")
+	http.ServeContent(writer, request, segmentPath, sfi.ModTime(), osFile)
+	service.debugInfo.requestServed(sfi.Size())
+	service.accessLog(logging, request, http.StatusOK, int(sfi.Size()))
+}
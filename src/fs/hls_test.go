@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a transcoder that writes a whole playlist of one segment at once
+const testTranscoderScript = `#!/bin/sh
+printf 'segment' > "$2/segment00000.ts"
+printf '#EXTM3U\n#EXTINF:6.0,\nsegment00000.ts\n#EXT-X-ENDLIST\n' > "$2/index.m3u8"
+`
+
+// testTranscoder returns a transcoder running the given script, with its
+// segments in a directory of its own
+func testTranscoder(t *testing.T, script string) (*HlsTranscoder, func()) {
+	dir, err := ioutil.TempDir("", "amahi-hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := filepath.Join(dir, "transcoder")
+	ioutil.WriteFile(command, []byte(script), 0755)
+	transcoder := &HlsTranscoder{
+		command:     []string{command, "{input}", "{dir}"},
+		dir:         filepath.Join(dir, "hls"),
+		maxSessions: 1,
+		idleTimeout: time.Minute,
+		cacheTTL:    time.Hour,
+		sessions:    make(map[string]*hlsSession),
+	}
+	return transcoder, func() { os.RemoveAll(dir) }
+}
+
+func testHlsService(t *testing.T, transcoder *HlsTranscoder) (*MercuryFsService, func()) {
+	shareDir, cleanup := testShareWithLinks(t)
+	shares, _ := NewHdaShares(shareDir)
+	service := &MercuryFsService{Shares: shares, Transcoder: transcoder, urlKey: newURLKey(),
+		Users: NewHdaUsers(false), debugInfo: new(debugInfo), info: new(HdaInfo)}
+	return service, cleanup
+}
+
+func TestHls(t *testing.T) {
+	transcoder, cleanup := testTranscoder(t, testTranscoderScript)
+	defer cleanup()
+	service, cleanupShare := testHlsService(t, transcoder)
+	defer cleanupShare()
+
+	writer := httptest.NewRecorder()
+	service.serveHls(writer, httptest.NewRequest("GET", "/hls?s=music&p=/album/song.mp3", nil))
+	if writer.Code != http.StatusOK || !strings.Contains(writer.Body.String(), "/hls/segment?") ||
+		!strings.Contains(writer.Body.String(), "f=segment00000.ts") {
+		t.Fatalf("Playlist answered %d: %s", writer.Code, writer.Body.String())
+	}
+
+	// only the segments of the session are served
+	for f, status := range map[string]int{
+		"segment00000.ts":       http.StatusOK,
+		"index.m3u8":            http.StatusNotFound,
+		"../../../secret":       http.StatusNotFound,
+		"..%2F..%2F..%2Fsecret": http.StatusNotFound,
+		"%2Fetc%2Fpasswd":       http.StatusNotFound,
+		"segment99999.ts":       http.StatusNotFound,
+	} {
+		writer = httptest.NewRecorder()
+		service.serveHlsSegment(writer, httptest.NewRequest("GET", "/hls/segment?s=music&p=/album/song.mp3&f="+f, nil))
+		if writer.Code != status {
+			t.Errorf("Segment %s answered %d, not %d", f, writer.Code, status)
+		}
+	}
+
+	// a complete playlist is used again after a restart, without transcoding
+	restarted := &HlsTranscoder{
+		command:     []string{"false"},
+		dir:         transcoder.dir,
+		maxSessions: 1,
+		idleTimeout: time.Minute,
+		cacheTTL:    time.Hour,
+		sessions:    make(map[string]*hlsSession),
+	}
+	fullPath, _ := service.fullPathToFile("music", "/album/song.mp3")
+	fi, _ := os.Stat(fullPath)
+	session, err := restarted.session(fullPath, fi)
+	if err != nil || session.cmd != nil || !session.complete() {
+		t.Errorf("Cached playlist not used: %+v %v", session, err)
+	}
+}
+
+func TestHlsBusy(t *testing.T) {
+	transcoder, cleanup := testTranscoder(t, "#!/bin/sh\nexec sleep 60\n")
+	defer cleanup()
+	service, cleanupShare := testHlsService(t, transcoder)
+	defer cleanupShare()
+	root := service.Shares.Get("music").GetPath()
+	ioutil.WriteFile(filepath.Join(root, "album", "other.mp3"), []byte("other"), 0644)
+
+	fullPath := filepath.Join(root, "album", "song.mp3")
+	fi, _ := os.Stat(fullPath)
+	session, err := transcoder.session(fullPath, fi)
+	if err != nil || !session.running {
+		t.Fatalf("Transcoder not started: %v", err)
+	}
+	defer session.cmd.Process.Kill()
+
+	// one session at most, the others play the file
+	writer := httptest.NewRecorder()
+	service.serveHls(writer, httptest.NewRequest("GET", "/hls?s=music&p=/album/other.mp3", nil))
+	if writer.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(writer.Header().Get("Location"), "/files?") {
+		t.Errorf("Busy transcoder answered %d, to %s", writer.Code, writer.Header().Get("Location"))
+	}
+	other := filepath.Join(root, "album", "other.mp3")
+	otherFi, _ := os.Stat(other)
+	if _, err := transcoder.session(other, otherFi); err != errTranscoderBusy {
+		t.Errorf("Second session gave %v", err)
+	}
+}
+
+func TestHlsCleanup(t *testing.T) {
+	transcoder, cleanup := testTranscoder(t, "#!/bin/sh\nexec sleep 60\n")
+	defer cleanup()
+	root, cleanupShare := testShareWithLinks(t)
+	defer cleanupShare()
+	fullPath := filepath.Join(root, "music", "album", "song.mp3")
+	fi, _ := os.Stat(fullPath)
+
+	// a transcoder nobody asks about is stopped, then its segments go
+	session, err := transcoder.session(fullPath, fi)
+	if err != nil {
+		t.Fatalf("Transcoder not started: %v", err)
+	}
+	transcoder.Lock()
+	session.lastAccess = time.Now().Add(-2 * time.Minute)
+	transcoder.Unlock()
+	transcoder.cleanup()
+	select {
+	case <-session.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Idle transcoder not stopped")
+	}
+	transcoder.cleanup()
+	if transcoder.lookup(fullPath, fi) != nil || exists(session.dir) {
+		t.Errorf("Stopped session kept")
+	}
+
+	// finished sessions go after the cache TTL, and leftovers of before a restart too
+	expired := &hlsSession{id: "expired", dir: filepath.Join(transcoder.dir, "expired"),
+		lastAccess: time.Now().Add(-2 * time.Hour), done: make(chan struct{})}
+	os.MkdirAll(expired.dir, 0700)
+	transcoder.sessions[expired.id] = expired
+	leftover := filepath.Join(transcoder.dir, "leftover")
+	os.MkdirAll(leftover, 0700)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(leftover, old, old)
+	recent := filepath.Join(transcoder.dir, "recent")
+	os.MkdirAll(recent, 0700)
+	transcoder.cleanup()
+	if exists(expired.dir) || exists(leftover) || len(transcoder.sessions) != 0 {
+		t.Errorf("Expired segments kept")
+	}
+	if !exists(recent) {
+		t.Errorf("Recent segments removed")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"path/filepath"
+)
+
+const settingsSchema = `CREATE TABLE IF NOT EXISTS settings (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL)`
+
+// LocalStore is the sqlite database where the service keeps its own state.
+// The HDA database is only read from, everything we write goes in here
+type LocalStore struct {
+	db *sql.DB
+}
+
+// NewLocalStore opens the store at path, creating it if needed. It holds
+// secrets (signing keys, TOTP secrets, session hashes), so only the service
+// can read it
+func NewLocalStore(path string) (*LocalStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	// several goroutines write to the store, wait for each other instead of failing
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	store := &LocalStore{db: db}
+	schema := []string{settingsSchema}
+	schema = append(schema, playbackSchema...)
+	schema = append(schema, userListsSchema...)
+	schema = append(schema, tagsSchema...)
+	schema = append(schema, sessionsSchema...)
+	schema = append(schema, apiTokensSchema...)
+	schema = append(schema, totpSchema...)
+	if err = store.createTables(schema...); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// including the files of a store made before, and the ones sqlite made
+	for _, name := range []string{path, path + "-wal", path + "-shm"} {
+		if err = os.Chmod(name, 0600); err != nil && !os.IsNotExist(err) {
+			db.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// getSetting returns the value of a setting of the service, or "" if not set
+func (store *LocalStore) getSetting(name string) string {
+	var value string
+	store.db.QueryRow("SELECT value FROM settings WHERE name = ?", name).Scan(&value)
+	return value
+}
+
+func (store *LocalStore) setSetting(name, value string) error {
+	_, err := store.db.Exec("INSERT OR REPLACE INTO settings (name, value) VALUES (?, ?)", name, value)
+	return err
+}
+
+// secret returns a random key kept under the given name, creating it the
+// first time, so that whatever it signs stays valid across restarts
+func (store *LocalStore) secret(name string) []byte {
+	if value, err := hex.DecodeString(store.getSetting(name)); err == nil && len(value) > 0 {
+		return value
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	err := store.setSetting(name, hex.EncodeToString(key))
+	if err != nil {
+		logging.Error("Error saving %s: %s", name, err.Error())
+	}
+	return key
+}
+
+// createTables runs the given CREATE TABLE/INDEX IF NOT EXISTS statements
+func (store *LocalStore) createTables(schema ...string) error {
+	for _, q := range schema {
+		if _, err := store.db.Exec(q); err != nil {
+			logging.Error("Error creating local tables: %s", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// the tables with rows about a file, keyed by its share and path
+var pathTables = []string{"playback_positions", "favorites", "recent_files", "file_tags"}
+
+// movePath makes everything kept about a file or directory (and the files in
+// it) follow it to its new path in the share
+func (store *LocalStore) movePath(share, from, to string) error {
+	from, to = storePath(from), storePath(to)
+	for _, table := range pathTables {
+		// rows already at the destination are replaced. substr counts
+		// characters, not bytes, so the lengths are left to sqlite
+		q := "UPDATE OR REPLACE " + table + " SET path = ? || substr(path, length(?) + 1) " +
+			"WHERE share = ? AND (path = ? OR substr(path, 1, length(?)) = ?)"
+		_, err := store.db.Exec(q, to, from, share, from, from+"/", from+"/")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetPath removes everything kept about a file or directory that is gone
+func (store *LocalStore) forgetPath(share, path string) error {
+	path = storePath(path)
+	for _, table := range pathTables {
+		q := "DELETE FROM " + table + " WHERE share = ? AND (path = ? OR substr(path, 1, length(?)) = ?)"
+		_, err := store.db.Exec(q, share, path, path+"/", path+"/")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *LocalStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStorePermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "test.db")
+
+	// made before by an older version, readable by everyone
+	os.MkdirAll(filepath.Dir(path), 0755)
+	ioutil.WriteFile(path, nil, 0644)
+	store, err := NewLocalStore(path)
+	if err != nil {
+		t.Fatalf("NewLocalStore failed: %s", err.Error())
+	}
+	defer store.Close()
+	store.secret("url-signing-key")
+
+	for _, name := range []string{path, path + "-wal", path + "-shm"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s is %v", filepath.Base(name), fi.Mode().Perm())
+		}
+	}
+
+	// a new one
+	path = filepath.Join(dir, "new", "test.db")
+	other, err := NewLocalStore(path)
+	if err != nil {
+		t.Fatalf("NewLocalStore failed: %s", err.Error())
+	}
+	defer other.Close()
+	if fi, _ := os.Stat(filepath.Dir(path)); fi.Mode().Perm() != 0700 {
+		t.Errorf("Directory is %v", fi.Mode().Perm())
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("Database is %v", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var musicSchema = []string{
+	`CREATE TABLE IF NOT EXISTS music_tracks (
+		share TEXT NOT NULL,
+		path TEXT NOT NULL,
+		mtime INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		artist TEXT NOT NULL,
+		album_artist TEXT NOT NULL,
+		album TEXT NOT NULL,
+		genre TEXT NOT NULL,
+		year INTEGER NOT NULL,
+		track INTEGER NOT NULL,
+		disc INTEGER NOT NULL,
+		duration INTEGER NOT NULL,
+		PRIMARY KEY (share, path))`,
+	`CREATE INDEX IF NOT EXISTS music_tracks_artist ON music_tracks (artist)`,
+	`CREATE INDEX IF NOT EXISTS music_tracks_album ON music_tracks (album_artist, album)`,
+}
+
+// MusicLibrary indexes the tags of the audio files in the shares tagged as music
+type MusicLibrary struct {
+	store  *LocalStore
+	shares *HdaShares
+}
+
+type musicArtist struct {
+	Name   string `json:"name"`
+	Albums int    `json:"albums"`
+	Tracks int    `json:"tracks"`
+}
+
+type musicAlbum struct {
+	Title    string  `json:"title"`
+	Artist   string  `json:"artist"`
+	Year     int     `json:"year"`
+	Tracks   int     `json:"tracks"`
+	Duration float64 `json:"duration"`
+	Art      string  `json:"art,omitempty"`
+}
+
+type musicGenre struct {
+	Name   string `json:"name"`
+	Tracks int    `json:"tracks"`
+}
+
+type musicTrack struct {
+	Share       string  `json:"share"`
+	Path        string  `json:"path"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist"`
+	AlbumArtist string  `json:"album_artist"`
+	Album       string  `json:"album"`
+	Genre       string  `json:"genre"`
+	Year        int     `json:"year"`
+	Track       int     `json:"track"`
+	Disc        int     `json:"disc"`
+	Duration    float64 `json:"duration"`
+	File        string  `json:"file"`
+	Art         string  `json:"art,omitempty"`
+}
+
+func NewMusicLibrary(store *LocalStore, shares *HdaShares) (*MusicLibrary, error) {
+	err := store.createTables(musicSchema...)
+	if err != nil {
+		return nil, err
+	}
+	return &MusicLibrary{store: store, shares: shares}, nil
+}
+
+func isMusicShare(share *HdaShare) bool {
+	return strings.Contains(strings.ToLower(share.tags), "music")
+}
+
+func isAudioFile(path string) bool {
+	return strings.HasPrefix(getContentType(path), "audio")
+}
+
+// scanShare brings the library up to date with the contents of the share,
+// only reading the tags of files that changed since the last scan
+func (library *MusicLibrary) scanShare(share *HdaShare) {
+	logging.Info("Scanning music in share %s", share.name)
+	known := make(map[string][2]int64)
+	rows, err := library.store.db.Query("SELECT path, mtime, size FROM music_tracks WHERE share = ?", share.name)
+	if err != nil {
+		logging.Error("Error reading music library: %s", err.Error())
+		return
+	}
+	for rows.Next() {
+		var path string
+		var mtime, size int64
+		rows.Scan(&path, &mtime, &size)
+		known[path] = [2]int64{mtime, size}
+	}
+	rows.Close()
+
+	root := filepath.Clean(share.path)
+	hidden := hiddenIn(share.name)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && hidden.entry(strings.TrimPrefix(filepath.Dir(path), root), info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !isAudioFile(path) {
+			return nil
+		}
+		relativePath := strings.TrimPrefix(path, root)
+		if old, ok := known[relativePath]; !ok || old[0] != info.ModTime().Unix() || old[1] != info.Size() {
+			library.index(share.name, relativePath, path, info)
+		}
+		delete(known, relativePath)
+		return nil
+	})
+
+	// whatever was not found anymore is gone
+	for relativePath := range known {
+		library.store.db.Exec("DELETE FROM music_tracks WHERE share = ? AND path = ?", share.name, relativePath)
+	}
+	logging.Info("Done scanning music in share %s", share.name)
+}
+
+// index reads the tags of one file into the library
+func (library *MusicLibrary) index(share, relativePath, fullPath string, info os.FileInfo) {
+	tags, err := readAudioTags(fullPath)
+	if err != nil {
+		debug(3, "Error reading tags of %s: %s", fullPath, err)
+		tags = new(audioTags)
+	}
+	if tags.title == "" {
+		name := filepath.Base(fullPath)
+		tags.title = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	albumArtist := tags.albumArtist
+	if albumArtist == "" {
+		albumArtist = tags.artist
+	}
+	q := "INSERT OR REPLACE INTO music_tracks " +
+		"(share, path, mtime, size, title, artist, album_artist, album, genre, year, track, disc, duration) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err = library.store.db.Exec(q, share, relativePath, info.ModTime().Unix(), info.Size(),
+		tags.title, tags.artist, albumArtist, tags.album, tags.genre, tags.year, tags.track, tags.disc,
+		int64(tags.duration.Seconds()))
+	if err != nil {
+		logging.Error("Error indexing %s: %s", fullPath, err.Error())
+	}
+}
+
+// update indexes a file or directory that was created or written to
+func (library *MusicLibrary) update(fullPath string) {
+	if library == nil {
+		return
+	}
+	share, relativePath := library.shares.ForPath(fullPath)
+	if share == nil || !isMusicShare(share) || strings.Contains(fullPath, ".fscache") {
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		if isAudioFile(fullPath) {
+			library.index(share.name, relativePath, fullPath, info)
+		}
+		return
+	}
+	hidden := hiddenIn(share.name)
+	filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && isAudioFile(path) && !strings.Contains(path, "/.") &&
+			!hidden.hides(relativePath+strings.TrimPrefix(path, fullPath)) {
+			library.index(share.name, relativePath+strings.TrimPrefix(path, fullPath), path, info)
+		}
+		return nil
+	})
+}
+
+// remove drops a file, or everything under a directory, from the library
+func (library *MusicLibrary) remove(fullPath string) {
+	if library == nil {
+		return
+	}
+	share, relativePath := library.shares.ForPath(fullPath)
+	if share == nil || !isMusicShare(share) {
+		return
+	}
+	prefix := strings.TrimSuffix(relativePath, "/") + "/"
+	q := "DELETE FROM music_tracks WHERE share = ? AND (path = ? OR substr(path, 1, length(?)) = ?)"
+	_, err := library.store.db.Exec(q, share.name, relativePath, prefix, prefix)
+	if err != nil {
+		logging.Error("Error removing %s from the music library: %s", fullPath, err.Error())
+	}
+}
+
+// musicFilter builds the WHERE clause for the share restrictions and the
+// artist, album and genre parameters of a request
+func musicFilter(shares []string, request *http.Request) (string, []interface{}) {
+	clauses := []string{"1"}
+	args := make([]interface{}, 0)
+	if shares != nil {
+		placeholders := make([]string, 0)
+		for _, name := range shares {
+			placeholders = append(placeholders, "?")
+			args = append(args, name)
+		}
+		if len(placeholders) == 0 {
+			clauses = append(clauses, "0")
+		} else {
+			clauses = append(clauses, "share IN ("+strings.Join(placeholders, ", ")+")")
+		}
+	}
+	q := request.URL.Query()
+	if artist, ok := q["artist"]; ok {
+		clauses = append(clauses, "(artist = ? OR album_artist = ?)")
+		args = append(args, artist[0], artist[0])
+	}
+	if album, ok := q["album"]; ok {
+		clauses = append(clauses, "album = ?")
+		args = append(args, album[0])
+	}
+	if genre, ok := q["genre"]; ok {
+		clauses = append(clauses, "genre = ?")
+		args = append(args, genre[0])
+	}
+	return " WHERE " + strings.Join(clauses, " AND "), args
+}
+
+// albumArt returns the link to the cached album art of a track, if there is one
+func (service *MercuryFsService) albumArt(share, path string) string {
+	fullPath, err := service.fullPathToFile(share, path)
+	if err != nil || !exists(thumbnailPathFor(fullPath)) {
+		return ""
+	}
+	return endpointFor("/cache", share, path)
+}
+
+func (library *MusicLibrary) tracks(where string, args []interface{}) ([]*musicTrack, error) {
+	q := "SELECT share, path, title, artist, album_artist, album, genre, year, track, disc, duration " +
+		"FROM music_tracks" + where + " ORDER BY album_artist, album, disc, track, title"
+	rows, err := library.store.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tracks := make([]*musicTrack, 0)
+	for rows.Next() {
+		t := new(musicTrack)
+		var duration int64
+		err = rows.Scan(&t.Share, &t.Path, &t.Title, &t.Artist, &t.AlbumArtist, &t.Album, &t.Genre,
+			&t.Year, &t.Track, &t.Disc, &duration)
+		if err != nil {
+			return nil, err
+		}
+		t.Duration = float64(duration)
+		t.File = endpointFor("/files", t.Share, t.Path)
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+func (service *MercuryFsService) musicArtists(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	where, args := musicFilter(shares, request)
+	q := "SELECT artist, COUNT(DISTINCT album), COUNT(*) FROM music_tracks" + where +
+		" GROUP BY artist ORDER BY artist COLLATE NOCASE"
+	service.serveMusicQuery(writer, request, q, args, func(rows *sql.Rows) (interface{}, error) {
+		a := new(musicArtist)
+		return a, rows.Scan(&a.Name, &a.Albums, &a.Tracks)
+	})
+}
+
+func (service *MercuryFsService) musicGenres(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	where, args := musicFilter(shares, request)
+	q := "SELECT genre, COUNT(*) FROM music_tracks" + where + " GROUP BY genre ORDER BY genre COLLATE NOCASE"
+	service.serveMusicQuery(writer, request, q, args, func(rows *sql.Rows) (interface{}, error) {
+		g := new(musicGenre)
+		return g, rows.Scan(&g.Name, &g.Tracks)
+	})
+}
+
+func (service *MercuryFsService) musicAlbums(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	where, args := musicFilter(shares, request)
+	// the first track of the album is the one used for the album art. Share
+	// names have no slashes and paths start with one, so share+path splits back
+	q := "SELECT album, album_artist, MAX(year), COUNT(*), SUM(duration), MIN(share || path) FROM music_tracks" +
+		where + " GROUP BY album_artist, album ORDER BY album_artist COLLATE NOCASE, album COLLATE NOCASE"
+	service.serveMusicQuery(writer, request, q, args, func(rows *sql.Rows) (interface{}, error) {
+		a := new(musicAlbum)
+		var duration int64
+		var first string
+		err := rows.Scan(&a.Title, &a.Artist, &a.Year, &a.Tracks, &duration, &first)
+		a.Duration = float64(duration)
+		if i := strings.IndexByte(first, '/'); i >= 0 {
+			a.Art = service.albumArt(first[:i], first[i:])
+		}
+		return a, err
+	})
+}
+
+func (service *MercuryFsService) musicTracks(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	if service.Music == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	where, args := musicFilter(shares, request)
+	tracks, err := service.Music.tracks(where, args)
+	if err != nil {
+		logging.Error("Error querying music library: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	for _, t := range tracks {
+		t.Art = service.albumArt(t.Share, t.Path)
+	}
+	result, _ := json.Marshal(tracks)
+	service.serveJSON(writer, request, string(result))
+}
+
+// serveMusicQuery runs an aggregate query over the library and serves the
+// rows, as converted by scan, in a json array
+func (service *MercuryFsService) serveMusicQuery(writer http.ResponseWriter, request *http.Request, q string,
+	args []interface{}, scan func(*sql.Rows) (interface{}, error)) {
+	if service.Music == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	rows, err := service.Music.store.db.Query(q, args...)
+	if err == nil {
+		defer rows.Close()
+	}
+	items := make([]interface{}, 0)
+	for err == nil && rows.Next() {
+		var item interface{}
+		item, err = scan(rows)
+		items = append(items, item)
+	}
+	if err != nil {
+		logging.Error("Error querying music library: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	result, _ := json.Marshal(items)
+	service.serveJSON(writer, request, string(result))
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMusicLibrary(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	album := filepath.Join(dir, "Music", "Sigur Rós", "Ágætis byrjun")
+	os.MkdirAll(album, 0755)
+	os.MkdirAll(filepath.Join(dir, "Music", ".trash"), 0755)
+	ioutil.WriteFile(filepath.Join(album, "01 Intro.mp3"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(album, "cover.jpg"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Music", "single.mp3"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Music", ".trash", "old.mp3"), []byte("data"), 0644)
+	shares, _ := NewHdaShares(dir)
+	library, err := NewMusicLibrary(store, shares)
+	if err != nil {
+		t.Fatalf("NewMusicLibrary failed: %s", err.Error())
+	}
+	library.scanShare(shares.Get("Music"))
+
+	tracks, err := library.tracks("", nil)
+	if err != nil || len(tracks) != 2 {
+		t.Fatalf("Tracks indexed: %+v, %v", tracks, err)
+	}
+	for _, track := range tracks {
+		if track.Path == "/single.mp3" && track.Title != "single" {
+			t.Errorf("Track without tags titled %q", track.Title)
+		}
+	}
+
+	// gone while the service was not running
+	os.Remove(filepath.Join(dir, "Music", "single.mp3"))
+	library.scanShare(shares.Get("Music"))
+	if tracks, _ = library.tracks("", nil); len(tracks) != 1 {
+		t.Errorf("Tracks after a scan: %+v", tracks)
+	}
+
+	// substr counts characters, not bytes
+	library.remove(filepath.Join(dir, "Music", "Sigur Rós"))
+	if tracks, _ = library.tracks("", nil); len(tracks) != 0 {
+		t.Errorf("Tracks after removing a folder: %+v", tracks)
+	}
+	library.update(filepath.Join(dir, "Music", "Sigur Rós"))
+	if tracks, _ = library.tracks("", nil); len(tracks) != 1 || tracks[0].Path != "/Sigur Rós/Ágætis byrjun/01 Intro.mp3" {
+		t.Errorf("Tracks after an update: %+v", tracks)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+// setThreadNiceness does nothing where the niceness is the whole process'
+func setThreadNiceness(nice int) error {
+	return nil
+}
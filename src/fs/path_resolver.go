@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// what is done with the symlinks in a share, set by shares.symlinks or by
+// shares.<name>.symlinks for a share
+const (
+	// they are followed wherever they point, as they used to be
+	symlinksFollow = "follow"
+	// they are followed while they point inside the share
+	symlinksWithinShare = "follow-within-share"
+	// paths through them are refused
+	symlinksDeny = "deny"
+)
+
+var (
+	errOutsideShare  = errors.New("path is outside of the share")
+	errSymlinkDenied = errors.New("path goes through a symlink")
+)
+
+// symlinkPolicy returns the symlink policy of a share
+func symlinkPolicy(shareName string) string {
+	policy := config.String("shares."+shareName+".symlinks", config.String("shares.symlinks", symlinksFollow))
+	switch policy {
+	case symlinksFollow, symlinksWithinShare, symlinksDeny:
+		return policy
+	}
+	logging.Warning("Unknown symlink policy %s for share %s, denying symlinks", policy, shareName)
+	return symlinksDeny
+}
+
+// within tells whether path is root or inside it
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../") && !filepath.IsAbs(rel)
+}
+
+// resolveInShare returns the full path of a path relative to the root of a
+// share. Paths with ".." or NUL in them are refused rather than cleaned up, as
+// no client sends them. The symlinks on the way are checked with the policy,
+// up to the first part of the path that does not exist yet, e.g. an upload.
+// The path is returned as asked for, not with the symlinks resolved
+func resolveInShare(root, relativePath, policy string) (string, error) {
+	if strings.IndexByte(relativePath, 0) >= 0 {
+		return "", errOutsideShare
+	}
+	for _, part := range strings.Split(filepath.ToSlash(relativePath), "/") {
+		if part == ".." {
+			return "", errOutsideShare
+		}
+	}
+	root = filepath.Clean(root)
+	path := filepath.Join(root, filepath.Clean("/"+relativePath))
+	if !within(root, path) {
+		return "", errOutsideShare
+	}
+	if policy == symlinksFollow || path == root {
+		return path, nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		realRoot = root
+	}
+	current := root
+	for _, part := range strings.Split(strings.TrimPrefix(path, root+"/"), "/") {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if err != nil {
+			// not there yet, nothing further can be a symlink
+			break
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if policy == symlinksDeny {
+			return "", errSymlinkDenied
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			// dangling, or a loop
+			return "", errSymlinkDenied
+		}
+		if !within(realRoot, target) {
+			return "", errOutsideShare
+		}
+	}
+	return path, nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testShareWithLinks makes a share with a link inside it and links out of it,
+// next to a secret file
+func testShareWithLinks(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "amahi-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "share")
+	os.MkdirAll(filepath.Join(root, "music/album"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "music/album/song.mp3"), []byte("song"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(root, "music"), filepath.Join(root, "inside"))
+	os.Symlink(dir, filepath.Join(root, "outside"))
+	os.Symlink("../secret", filepath.Join(root, "music/secret"))
+	os.Symlink("missing", filepath.Join(root, "dangling"))
+	return root, func() { os.RemoveAll(dir) }
+}
+
+func TestResolveInShare(t *testing.T) {
+	root, cleanup := testShareWithLinks(t)
+	defer cleanup()
+
+	for _, path := range []string{"/../secret", "..", "/music/../../secret", "music/..", "/a\x00b"} {
+		if p, err := resolveInShare(root, path, symlinksFollow); err == nil {
+			t.Errorf("%q resolved to %s", path, p)
+		}
+	}
+	if p, _ := resolveInShare(root, "/music//album/./song.mp3", symlinksDeny); p != filepath.Join(root, "music/album/song.mp3") {
+		t.Errorf("Path not cleaned up: %s", p)
+	}
+	if p, _ := resolveInShare(root, "/", symlinksDeny); p != root {
+		t.Errorf("Root is %s", p)
+	}
+	if p, err := resolveInShare(root, "/music/new/upload.txt", symlinksWithinShare); err != nil || p != filepath.Join(root, "music/new/upload.txt") {
+		t.Errorf("New file refused: %s %v", p, err)
+	}
+
+	for _, c := range []struct {
+		path   string
+		policy string
+		ok     bool
+	}{
+		{"/inside/album/song.mp3", symlinksFollow, true},
+		{"/inside/album/song.mp3", symlinksWithinShare, true},
+		{"/inside/album/song.mp3", symlinksDeny, false},
+		{"/outside/secret", symlinksFollow, true},
+		{"/outside/secret", symlinksWithinShare, false},
+		{"/music/secret", symlinksWithinShare, false},
+		{"/inside/secret", symlinksWithinShare, false},
+		{"/dangling", symlinksWithinShare, false},
+	} {
+		_, err := resolveInShare(root, c.path, c.policy)
+		if (err == nil) != c.ok {
+			t.Errorf("%s with %s: %v", c.path, c.policy, err)
+		}
+	}
+}
+
+func FuzzResolveInShare(f *testing.F) {
+	root, cleanup := testShareWithLinks(f)
+	defer cleanup()
+	realRoot, _ := filepath.EvalSymlinks(root)
+	for _, seed := range []string{"/", "/music/album/song.mp3", "/../secret", "/outside/secret", "/inside/../..",
+		"music/secret", "/%2e%2e/secret", "/..\\secret", "/dangling/x", "//inside//album/", "/a\x00b"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, relativePath string) {
+		for _, policy := range []string{symlinksFollow, symlinksWithinShare, symlinksDeny} {
+			path, err := resolveInShare(root, relativePath, policy)
+			if err != nil {
+				continue
+			}
+			if !within(root, path) {
+				t.Fatalf("%q resolved outside of the share with %s: %s", relativePath, policy, path)
+			}
+			if policy == symlinksFollow {
+				continue
+			}
+			// what is there of the path has to be in the share
+			for p := path; within(root, p); p = filepath.Dir(p) {
+				if real, err := filepath.EvalSymlinks(p); err == nil {
+					if !within(realRoot, real) {
+						t.Fatalf("%q leads out of the share with %s: %s", relativePath, policy, real)
+					}
+					break
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pinFailures are the failed PIN attempts of one client
+type pinFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// pinAttempt is an attempt of a client, counted in the global limit
+type pinAttempt struct {
+	client string
+	at     time.Time
+}
+
+// pinLimiter slows down PIN guessing. Each client gets a few attempts, then
+// waits twice as long after every failure, and is locked out for a while
+// after too many. All the failures together are limited too, for guesses
+// spread over many addresses, but that does not hold back the clients that
+// logged in lately, so that nobody can lock everyone out
+type pinLimiter struct {
+	clients map[string]*pinFailures
+	// the recent failures of all clients, oldest first
+	recent      []pinAttempt
+	globalUntil time.Time
+	// when the clients that logged in did
+	known map[string]time.Time
+
+	freeAttempts    int
+	lockoutAttempts int
+	baseDelay       time.Duration
+	maxDelay        time.Duration
+	lockout         time.Duration
+	globalFailures  int
+	globalWindow    time.Duration
+	knownFor        time.Duration
+	now             func() time.Time
+	sync.Mutex
+}
+
+// newPinLimiter reads its limits from the auth.pin_* options
+func newPinLimiter() *pinLimiter {
+	return &pinLimiter{
+		clients:         make(map[string]*pinFailures),
+		known:           make(map[string]time.Time),
+		freeAttempts:    config.Int("auth.pin_free_attempts", 3),
+		lockoutAttempts: config.Int("auth.pin_lockout_attempts", 10),
+		baseDelay:       config.Duration("auth.pin_base_delay", time.Second),
+		maxDelay:        config.Duration("auth.pin_max_delay", 5*time.Minute),
+		lockout:         config.Duration("auth.pin_lockout", 30*time.Minute),
+		globalFailures:  config.Int("auth.pin_global_failures", 60),
+		globalWindow:    config.Duration("auth.pin_global_window", time.Minute),
+		knownFor:        config.Duration("auth.pin_known_clients", 30*24*time.Hour),
+		now:             time.Now,
+	}
+}
+
+// allow tells whether the client can try a PIN now, or how long it has to
+// wait. The attempt counts as a failure from then on, until succeeded says
+// otherwise, so that guesses sent together do not all get in before the
+// first one fails
+func (l *pinLimiter) allow(client string) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.forgetOld(now)
+	if wait := l.wait(client, now); wait > 0 {
+		return wait, false
+	}
+	l.record(client, now)
+	return 0, true
+}
+
+// failed returns how long the client has to wait after a wrong PIN. The
+// attempt was recorded when it was allowed
+func (l *pinLimiter) failed(client string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	return l.wait(client, l.now())
+}
+
+// succeeded forgets the failures of the client, the last attempt included.
+// Only that attempt goes from the global count: the other clients' failures
+// made since then still count
+func (l *pinLimiter) succeeded(client string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.clients, client)
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		if l.recent[i].client == client {
+			l.recent = append(l.recent[:i], l.recent[i+1:]...)
+			break
+		}
+	}
+	l.known[client] = l.now()
+}
+
+// record counts an attempt of the client as a failure
+func (l *pinLimiter) record(client string, now time.Time) {
+	f := l.clients[client]
+	if f == nil {
+		f = new(pinFailures)
+		l.clients[client] = f
+	}
+	f.count++
+	f.last = now
+	switch {
+	case f.count >= l.lockoutAttempts:
+		f.until = now.Add(l.lockout)
+	case f.count > l.freeAttempts:
+		delay := l.baseDelay << uint(f.count-l.freeAttempts-1)
+		if delay > l.maxDelay || delay <= 0 {
+			delay = l.maxDelay
+		}
+		f.until = now.Add(delay)
+	}
+
+	l.recent = append(l.recent, pinAttempt{client, now})
+	if len(l.recent) >= l.globalFailures {
+		l.globalUntil = l.recent[0].at.Add(l.globalWindow)
+	}
+}
+
+// wait returns how long the client has to wait before trying again
+func (l *pinLimiter) wait(client string, now time.Time) time.Duration {
+	var until time.Time
+	if f := l.clients[client]; f != nil {
+		until = f.until
+	}
+	if _, known := l.known[client]; !known && l.globalUntil.After(until) {
+		until = l.globalUntil
+	}
+	if !now.Before(until) {
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// forgetOld drops the failures that do not count anymore
+func (l *pinLimiter) forgetOld(now time.Time) {
+	i := 0
+	for i < len(l.recent) && now.Sub(l.recent[i].at) > l.globalWindow {
+		i++
+	}
+	l.recent = l.recent[i:]
+	for client, f := range l.clients {
+		if now.After(f.until) && now.Sub(f.last) > l.lockout {
+			delete(l.clients, client)
+		}
+	}
+	for client, at := range l.known {
+		if now.Sub(at) > l.knownFor {
+			delete(l.known, client)
+		}
+	}
+}
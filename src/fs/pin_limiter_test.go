@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPinLimiter(t *testing.T) {
+	now := time.Now()
+	l := newPinLimiter()
+	l.now = func() time.Time { return now }
+	attempt := func(client string) time.Duration {
+		if wait, ok := l.allow(client); !ok {
+			t.Fatalf("Client %s not allowed, waits %s", client, wait)
+		}
+		return l.failed(client)
+	}
+
+	// a few free attempts, then twice the wait every time
+	for i := 0; i < 3; i++ {
+		if wait := attempt("a"); wait != 0 {
+			t.Errorf("Attempt %d waits %s", i+1, wait)
+		}
+	}
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if wait := attempt("a"); wait != expected {
+			t.Errorf("Wait is %s, expected %s", wait, expected)
+		}
+		if _, ok := l.allow("a"); ok {
+			t.Errorf("Client allowed while waiting")
+		}
+		if _, ok := l.allow("b"); !ok {
+			t.Errorf("Other client not allowed")
+		}
+		l.succeeded("b")
+		now = now.Add(expected)
+	}
+
+	// locked out after too many
+	for i := 0; i < 4; i++ {
+		attempt("a")
+		now = now.Add(time.Minute)
+	}
+	if wait, ok := l.allow("a"); ok || wait != 29*time.Minute {
+		t.Errorf("Client not locked out: %s", wait)
+	}
+	l.succeeded("a")
+	if _, ok := l.allow("a"); !ok {
+		t.Errorf("Client not allowed after success")
+	}
+
+	// attempts sent together count before they fail
+	l = newPinLimiter()
+	l.now = func() time.Time { return now }
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if _, ok := l.allow("c"); ok {
+			allowed++
+		}
+	}
+	if allowed != 4 {
+		t.Errorf("%d attempts allowed together", allowed)
+	}
+
+	// many clients together, but not the ones that logged in lately
+	l = newPinLimiter()
+	l.now = func() time.Time { return now }
+	l.allow("known")
+	l.succeeded("known")
+	for i := 0; i < 60; i++ {
+		attempt(string(rune('A' + i)))
+	}
+	if wait, ok := l.allow("new"); ok || wait != time.Minute {
+		t.Errorf("Global limit not applied: %s", wait)
+	}
+	if _, ok := l.allow("known"); !ok {
+		t.Errorf("Global limit applied to a known client")
+	}
+	now = now.Add(time.Minute + time.Second)
+	if _, ok := l.allow("new"); !ok {
+		t.Errorf("Global limit not lifted")
+	}
+
+	// a login takes back its own attempt, not the failure of another client
+	l = newPinLimiter()
+	l.now = func() time.Time { return now }
+	l.allow("d")
+	attempt("e")
+	l.succeeded("d")
+	if len(l.recent) != 1 || l.recent[0].client != "e" {
+		t.Errorf("Failures left after a login: %v", l.recent)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var playbackSchema = []string{
+	`CREATE TABLE IF NOT EXISTS playback_positions (
+		user TEXT NOT NULL,
+		share TEXT NOT NULL,
+		path TEXT NOT NULL,
+		position REAL NOT NULL,
+		duration REAL NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (user, share, path))`,
+}
+
+// playbackPosition is where a user left off playing a file, in seconds
+type playbackPosition struct {
+	Position  float64   `json:"position"`
+	Duration  float64   `json:"duration"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// storePath is the form of the paths kept in the local store, so that "a/b",
+// "/a/b" and "/a//b/" are the same file
+func storePath(path string) string {
+	return filepath.Join("/", path)
+}
+
+func (store *LocalStore) playbackPosition(user, share, path string) (*playbackPosition, error) {
+	p := new(playbackPosition)
+	var updatedAt int64
+	q := "SELECT position, duration, updated_at FROM playback_positions WHERE user = ? AND share = ? AND path = ?"
+	err := store.db.QueryRow(q, user, share, storePath(path)).Scan(&p.Position, &p.Duration, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return p, nil
+}
+
+func (store *LocalStore) savePlaybackPosition(user, share, path string, p *playbackPosition) error {
+	q := "INSERT OR REPLACE INTO playback_positions (user, share, path, position, duration, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := store.db.Exec(q, user, share, storePath(path), p.Position, p.Duration, p.UpdatedAt.Unix())
+	return err
+}
+
+func (store *LocalStore) deletePlaybackPosition(user, share, path string) error {
+	q := "DELETE FROM playback_positions WHERE user = ? AND share = ? AND path = ?"
+	_, err := store.db.Exec(q, user, share, storePath(path))
+	return err
+}
+
+// directoryPlaybackPositions returns the positions of the user in the files of
+// a directory, by file name
+func (store *LocalStore) directoryPlaybackPositions(user, share, dir string) map[string]*playbackPosition {
+	positions := make(map[string]*playbackPosition)
+	dir = storePath(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	q := "SELECT path, position, duration, updated_at FROM playback_positions " +
+		"WHERE user = ? AND share = ? AND substr(path, 1, length(?)) = ?"
+	rows, err := store.db.Query(q, user, share, prefix, prefix)
+	if err != nil {
+		logging.Error("Error reading playback positions: %s", err.Error())
+		return positions
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		var updatedAt int64
+		p := new(playbackPosition)
+		if rows.Scan(&path, &p.Position, &p.Duration, &updatedAt) != nil || filepath.Dir(path) != dir {
+			continue
+		}
+		p.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		positions[filepath.Base(path)] = p
+	}
+	return positions
+}
+
+// playbackAnnotator adds the positions of the requester to the audio and video
+// entries of a directory listing
+func (service *MercuryFsService) playbackAnnotator(request *http.Request, share, path string) func([]fileInfo) {
+	return func(fileInfos []fileInfo) {
+		user, ok := service.userKey(request)
+		if !ok || service.store == nil {
+			return
+		}
+		positions := service.store.directoryPlaybackPositions(user, share, path)
+		for i := range fileInfos {
+			fileInfos[i].playback = positions[fileInfos[i].name]
+		}
+	}
+}
+
+// servePlaybackPosition gets (GET), saves (PUT, with {"position": 754.2,
+// "duration": 5400}) or forgets (DELETE) the position of the requester in a file
+func (service *MercuryFsService) servePlaybackPosition(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	user, ok := service.userKey(request)
+	if !ok {
+		http.Error(writer, "Authentication Failed", http.StatusUnauthorized)
+		service.accessLog(logging, request, http.StatusUnauthorized, 0)
+		return
+	}
+	fullPath, err := service.fullPathToFile(share, path)
+	if err != nil || !isPlayable(fullPath) || service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		p, err := service.store.playbackPosition(user, share, path)
+		if err == sql.ErrNoRows {
+			http.NotFound(writer, request)
+			service.accessLog(logging, request, http.StatusNotFound, 0)
+			return
+		} else if err != nil {
+			break
+		}
+		result, _ := json.Marshal(p)
+		service.serveJSON(writer, request, string(result))
+		return
+	case "PUT":
+		defer request.Body.Close()
+		p := new(playbackPosition)
+		if json.NewDecoder(request.Body).Decode(p) != nil || p.Position < 0 || p.Duration < 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			service.accessLog(logging, request, http.StatusBadRequest, 0)
+			return
+		}
+		p.UpdatedAt = time.Now()
+		if err = service.store.savePlaybackPosition(user, share, path, p); err != nil {
+			break
+		}
+		writer.WriteHeader(http.StatusOK)
+		service.accessLog(logging, request, http.StatusOK, 0)
+		return
+	case "DELETE":
+		if err = service.store.deletePlaybackPosition(user, share, path); err != nil {
+			break
+		}
+		writer.WriteHeader(http.StatusOK)
+		service.accessLog(logging, request, http.StatusOK, 0)
+		return
+	}
+	logging.Error("Error with playback position of %s: %s", fullPath, err.Error())
+	http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+	service.accessLog(logging, request, http.StatusInternalServerError, 0)
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testLocalStore(t *testing.T) (*LocalStore, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err.Error())
+	}
+	store, err := NewLocalStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("NewLocalStore failed: %s", err.Error())
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPlaybackPositions(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	p := &playbackPosition{Position: 754.5, Duration: 5400, UpdatedAt: time.Now()}
+	store.savePlaybackPosition("user:1", "Movies", "Kids/Movie.mkv", p)
+	store.savePlaybackPosition("user:1", "Movies", "/Kids/Deeper/Other.mkv", p)
+	store.savePlaybackPosition("user:2", "Movies", "/Kids/Movie.mkv", &playbackPosition{Position: 10})
+
+	saved, err := store.playbackPosition("user:1", "Movies", "/Kids/Movie.mkv")
+	if err != nil || saved.Position != 754.5 || saved.Duration != 5400 {
+		t.Errorf("Position read back as %v (%v)", saved, err)
+	}
+
+	positions := store.directoryPlaybackPositions("user:1", "Movies", "/Kids/")
+	if len(positions) != 1 || positions["Movie.mkv"] == nil {
+		t.Errorf("Directory positions are %v", positions)
+	}
+
+	// substr counts characters, not bytes
+	store.savePlaybackPosition("user:1", "Movies", "/Amélie/Amélie.mkv", p)
+	if positions := store.directoryPlaybackPositions("user:1", "Movies", "/Amélie"); positions["Amélie.mkv"] == nil {
+		t.Errorf("Positions in a non-ASCII directory are %v", positions)
+	}
+
+	store.deletePlaybackPosition("user:1", "Movies", "/Kids/Movie.mkv")
+	if _, err = store.playbackPosition("user:1", "Movies", "/Kids/Movie.mkv"); err == nil {
+		t.Errorf("Position not deleted")
+	}
+	if _, err = store.playbackPosition("user:2", "Movies", "/Kids/Movie.mkv"); err != nil {
+		t.Errorf("Position of another user deleted")
+	}
+}
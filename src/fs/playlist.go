@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// playlistEntry is one file of an M3U8 playlist
+type playlistEntry struct {
+	Share string `json:"s"`
+	Path  string `json:"p"`
+	// in seconds, -1 if unknown
+	duration int
+	title    string
+}
+
+func isPlayable(name string) bool {
+	contentType := getContentType(name)
+	return strings.HasPrefix(contentType, "audio") || strings.HasPrefix(contentType, "video")
+}
+
+// m3u8 renders the entries as an extended M3U playlist with absolute, signed
+// links, so that players can fetch the files without any credentials
+func (service *MercuryFsService) m3u8(request *http.Request, entries []*playlistEntry) string {
+	base, grant := baseURL(request), service.linkGrant(request)
+	lines := []string{"#EXTM3U"}
+	for _, e := range entries {
+		title := e.title
+		if title == "" {
+			title = filepath.Base(e.Path)
+		}
+		// titles go on a single line
+		title = strings.NewReplacer("\r", " ", "\n", " ").Replace(title)
+		lines = append(lines, fmt.Sprintf("#EXTINF:%d,%s", e.duration, title))
+		lines = append(lines, base+service.signedEndpointFor("/files", e.Share, e.Path, grant))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (service *MercuryFsService) servePlaylist(writer http.ResponseWriter, request *http.Request, name string, entries []*playlistEntry) {
+	// no links to hidden files, e.g. of a library scanned before they were
+	visible := make([]*playlistEntry, 0, len(entries))
+	for _, e := range entries {
+		if !hiddenIn(e.Share).hides(e.Path) {
+			visible = append(visible, e)
+		}
+	}
+	entries = visible
+	playlist := service.m3u8(request, entries)
+	audit(request, "links-created", auditSuccess, service.requester(request), "%d signed links in playlist %q", len(entries), name)
+	size := int64(len(playlist))
+	writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writer.Header().Set("Content-Type", "application/vnd.apple.mpegurl; charset=utf-8")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name+".m3u8"))
+	writer.Header().Set("Cache-Control", "no-cache, private")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte(playlist))
+	service.debugInfo.requestServed(size)
+	service.accessLog(logging, request, http.StatusOK, int(size))
+}
+
+// directoryPlaylist serves a playlist of the audio and video files in a directory
+func (service *MercuryFsService) directoryPlaylist(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	fullPath, err := service.fullPathToFile(share, path)
+	if err != nil {
+		debug(2, "File not found: %s", err)
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	osFile, err := os.Open(fullPath)
+	if err != nil {
+		debug(2, "Error opening directory: %s", err.Error())
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	defer osFile.Close()
+	fis, err := osFile.Readdir(0)
+	if err != nil {
+		debug(2, "Error reading directory: %s", err.Error())
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+
+	entries := make([]*playlistEntry, 0)
+	for _, fi := range directoryFileInfos(fis, fullPath, share, path) {
+		if fi.mimeType == "text/directory" || !isPlayable(fi.name) {
+			continue
+		}
+		entries = append(entries, &playlistEntry{
+			Share:    share,
+			Path:     strings.TrimSuffix(path, "/") + "/" + fi.name,
+			duration: -1,
+		})
+	}
+	name := filepath.Base(fullPath)
+	if path == "" || path == "/" {
+		name = share
+	}
+	service.servePlaylist(writer, request, name, entries)
+}
+
+// albumPlaylist serves a playlist out of the music library, filtered by the
+// same artist, album and genre parameters as /music/tracks
+func (service *MercuryFsService) albumPlaylist(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	if service.Music == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	where, args := musicFilter(shares, request)
+	tracks, err := service.Music.tracks(where, args)
+	if err != nil {
+		logging.Error("Error querying music library: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	entries := make([]*playlistEntry, 0)
+	for _, t := range tracks {
+		title := t.Title
+		if t.Artist != "" {
+			title = t.Artist + " - " + t.Title
+		}
+		entries = append(entries, &playlistEntry{Share: t.Share, Path: t.Path, duration: int(t.Duration), title: title})
+	}
+	name := request.URL.Query().Get("album")
+	if name == "" {
+		name = "music"
+	}
+	service.servePlaylist(writer, request, name, entries)
+}
+
+// filesPlaylist serves a playlist of an explicit list of files, posted as
+// {"files": [{"s": "share", "p": "/path"}, ...]}
+func (service *MercuryFsService) filesPlaylist(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	defer request.Body.Close()
+	var data struct {
+		Name  string           `json:"name"`
+		Files []*playlistEntry `json:"files"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&data)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		service.accessLog(logging, request, http.StatusBadRequest, 0)
+		return
+	}
+	readable := make(map[string]bool)
+	for _, name := range shares {
+		readable[name] = true
+	}
+	for _, e := range data.Files {
+		if e == nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			service.accessLog(logging, request, http.StatusBadRequest, 0)
+			return
+		}
+		if shares != nil && !readable[e.Share] {
+			http.Error(writer, "Access Forbidden", http.StatusForbidden)
+			service.accessLog(logging, request, http.StatusForbidden, 0)
+			return
+		}
+		if _, err := service.fullPathToFile(e.Share, e.Path); err != nil || hiddenIn(e.Share).hides(e.Path) {
+			http.NotFound(writer, request)
+			service.accessLog(logging, request, http.StatusNotFound, 0)
+			return
+		}
+		e.duration = -1
+	}
+	if data.Name == "" {
+		data.Name = "playlist"
+	}
+	service.servePlaylist(writer, request, data.Name, data.Files)
+}
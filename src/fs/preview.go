@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+	"golang.org/x/net/html/charset"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// what a text preview returns unless asked otherwise, and the most it can return
+	previewLines    = 200
+	maxPreviewLines = 5000
+	previewBytes    = 64 << 10
+	maxPreviewBytes = 1 << 20
+	// markdown files are rendered whole, up to this size
+	maxMarkdownSize = 1 << 20
+	// rows of a CSV page
+	previewRows    = 100
+	maxPreviewRows = 1000
+)
+
+// textPreview is the beginning of a text file, decoded to UTF-8
+type textPreview struct {
+	Type      string `json:"type"`
+	Charset   string `json:"charset"`
+	Text      string `json:"text,omitempty"`
+	HTML      string `json:"html,omitempty"`
+	Lines     int    `json:"lines,omitempty"`
+	Truncated bool   `json:"truncated"`
+}
+
+// csvPreview is one page of the rows of a CSV file
+type csvPreview struct {
+	Type    string     `json:"type"`
+	Charset string     `json:"charset"`
+	Page    int        `json:"page"`
+	Header  []string   `json:"header"`
+	Rows    [][]string `json:"rows"`
+	More    bool       `json:"more"`
+}
+
+// isTextLike tells whether we can preview a file of this content type
+func isTextLike(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") && contentType != "text/directory"
+}
+
+// queryInt reads a positive integer parameter, within [1, max]
+func queryInt(request *http.Request, name string, def, max int) int {
+	n, err := strconv.Atoi(request.URL.Query().Get(name))
+	if err != nil || n < 1 {
+		return def
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// decodeText returns the text as UTF-8, along with the charset it was in,
+// judging from byte order marks, the markup and what the bytes look like
+func decodeText(data []byte, contentType string) (string, string) {
+	e, name, _ := charset.DetermineEncoding(data, contentType)
+	decoded, err := e.NewDecoder().Bytes(data)
+	if err != nil {
+		decoded = data
+	}
+	return strings.TrimPrefix(string(decoded), "\ufeff"), name
+}
+
+// firstLines returns at most n lines of the text. The last line is dropped
+// when the text was cut, as it may be incomplete
+func firstLines(text string, n int, cut bool) (string, int, bool) {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	truncated := cut
+	if cut && len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[:n]
+		truncated = true
+	}
+	return strings.Join(lines, ""), len(lines), truncated
+}
+
+// csvDelimiter guesses the delimiter from the first line: many spreadsheets
+// write semicolons, or tabs
+func csvDelimiter(text string) rune {
+	first := text
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		first = text[:i]
+	}
+	delimiter, most := ',', strings.Count(first, ",")
+	for _, d := range []rune{';', '\t'} {
+		if n := strings.Count(first, string(d)); n > most {
+			delimiter, most = d, n
+		}
+	}
+	return delimiter
+}
+
+// csvPage reads the given page (from 0) of the rows after the header
+func csvPage(r io.Reader, delimiter rune, page, rows int) (*csvPreview, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	preview := &csvPreview{Type: "csv", Page: page, Rows: make([][]string, 0)}
+	header, err := reader.Read()
+	if err == io.EOF {
+		preview.Header = []string{}
+		return preview, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	preview.Header = header
+	for skip := page * rows; skip > 0; skip-- {
+		if _, err = reader.Read(); err == io.EOF {
+			return preview, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return preview, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(preview.Rows) == rows {
+			preview.More = true
+			return preview, nil
+		}
+		preview.Rows = append(preview.Rows, record)
+	}
+}
+
+// renderMarkdown renders the markdown to HTML that is safe to show in the apps
+func renderMarkdown(text string) string {
+	unsafe := blackfriday.MarkdownCommon([]byte(text))
+	return string(bluemonday.UGCPolicy().SanitizeBytes(unsafe))
+}
+
+// servePreview returns the beginning of a text file ("lines" and "bytes"
+// parameters), markdown rendered as HTML, or a page of a CSV file ("page" and
+// "rows" parameters), so that the apps do not have to download big files
+func (service *MercuryFsService) servePreview(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	fullPath, err := service.fullPathToFile(share, path)
+	if err != nil {
+		debug(2, "File not found: %s", err)
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	contentType := getContentType(fullPath)
+	osFile, err := os.Open(fullPath)
+	if err != nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	defer osFile.Close()
+	fi, _ := osFile.Stat()
+	if fi.IsDir() {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	if !isTextLike(contentType) {
+		http.Error(writer, "No preview for "+contentType, http.StatusUnsupportedMediaType)
+		service.accessLog(logging, request, http.StatusUnsupportedMediaType, 0)
+		return
+	}
+
+	var result interface{}
+	switch contentType {
+	case "text/csv":
+		// the charset is detected on the beginning of the file, but the pages
+		// may be anywhere in it
+		head := make([]byte, 4096)
+		n, _ := io.ReadFull(osFile, head)
+		_, name, _ := charset.DetermineEncoding(head[:n], contentType)
+		osFile.Seek(0, io.SeekStart)
+		r, err := charset.NewReaderLabel(name, osFile)
+		if err != nil {
+			r = osFile
+		}
+		text, _ := decodeText(head[:n], contentType)
+		// pages count from 0
+		page, _ := strconv.Atoi(request.URL.Query().Get("page"))
+		if page < 0 {
+			page = 0
+		}
+		preview, err := csvPage(r, csvDelimiter(text), page, queryInt(request, "rows", previewRows, maxPreviewRows))
+		if err != nil {
+			debug(2, "Error reading CSV %s: %s", fullPath, err.Error())
+			http.Error(writer, "Cannot parse CSV", http.StatusUnprocessableEntity)
+			service.accessLog(logging, request, http.StatusUnprocessableEntity, 0)
+			return
+		}
+		preview.Charset = name
+		result = preview
+	case "text/markdown":
+		data, cut := readPrefix(osFile, maxMarkdownSize)
+		text, name := decodeText(data, contentType)
+		if i := strings.LastIndexByte(text, '\n'); cut && i > 0 {
+			text = text[:i+1]
+		}
+		result = &textPreview{Type: "markdown", Charset: name, HTML: renderMarkdown(text), Truncated: cut}
+	default:
+		data, cut := readPrefix(osFile, int64(queryInt(request, "bytes", previewBytes, maxPreviewBytes)))
+		text, name := decodeText(data, contentType)
+		preview := &textPreview{Type: "text", Charset: name}
+		preview.Text, preview.Lines, preview.Truncated = firstLines(text, queryInt(request, "lines", previewLines, maxPreviewLines), cut)
+		result = preview
+	}
+	data, _ := json.Marshal(result)
+	service.serveJSON(writer, request, string(data))
+}
+
+// readPrefix reads up to max bytes of the file, and tells if there was more
+func readPrefix(r io.Reader, max int64) ([]byte, bool) {
+	var b bytes.Buffer
+	n, _ := io.Copy(&b, io.LimitReader(r, max+1))
+	if n > max {
+		return b.Bytes()[:max], true
+	}
+	return b.Bytes(), false
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	text, name := decodeText([]byte("caf\xe9 cr\xe8me\n"), "text/plain")
+	if text != "café crème\n" || name != "windows-1252" {
+		t.Errorf("Latin-1 text decoded as %q (%s)", text, name)
+	}
+	text, name = decodeText([]byte("\xef\xbb\xbfcafé\n"), "text/plain")
+	if text != "café\n" || name != "utf-8" {
+		t.Errorf("UTF-8 text decoded as %q (%s)", text, name)
+	}
+	text, name = decodeText([]byte("\xff\xfeh\x00i\x00"), "text/plain")
+	if text != "hi" || name != "utf-16le" {
+		t.Errorf("UTF-16 text decoded as %q (%s)", text, name)
+	}
+}
+
+func TestFirstLines(t *testing.T) {
+	text, n, truncated := firstLines("one\ntwo\nthree\nfo", 10, true)
+	if text != "one\ntwo\nthree\n" || n != 3 || !truncated {
+		t.Errorf("Cut text gives %q, %d, %t", text, n, truncated)
+	}
+	text, n, truncated = firstLines("one\ntwo\nthree\n", 2, false)
+	if text != "one\ntwo\n" || n != 2 || !truncated {
+		t.Errorf("First 2 lines give %q, %d, %t", text, n, truncated)
+	}
+	text, n, truncated = firstLines("one\ntwo", 5, false)
+	if text != "one\ntwo" || n != 2 || truncated {
+		t.Errorf("Whole text gives %q, %d, %t", text, n, truncated)
+	}
+}
+
+func TestCSVPage(t *testing.T) {
+	data := "\ufeffname;age\nann;30\nbob;41\n\"c;d\";7\n"
+	delimiter := csvDelimiter(data)
+	if delimiter != ';' {
+		t.Fatalf("Delimiter detected as %q", delimiter)
+	}
+	page, err := csvPage(strings.NewReader(data), delimiter, 0, 2)
+	if err != nil {
+		t.Fatalf("csvPage failed: %s", err.Error())
+	}
+	if page.Header[0] != "name" || len(page.Rows) != 2 || page.Rows[1][1] != "41" || !page.More {
+		t.Errorf("First page is %+v", page)
+	}
+	page, _ = csvPage(strings.NewReader(data), delimiter, 1, 2)
+	if len(page.Rows) != 1 || page.Rows[0][0] != "c;d" || page.More {
+		t.Errorf("Second page is %+v", page)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	html := renderMarkdown("# Title\n\n<script>alert(1)</script>\n\n[link](javascript:alert(1))\n")
+	if !strings.Contains(html, "<h1>Title</h1>") {
+		t.Errorf("Markdown not rendered: %s", html)
+	}
+	if strings.Contains(html, "<script") || strings.Contains(html, "javascript:") {
+		t.Errorf("Markdown not sanitized: %s", html)
+	}
+}
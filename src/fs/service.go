@@ -11,6 +11,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"errors"
@@ -24,7 +25,6 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -38,6 +38,9 @@ type MercuryFsService struct {
 	Shares *HdaShares
 	Apps   *HdaApps
 
+	// failed PIN attempts
+	pins *pinLimiter
+
 	// TLS configuration
 	TLSConfig *tls.Config
 
@@ -48,6 +51,17 @@ type MercuryFsService struct {
 
 	metadata *metadata.Library
 
+	store *LocalStore
+
+	// key for signing links to files
+	urlKey []byte
+
+	Music *MusicLibrary
+
+	Books *BookLibrary
+
+	Transcoder *HlsTranscoder
+
 	debugInfo *debugInfo
 
 	apiRouter *mux.Router
@@ -60,24 +74,64 @@ func NewMercuryFSService(rootDir, localAddr string, isDemo bool) (service *Mercu
 	service = new(MercuryFsService)
 
 	service.Users = NewHdaUsers(isDemo)
+	service.pins = newPinLimiter()
 	service.Shares, err = NewHdaShares(rootDir)
 	if err != nil {
 		debug(3, "Error making HdaShares: %s", err.Error())
 		return nil, err
 	}
 	service.debugInfo = new(debugInfo)
+	service.urlKey = newURLKey()
+	service.Transcoder = NewHlsTranscoder()
 
 	// set up API mux
 	apiRouter := mux.NewRouter()
 	apiRouter.HandleFunc("/auth", service.authenticate).Methods("POST")
+	apiRouter.HandleFunc("/auth/refresh", service.refreshSession).Methods("POST")
 	apiRouter.HandleFunc("/logout", service.logout).Methods("POST")
+	apiRouter.HandleFunc("/sessions", service.serveSessions).Methods("GET")
+	apiRouter.HandleFunc("/sessions", service.revokeSessions).Methods("DELETE")
+	apiRouter.HandleFunc("/tokens", service.serveAPITokens).Methods("GET")
+	apiRouter.HandleFunc("/tokens", service.createAPIToken).Methods("POST")
+	apiRouter.HandleFunc("/tokens", service.revokeAPIToken).Methods("DELETE")
+	apiRouter.HandleFunc("/totp", service.serveTotp).Methods("GET")
+	apiRouter.HandleFunc("/totp", service.enrollTotp).Methods("POST")
+	apiRouter.HandleFunc("/totp", service.disableTotp).Methods("DELETE")
+	apiRouter.HandleFunc("/totp/confirm", service.confirmTotp).Methods("POST")
+	apiRouter.HandleFunc("/audit", use(service.serveAudit, service.adminOnly)).Methods("GET")
 	apiRouter.HandleFunc("/shares", service.serveShares).Methods("GET")
-	apiRouter.HandleFunc("/files", use(service.serveFile, service.shareReadAccess, service.restrictCache)).Methods("GET")
-	apiRouter.HandleFunc("/files", use(service.deleteFile, service.shareWriteAccess, service.restrictCache)).Methods("DELETE")
-	apiRouter.HandleFunc("/files", use(service.uploadFile, service.shareWriteAccess, service.restrictCache)).Methods("POST")
-	apiRouter.HandleFunc("/cache", use(service.serveCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/files", use(service.serveFile, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/files", use(service.deleteFile, service.restrictCache, service.shareWriteAccess, service.audited("file-deleted"))).Methods("DELETE")
+	apiRouter.HandleFunc("/files", use(service.uploadFile, service.restrictCache, service.shareWriteAccess, service.audited("file-uploaded"))).Methods("POST")
+	apiRouter.HandleFunc("/files", use(service.moveFile, service.restrictCache, service.shareWriteAccess, service.audited("file-moved"))).Methods("PUT")
+	apiRouter.HandleFunc("/cache", use(service.serveCache, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/cache/status", service.serveCacheStatus).Methods("GET")
+	apiRouter.HandleFunc("/cache/maintenance", use(service.serveCacheMaintenanceReport, service.adminOnly)).Methods("GET")
+	apiRouter.HandleFunc("/cache/{operation:rebuild|verify|purge}", use(service.serveCacheMaintenance, service.adminOnly)).Methods("POST")
+	apiRouter.HandleFunc("/subtitles", use(service.serveSubtitle, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/preview", use(service.servePreview, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/hls", use(service.serveHls, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/hls/segment", use(service.serveHlsSegment, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/position", use(service.servePlaybackPosition, service.restrictCache, service.shareReadAccess)).Methods("GET", "PUT", "DELETE")
+	apiRouter.HandleFunc("/favorites", service.serveFavorites).Methods("GET")
+	apiRouter.HandleFunc("/favorites", use(service.changeFavorite, service.restrictCache, service.shareReadAccess)).Methods("POST", "DELETE")
+	apiRouter.HandleFunc("/recent", service.serveRecent).Methods("GET")
+	apiRouter.HandleFunc("/recent", service.clearRecent).Methods("DELETE")
+	apiRouter.HandleFunc("/tags", use(service.serveFileTags, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/tags", use(service.changeFileTags, service.restrictCache, service.shareWriteAccess)).Methods("POST", "DELETE")
+	apiRouter.HandleFunc("/tags/all", service.serveAllTags).Methods("GET")
+	apiRouter.HandleFunc("/collections", service.serveCollections).Methods("GET", "PUT", "DELETE")
+	apiRouter.HandleFunc("/collections/files", service.serveCollectionFiles).Methods("GET")
+	apiRouter.HandleFunc("/playlist", use(service.directoryPlaylist, service.restrictCache, service.shareReadAccess)).Methods("GET")
+	apiRouter.HandleFunc("/playlist", service.filesPlaylist).Methods("POST")
 	apiRouter.HandleFunc("/apps", service.appsList).Methods("GET")
 	apiRouter.HandleFunc("/md", service.getMetadata).Methods("GET")
+	apiRouter.HandleFunc("/music/artists", service.musicArtists).Methods("GET")
+	apiRouter.HandleFunc("/music/albums", service.musicAlbums).Methods("GET")
+	apiRouter.HandleFunc("/music/genres", service.musicGenres).Methods("GET")
+	apiRouter.HandleFunc("/music/tracks", service.musicTracks).Methods("GET")
+	apiRouter.HandleFunc("/music/playlist", service.albumPlaylist).Methods("GET")
+	apiRouter.HandleFunc("/books", service.serveBooks).Methods("GET")
 	apiRouter.HandleFunc("/hda_debug", service.hdaDebug).Methods("GET")
 
 	service.apiRouter = apiRouter
@@ -171,28 +225,65 @@ func directory(fi os.FileInfo, js string, w http.ResponseWriter, request *http.R
 	return status, size
 }
 
+// serveJSON responds with the given json, honoring If-None-Match against its etag
+func (service *MercuryFsService) serveJSON(writer http.ResponseWriter, request *http.Request, json string) {
+	etag := `"` + sha1bytes([]byte(json)) + `"`
+	inm := request.Header.Get("If-None-Match")
+	if inm == etag {
+		debug(4, "If-None-Match match found for %s", etag)
+		writer.WriteHeader(http.StatusNotModified)
+		service.debugInfo.requestServed(int64(0))
+		service.accessLog(logging, request, http.StatusNotModified, 0)
+	} else {
+		debug(4, "If-None-Match (%s) match NOT found for Etag %s", inm, etag)
+		size := int64(len(json))
+		writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		writer.Header().Set("ETag", etag)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write([]byte(json))
+		service.debugInfo.requestServed(size)
+		service.accessLog(logging, request, http.StatusOK, int(size))
+	}
+}
+
 // fullPathToFile creates the full path to the requested file and checks to make sure that
-// there aren't any  '..' to prevent unauthorized access
+// it stays in the share, with the symlink policy of the share, to prevent unauthorized access
 func (service *MercuryFsService) fullPathToFile(shareName, relativePath string) (string, error) {
 	share := service.Shares.Get(shareName)
 
 	if share == nil {
 		return "", errors.New(fmt.Sprintf("Share %s not found", shareName))
-	} else if strings.Contains(relativePath, "../") {
-		return "", errors.New(fmt.Sprintf("path %s contains ..", relativePath))
 	}
 
-	path := share.GetPath() + relativePath
+	path, err := resolveInShare(share.GetPath(), relativePath, symlinkPolicy(shareName))
+	if err != nil {
+		debug(3, "Path %s in %s refused: %s", relativePath, shareName, err.Error())
+		return "", err
+	}
 	debug(3, "Full path: %s", path)
 	return path, nil
 }
 
+// relayConnection is the key of the context of the requests from the relay
+type relayConnection struct{}
+
+// viaRelay tells whether a request came through the relay, rather than to the
+// local server on the LAN
+func viaRelay(r *http.Request) bool {
+	relayed, _ := r.Context().Value(relayConnection{}).(bool)
+	return relayed
+}
+
 // serve requests with the ServeConn function over HTTP/2, in goroutines, until we get some error
 func (service *MercuryFsService) StartServing(conn net.Conn) error {
 	logging.Info("Connection to the proxy established.")
 	service.info.relay_addr = conn.RemoteAddr().String()
 
-	serveConnOpts := &http2.ServeConnOpts{BaseConfig: service.server}
+	// the requests tell they came through the relay, see viaRelay
+	ctx := context.WithValue(context.Background(), relayConnection{}, true)
+	serveConnOpts := &http2.ServeConnOpts{BaseConfig: service.server, Context: ctx}
 	server2 := new(http2.Server)
 
 	// start serving over http2 on provided conn and block until connection is lost
@@ -214,11 +305,7 @@ func (service *MercuryFsService) serveCache(writer http.ResponseWriter, request
 	service.printRequest(request)
 
 	fullPath, err := service.fullPathToFile(share, path)
-
-	parentDir := filepath.Dir(fullPath)
-	filename := filepath.Base(fullPath)
-	thumbnailDirPath := filepath.Join(parentDir, ".fscache/thumbnails")
-	thumbnailPath := filepath.Join(thumbnailDirPath, filename)
+	thumbnailPath := thumbnailPathFor(fullPath)
 
 	if err != nil {
 		debug(2, "File not found: %s", err)
@@ -239,6 +326,7 @@ func (service *MercuryFsService) serveCache(writer http.ResponseWriter, request
 
 	// This shouldn't return an error since we just opened the file
 	fi, _ := osFile.Stat()
+	fscache.touch(thumbnailPath, fi)
 
 	// If the file is a directory, return 404 as cache file doesn't exist for directory
 	if fi.IsDir() || isSymlinkDir(fi, fullPath) {
@@ -262,6 +350,14 @@ func (service *MercuryFsService) serveCache(writer http.ResponseWriter, request
 		writer.Header().Set("ETag", etag)
 		writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
 		debug(4, "Etag sent: %s", etag)
+		// thumbnails keep the name of the original file (e.g. album art of an
+		// mp3), so the content type has to come from the data itself
+		if !strings.HasPrefix(getContentType(thumbnailPath), "image") {
+			sniff := make([]byte, 512)
+			n, _ := io.ReadFull(osFile, sniff)
+			writer.Header().Set("Content-Type", http.DetectContentType(sniff[:n]))
+			osFile.Seek(0, io.SeekStart)
+		}
 
 		http.ServeContent(writer, request, thumbnailPath, fi.ModTime(), osFile)
 		service.accessLog(logging, request, http.StatusOK, int(fi.Size()))
@@ -304,7 +400,8 @@ func (service *MercuryFsService) serveFile(writer http.ResponseWriter, request *
 
 	// If the file is a directory, return the all the files within the directory...
 	if fi.IsDir() || isSymlinkDir(fi, fullPath) {
-		jsonDir, err := dirToJSON(osFile, fullPath, share, path)
+		jsonDir, err := dirToJSON(osFile, fullPath, share, path,
+			service.playbackAnnotator(request, share, path), service.tagsAnnotator(share, path))
 		if err != nil {
 			debug(2, "Error converting dir to JSON: %s", err.Error())
 			service.accessLog(logging, request, http.StatusNotFound, 0)
@@ -335,6 +432,7 @@ func (service *MercuryFsService) serveFile(writer http.ResponseWriter, request *
 		http.ServeContent(writer, request, fullPath, fi.ModTime(), osFile)
 		service.accessLog(logging, request, http.StatusOK, int(fi.Size()))
 		service.debugInfo.requestServed(fi.Size())
+		service.recordRecent(request, share, path)
 	}
 
 	return
@@ -430,6 +528,15 @@ func pathForLog(u *url.URL) string {
 	return buf.String()
 }
 
+// endpointFor returns the link to a file in a share through the given API
+// endpoint, e.g. /files or /cache
+func endpointFor(endpoint, share, path string) string {
+	q := url.Values{}
+	q.Set("s", share)
+	q.Set("p", path)
+	return endpoint + "?" + q.Encode()
+}
+
 func isSymlinkDir(m os.FileInfo, fullPath string) bool {
 	// debug(1, "isSymlinkDir(%s)", m.Name())
 	// not a symlink, so return
@@ -561,6 +668,7 @@ func (service *MercuryFsService) printRequest(request *http.Request) {
 }
 
 func (service *MercuryFsService) topVhostFilter(writer http.ResponseWriter, request *http.Request) {
+	request = withAdminCheck(request)
 
 	header := writer.Header()
 
@@ -644,6 +752,9 @@ func (service *MercuryFsService) deleteFile(writer http.ResponseWriter, request
 			service.accessLog(logging, request, http.StatusNotFound, 0)
 			return
 		}
+		if service.store != nil {
+			service.store.forgetPath(share, path)
+		}
 	} else {
 		debug(2, "NOTICE: Running in no-delete mode. Would have deleted: %s", fullPath)
 	}
@@ -653,6 +764,65 @@ func (service *MercuryFsService) deleteFile(writer http.ResponseWriter, request
 	return
 }
 
+// moveFile moves or renames a file or directory within its share, to the path
+// in the "to" parameter. What is kept about it (tags, favorites, etc.) follows it
+func (service *MercuryFsService) moveFile(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+	to := q.Query().Get("to")
+
+	debug(2, "moveFile PUT request")
+
+	service.printRequest(request)
+
+	fullPath, err := service.fullPathToFile(share, path)
+	if err != nil {
+		debug(2, "File not found: %s", err)
+		http.NotFound(writer, request)
+		service.debugInfo.requestServed(int64(0))
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	to = storePath(to)
+	toFullPath, err := service.fullPathToFile(share, to)
+	if err != nil || to == "/" || strings.Contains(to, ".fscache") || storePath(path) == "/" {
+		writer.WriteHeader(http.StatusBadRequest)
+		service.debugInfo.requestServed(int64(0))
+		service.accessLog(logging, request, http.StatusBadRequest, 0)
+		return
+	}
+	if _, err = os.Lstat(toFullPath); err == nil {
+		http.Error(writer, "Destination exists", http.StatusConflict)
+		service.debugInfo.requestServed(int64(0))
+		service.accessLog(logging, request, http.StatusConflict, 0)
+		return
+	}
+
+	// if using the welcome server, just return OK without moving anything
+	if !noDelete {
+		err = os.Rename(fullPath, toFullPath)
+		if err != nil {
+			debug(2, "Error moving file: %s", err.Error())
+			writer.WriteHeader(http.StatusExpectationFailed)
+			service.debugInfo.requestServed(int64(0))
+			service.accessLog(logging, request, http.StatusExpectationFailed, 0)
+			return
+		}
+		if service.store != nil {
+			if err = service.store.movePath(share, path, to); err != nil {
+				logging.Error("Error moving %s in the local store: %s", fullPath, err.Error())
+			}
+		}
+	} else {
+		debug(2, "NOTICE: Running in no-delete mode. Would have moved: %s to %s", fullPath, toFullPath)
+	}
+
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+	return
+}
+
 // upload a file!
 func (service *MercuryFsService) uploadFile(writer http.ResponseWriter, request *http.Request) {
 	q := request.URL
@@ -699,9 +869,9 @@ func (service *MercuryFsService) uploadFile(writer http.ResponseWriter, request
 		}
 		defer file.Close()
 
-		fullPath, _ := service.fullPathToFile(share, path+"/"+handler.Filename)
+		fullPath, err := service.fullPathToFile(share, path+"/"+handler.Filename)
 		//check if the file name is valid
-		if !validFilename(fullPath) {
+		if err != nil || !validFilename(fullPath) {
 			debug(2, "invalid filename")
 			writer.WriteHeader(http.StatusUnsupportedMediaType)
 			service.debugInfo.requestServed(int64(0))
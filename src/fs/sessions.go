@@ -0,0 +1,343 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sessions are kept with a hash of their token, never the token itself. The
+// token_hash is the id of the session, and its token while it has no row in
+// session_tokens, as the sessions from before refresh tokens
+var sessionsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		login TEXT NOT NULL,
+		name TEXT NOT NULL,
+		is_demo INTEGER NOT NULL,
+		device TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		user_updated_at INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_request_at INTEGER NOT NULL)`,
+	// the short-lived access token and the refresh token of a session, with
+	// the refresh token it replaced, to tell when a used one comes back
+	`CREATE TABLE IF NOT EXISTS session_tokens (
+		session TEXT PRIMARY KEY,
+		access_hash TEXT NOT NULL UNIQUE,
+		access_expires_at INTEGER NOT NULL,
+		refresh_hash TEXT NOT NULL UNIQUE,
+		used_refresh_hash TEXT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS session_tokens_used ON session_tokens (used_refresh_hash)`,
+}
+
+// how often the last use of a session is written to the store
+const sessionTouchPeriod = time.Minute
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (store *LocalStore) saveSession(user *HdaUser) error {
+	_, err := store.db.Exec(`INSERT OR REPLACE INTO sessions
+		(token_hash, user_id, login, name, is_demo, device, user_agent, user_updated_at, created_at, last_request_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.session, user.id, user.Login, user.Name, user.IsDemo, user.Device, user.UserAgent, user.UpdatedAt.UnixNano(),
+		user.CreatedAt.Unix(), user.LastRequestAt.Unix())
+	if err != nil || !user.refreshable() {
+		return err
+	}
+	return store.saveSessionTokens(user)
+}
+
+func (store *LocalStore) saveSessionTokens(user *HdaUser) error {
+	_, err := store.db.Exec(`INSERT OR REPLACE INTO session_tokens
+		(session, access_hash, access_expires_at, refresh_hash, used_refresh_hash) VALUES (?, ?, ?, ?, ?)`,
+		user.session, user.accessHash, user.accessExpiresAt.Unix(), user.refreshHash, user.usedRefreshHash)
+	return err
+}
+
+const sessionColumns = `s.token_hash, s.user_id, s.login, s.name, s.is_demo, s.device, s.user_agent,
+	s.user_updated_at, s.created_at, s.last_request_at,
+	t.access_hash, t.access_expires_at, t.refresh_hash, t.used_refresh_hash
+	FROM sessions AS s LEFT JOIN session_tokens AS t ON t.session = s.token_hash`
+
+func scanSession(row interface {
+	Scan(dest ...interface{}) error
+}) (*HdaUser, error) {
+	user := new(HdaUser)
+	var updatedAt, createdAt, lastRequestAt int64
+	var accessHash, refreshHash, usedRefreshHash sql.NullString
+	var accessExpiresAt sql.NullInt64
+	err := row.Scan(&user.session, &user.id, &user.Login, &user.Name, &user.IsDemo, &user.Device, &user.UserAgent,
+		&updatedAt, &createdAt, &lastRequestAt, &accessHash, &accessExpiresAt, &refreshHash, &usedRefreshHash)
+	if err != nil {
+		return nil, err
+	}
+	user.UpdatedAt = time.Unix(0, updatedAt)
+	user.CreatedAt = time.Unix(createdAt, 0)
+	user.LastRequestAt = time.Unix(lastRequestAt, 0)
+	user.accessHash = user.session
+	if accessHash.Valid {
+		user.accessHash = accessHash.String
+		user.accessExpiresAt = time.Unix(accessExpiresAt.Int64, 0)
+		user.refreshHash = refreshHash.String
+		user.usedRefreshHash = usedRefreshHash.String
+	}
+	// checked against the HDA database on first use
+	return user, nil
+}
+
+// session returns the session with the given id, or nil if there is none
+func (store *LocalStore) session(id string) *HdaUser {
+	user, err := scanSession(store.db.QueryRow("SELECT "+sessionColumns+" WHERE s.token_hash = ?", id))
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// sessionByAccess returns the session of an access token, given its hash
+func (store *LocalStore) sessionByAccess(accessHash string) *HdaUser {
+	user, err := scanSession(store.db.QueryRow("SELECT "+sessionColumns+
+		" WHERE (t.session IS NULL AND s.token_hash = ?) OR t.access_hash = ?", accessHash, accessHash))
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// sessionByRefresh returns the session of a refresh token, given its hash,
+// whether it is the current one or the one it replaced
+func (store *LocalStore) sessionByRefresh(refreshHash string) *HdaUser {
+	user, err := scanSession(store.db.QueryRow("SELECT "+sessionColumns+
+		" WHERE t.refresh_hash = ? OR t.used_refresh_hash = ?", refreshHash, refreshHash))
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// sessions returns all the sessions, by id
+func (store *LocalStore) sessions() (map[string]*HdaUser, error) {
+	rows, err := store.db.Query("SELECT " + sessionColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make(map[string]*HdaUser)
+	for rows.Next() {
+		user, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions[user.session] = user
+	}
+	return sessions, rows.Err()
+}
+
+func (store *LocalStore) touchSession(id string, lastRequestAt time.Time) {
+	store.db.Exec("UPDATE sessions SET last_request_at = ? WHERE token_hash = ?", lastRequestAt.Unix(), id)
+}
+
+func (store *LocalStore) deleteSession(id string) {
+	store.db.Exec("DELETE FROM session_tokens WHERE session = ?", id)
+	store.db.Exec("DELETE FROM sessions WHERE token_hash = ?", id)
+}
+
+// deleteExpiredSessions removes the sessions idle or older than allowed
+func (store *LocalStore) deleteExpiredSessions(idle, maxAge time.Duration) error {
+	now := time.Now()
+	_, err := store.db.Exec("DELETE FROM sessions WHERE last_request_at < ? OR created_at < ?",
+		now.Add(-idle).Unix(), now.Add(-maxAge).Unix())
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec("DELETE FROM session_tokens WHERE session NOT IN (SELECT token_hash FROM sessions)")
+	return err
+}
+
+// sessionInfo is a session as the API shows it. The id is the hash of the
+// first token of the session, which does not let anyone in
+type sessionInfo struct {
+	ID            string    `json:"id"`
+	Login         string    `json:"login"`
+	Name          string    `json:"name"`
+	Device        string    `json:"device"`
+	UserAgent     string    `json:"user_agent"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastRequestAt time.Time `json:"last_request_at"`
+	Current       bool      `json:"current"`
+}
+
+// sameUser tells whether two sessions are of the same user
+func (user *HdaUser) sameUser(other *HdaUser) bool {
+	return user.id == other.id && user.IsDemo == other.IsDemo
+}
+
+// sessionList returns the sessions that have not expired, by id. The ones in
+// memory are the most up to date
+func (users *HdaUsers) sessionList() map[string]*HdaUser {
+	users.Lock()
+	defer users.Unlock()
+	sessions := make(map[string]*HdaUser)
+	if users.store != nil {
+		stored, err := users.store.sessions()
+		if err != nil {
+			logging.Error("Error reading sessions: %s", err.Error())
+		} else {
+			sessions = stored
+		}
+	}
+	for _, user := range users.Users {
+		sessions[user.session] = user
+	}
+	now := time.Now()
+	for key, user := range sessions {
+		if now.Sub(user.LastRequestAt) > users.idleTimeout || now.Sub(user.CreatedAt) > users.maxAge {
+			delete(sessions, key)
+		}
+	}
+	return sessions
+}
+
+// live tells whether the session with the given id has not ended
+func (users *HdaUsers) live(id string) bool {
+	users.Lock()
+	defer users.Unlock()
+	var user *HdaUser
+	for _, u := range users.Users {
+		if u.session == id {
+			user = u
+			break
+		}
+	}
+	if user == nil && users.store != nil {
+		user = users.store.session(id)
+	}
+	return user != nil && !users.expired(user)
+}
+
+// revoke ends the session with the given id if allowed says so
+func (users *HdaUsers) revoke(id string, allowed func(user *HdaUser) bool) bool {
+	users.Lock()
+	defer users.Unlock()
+	var user *HdaUser
+	for _, u := range users.Users {
+		if u.session == id {
+			user = u
+			break
+		}
+	}
+	if user == nil && users.store != nil {
+		user = users.store.session(id)
+	}
+	if user == nil || !allowed(user) {
+		return false
+	}
+	users.forget(user)
+	return true
+}
+
+// currentSession returns the id of the session of a request, if any
+func (service *MercuryFsService) currentSession(request *http.Request) string {
+	if user := service.Users.find(parseAuthToken(request)); user != nil {
+		return user.session
+	}
+	return ""
+}
+
+// sessionsFor returns the sessions the requester can see: their own, or
+// everyone's for the admin, who can pick a user with the "login" parameter.
+// Anonymous requests never see everyone's, whatever auth.anonymous says.
+// When ok is false the request was already answered
+func (service *MercuryFsService) sessionsFor(writer http.ResponseWriter, request *http.Request) (sessions map[string]*HdaUser, ok bool) {
+	var requester *HdaUser
+	admin := hasAdminCredentials(request)
+	if !admin {
+		if requester = service.checkAuthHeader(writer, request); requester == nil {
+			return nil, false
+		}
+	}
+	login := request.URL.Query().Get("login")
+	sessions = service.Users.sessionList()
+	for key, user := range sessions {
+		if (!admin && !user.sameUser(requester)) || (admin && login != "" && user.Login != login) {
+			delete(sessions, key)
+		}
+	}
+	return sessions, true
+}
+
+// serveSessions lists the sessions of the requester, most recently used first
+func (service *MercuryFsService) serveSessions(writer http.ResponseWriter, request *http.Request) {
+	sessions, ok := service.sessionsFor(writer, request)
+	if !ok {
+		return
+	}
+	current := service.currentSession(request)
+	result := make([]*sessionInfo, 0, len(sessions))
+	for key, user := range sessions {
+		result = append(result, &sessionInfo{
+			ID:            key,
+			Login:         user.Login,
+			Name:          user.Name,
+			Device:        user.Device,
+			UserAgent:     user.UserAgent,
+			CreatedAt:     user.CreatedAt,
+			LastRequestAt: user.LastRequestAt,
+			Current:       key == current,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastRequestAt.After(result[j].LastRequestAt) })
+	data, _ := json.Marshal(result)
+	service.serveJSON(writer, request, string(data))
+}
+
+// revokeSessions ends the session with the given "id", or with "all=true"
+// all the sessions the requester can see but the one of the request
+func (service *MercuryFsService) revokeSessions(writer http.ResponseWriter, request *http.Request) {
+	sessions, ok := service.sessionsFor(writer, request)
+	if !ok {
+		return
+	}
+	all, id := request.URL.Query().Get("all") == "true", request.URL.Query().Get("id")
+	current := service.currentSession(request)
+	revoked := 0
+	for key, user := range sessions {
+		if (all && key == current) || (!all && key != id) {
+			continue
+		}
+		// still there, and of the same user
+		if service.Users.revoke(key, user.sameUser) {
+			audit(request, "session-revoked", auditSuccess, service.requester(request), "session of %s on %q", user.Login, user.Device)
+			revoked++
+		}
+	}
+	if revoked == 0 && !all {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	result := fmt.Sprintf(`{"revoked": %d}`, revoked)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write([]byte(result))
+	service.accessLog(logging, request, http.StatusOK, len(result))
+	service.debugInfo.requestServed(int64(len(result)))
+}
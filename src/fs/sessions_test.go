@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersistentSessions(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	users := NewHdaUsers(true)
+	users.setStore(store)
+	token, err := users.queryUser("1234", "phone", "app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := users.queryUser("1234", "phone", "app", false)
+	if token.AuthToken == other.AuthToken {
+		t.Errorf("Logins share a token")
+	}
+	var n int
+	store.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token_hash = ?", token.AuthToken).Scan(&n)
+	if n != 0 {
+		t.Errorf("Token stored in the clear")
+	}
+
+	// after a restart
+	users = NewHdaUsers(true)
+	users.setStore(store)
+	if user := users.find(token.AuthToken); user == nil || !user.IsDemo {
+		t.Fatalf("Session lost: %v", user)
+	}
+	users.remove(token.AuthToken)
+	users = NewHdaUsers(true)
+	users.setStore(store)
+	if users.find(token.AuthToken) != nil {
+		t.Errorf("Logged out session found")
+	}
+
+	// idle for too long
+	users.idleTimeout = time.Hour
+	users.store.db.Exec("UPDATE sessions SET last_request_at = ?", time.Now().Add(-2*time.Hour).Unix())
+	if users.find(other.AuthToken) != nil {
+		t.Errorf("Idle session found")
+	}
+	store.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&n)
+	if n != 0 {
+		t.Errorf("Idle session not removed")
+	}
+
+	// too old
+	token, _ = users.queryUser("1234", "phone", "app", false)
+	users.maxAge = time.Hour
+	users.Users[hashToken(token.AuthToken)].CreatedAt = time.Now().Add(-2 * time.Hour)
+	if users.find(token.AuthToken) != nil {
+		t.Errorf("Old session found")
+	}
+}
+
+func TestSessionsAPI(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+	users := NewHdaUsers(true)
+	users.setStore(store)
+	service := &MercuryFsService{Users: users, debugInfo: new(debugInfo), info: new(HdaInfo)}
+	phone, _ := users.queryUser("1234", "phone", "app", false)
+	tablet, _ := users.queryUser("1234", "tablet", "app", false)
+
+	request := httptest.NewRequest("GET", "/sessions", nil)
+	request.Header.Set("Authorization", phone.AuthToken)
+	writer := httptest.NewRecorder()
+	service.serveSessions(writer, request)
+	var sessions []sessionInfo
+	json.Unmarshal(writer.Body.Bytes(), &sessions)
+	if len(sessions) != 2 || !sessions[0].Current || sessions[0].Device != "phone" {
+		t.Fatalf("Sessions are %s", writer.Body.String())
+	}
+
+	// from the phone, log the tablet out
+	request = httptest.NewRequest("DELETE", "/sessions?id="+hashToken(tablet.AuthToken), nil)
+	request.Header.Set("Authorization", phone.AuthToken)
+	writer = httptest.NewRecorder()
+	service.revokeSessions(writer, request)
+	if writer.Code != http.StatusOK || users.find(tablet.AuthToken) != nil || users.find(phone.AuthToken) == nil {
+		t.Errorf("Tablet not logged out: %d %s", writer.Code, writer.Body.String())
+	}
+	request = httptest.NewRequest("DELETE", "/sessions?id=unknown", nil)
+	request.Header.Set("Authorization", phone.AuthToken)
+	writer = httptest.NewRecorder()
+	service.revokeSessions(writer, request)
+	if writer.Code != http.StatusNotFound {
+		t.Errorf("Unknown session revoked: %d", writer.Code)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+	users := NewHdaUsers(true)
+	users.setStore(store)
+	service := &MercuryFsService{Users: users, debugInfo: new(debugInfo), info: new(HdaInfo)}
+
+	first, _ := users.queryUser("1234", "phone", "app", true)
+	if first.RefreshToken == "" || first.ExpiresIn <= 0 || users.find(first.AuthToken) == nil {
+		t.Fatalf("Login with refresh gave %+v", first)
+	}
+	refresh := func(token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/auth/refresh", strings.NewReader(`{"refresh_token": "`+token+`"}`))
+		writer := httptest.NewRecorder()
+		service.refreshSession(writer, request)
+		return writer
+	}
+
+	// after a restart, with the access token expired
+	users = NewHdaUsers(true)
+	users.setStore(store)
+	service.Users = users
+	store.db.Exec("UPDATE session_tokens SET access_expires_at = ?", time.Now().Add(-time.Minute).Unix())
+	if users.find(first.AuthToken) != nil {
+		t.Errorf("Expired access token found")
+	}
+	writer := refresh(first.RefreshToken)
+	var second sessionTokens
+	json.Unmarshal(writer.Body.Bytes(), &second)
+	if writer.Code != http.StatusOK || second.RefreshToken == first.RefreshToken || users.find(second.AuthToken) == nil {
+		t.Fatalf("Refresh gave %d %s", writer.Code, writer.Body.String())
+	}
+	if users.find(first.AuthToken) != nil {
+		t.Errorf("Replaced access token found")
+	}
+	if len(users.sessionList()) != 1 {
+		t.Errorf("Refresh made a new session")
+	}
+
+	// the first refresh token again, as if stolen
+	if writer = refresh(first.RefreshToken); writer.Code != http.StatusUnauthorized {
+		t.Errorf("Used refresh token taken: %d", writer.Code)
+	}
+	if users.find(second.AuthToken) != nil || refresh(second.RefreshToken).Code != http.StatusUnauthorized {
+		t.Errorf("Session not ended after a used refresh token")
+	}
+
+	// once the transition is over
+	legacy, _ := users.queryUser("1234", "old app", "app", false)
+	if legacy.RefreshToken != "" || users.find(legacy.AuthToken) == nil {
+		t.Errorf("Legacy login gave %+v", legacy)
+	}
+	users.legacyTokens = false
+	if users.find(legacy.AuthToken) != nil {
+		t.Errorf("Legacy token taken after the transition")
+	}
+	if tokens, _ := users.queryUser("1234", "old app", "app", false); tokens.RefreshToken == "" {
+		t.Errorf("No refresh token after the transition")
+	}
+}
@@ -19,6 +19,12 @@ const SQL_SELECT_APPS = "SELECT webapps.name, apps.name, apps.logo_url FROM weba
 
 const METADATA_FILE = "/var/hda/tmp/aamd.db"
 
+// local state of the service: music library, sessions, etc.
+const LOCAL_DB_FILE = "/var/lib/amahi-anywhere/amahi-anywhere.db"
+
+// runtime options of the service, see config.go
+const CONFIG_FILE = "/etc/amahi-anywhere.conf"
+
 const PLATFORM = "fedora"
 
 const PID_FILE = "/run/amahi-anywhere.pid"
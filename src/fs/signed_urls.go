@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long the links handed out in playlists stay valid, at most: they stop
+// working with what the playlist was asked for with, e.g. a session
+const signedLinkTTL = 24 * time.Hour
+
+// newURLKey returns a key for signing links, so that players that cannot send
+// an Authorization header can still fetch files. It is replaced by one kept in
+// the local store once that is open, so links survive restarts
+func newURLKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func (service *MercuryFsService) urlSignature(endpoint, share, path, expires, grant string) string {
+	mac := hmac.New(sha256.New, service.urlKey)
+	mac.Write([]byte(endpoint + "\x00" + share + "\x00" + path + "\x00" + expires + "\x00" + grant))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// linkGrant names what a request for signed links got in with, the links
+// work as long as it does: "session:<id>" for a user, "token:<id>" for an API
+// token, "admin" for the admin, or "anonymous" as auth.anonymous allows
+func (service *MercuryFsService) linkGrant(r *http.Request) string {
+	if hasAdminCredentials(r) {
+		return "admin"
+	}
+	if token := service.apiTokenFor(r); token != nil {
+		return "token:" + strconv.FormatInt(token.ID, 10)
+	}
+	if user := service.Users.find(parseAuthToken(r)); user != nil {
+		return "session:" + user.session
+	}
+	return "anonymous"
+}
+
+// grantLive tells whether what a link was signed for still lets it read the share
+func (service *MercuryFsService) grantLive(grant, share string) bool {
+	switch {
+	case grant == "admin":
+		return true
+	case grant == "anonymous":
+		return adminAuth.anonymous != anonymousDeny
+	case strings.HasPrefix(grant, "session:"):
+		return service.Users.live(strings.TrimPrefix(grant, "session:"))
+	case strings.HasPrefix(grant, "token:") && service.store != nil:
+		id, err := strconv.ParseInt(strings.TrimPrefix(grant, "token:"), 10, 64)
+		if err != nil {
+			return false
+		}
+		token := service.store.apiTokenByID(id)
+		return token != nil && !token.expired() && token.allows(share, false)
+	}
+	return false
+}
+
+// signedEndpointFor is like endpointFor, with a signature that grants read
+// access to that one file, until the link expires or the grant (see
+// linkGrant) ends
+func (service *MercuryFsService) signedEndpointFor(endpoint, share, path, grant string) string {
+	expires := strconv.FormatInt(time.Now().Add(signedLinkTTL).Unix(), 10)
+	q := url.Values{}
+	q.Set("s", share)
+	q.Set("p", path)
+	q.Set("exp", expires)
+	q.Set("g", grant)
+	q.Set("sig", service.urlSignature(endpoint, share, path, expires, grant))
+	return endpoint + "?" + q.Encode()
+}
+
+// hasValidSignature checks the signature of a link made by signedEndpointFor
+func (service *MercuryFsService) hasValidSignature(r *http.Request) bool {
+	q := r.URL.Query()
+	sig, expires, grant := q.Get("sig"), q.Get("exp"), q.Get("g")
+	if sig == "" || expires == "" || grant == "" {
+		return false
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	expected := service.urlSignature(r.URL.Path, q.Get("s"), q.Get("p"), expires, grant)
+	return hmac.Equal([]byte(sig), []byte(expected)) && service.grantLive(grant, q.Get("s"))
+}
+
+// baseURL returns the scheme and host the client used to reach us, which is
+// the relay when the request came through it. Only the relay says so in the
+// X-Forwarded headers, on the LAN they are whatever the client says
+func baseURL(r *http.Request) string {
+	scheme, host := "", ""
+	if viaRelay(r) {
+		scheme, host = r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host")
+	}
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	if host == "" {
+		host = r.Host
+	}
+	return scheme + "://" + host
+}
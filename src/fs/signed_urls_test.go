@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignedEndpoint(t *testing.T) {
+	service := &MercuryFsService{urlKey: newURLKey(), Users: NewHdaUsers(true)}
+	link := service.signedEndpointFor("/files", "Music", "/Album/01 Song.mp3", "admin")
+
+	request := httptest.NewRequest("GET", link, nil)
+	if !service.hasValidSignature(request) {
+		t.Errorf("Signature of %s not valid", link)
+	}
+
+	tampered := strings.Replace(link, "01", "02", 1)
+	request = httptest.NewRequest("GET", tampered, nil)
+	if service.hasValidSignature(request) {
+		t.Errorf("Signature of tampered link %s is valid", tampered)
+	}
+
+	other := strings.Replace(link, "/files", "/cache", 1)
+	request = httptest.NewRequest("GET", other, nil)
+	if service.hasValidSignature(request) {
+		t.Errorf("Signature is valid for another endpoint: %s", other)
+	}
+
+	// links of a session end with it
+	session, _ := service.Users.queryUser("1234", "tv", "app", false)
+	request = httptest.NewRequest("GET", "/playlist", nil)
+	request.Header.Set("Authorization", session.AuthToken)
+	grant := service.linkGrant(request)
+	link = service.signedEndpointFor("/files", "Music", "/Album/01 Song.mp3", grant)
+	if !service.hasValidSignature(httptest.NewRequest("GET", link, nil)) {
+		t.Errorf("Link of %s not valid", grant)
+	}
+	forged := strings.Replace(link, "g=session", "g=admin&x=session", 1)
+	if service.hasValidSignature(httptest.NewRequest("GET", forged, nil)) {
+		t.Errorf("Link with another grant is valid: %s", forged)
+	}
+	service.Users.remove(session.AuthToken)
+	if service.hasValidSignature(httptest.NewRequest("GET", link, nil)) {
+		t.Errorf("Link still valid after logout")
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	request := httptest.NewRequest("GET", "http://hda.local:4563/playlist", nil)
+	request.Header.Set("X-Forwarded-Host", "relay.example.com")
+	request.Header.Set("X-Forwarded-Proto", "https")
+	if base := baseURL(request); base != "http://hda.local:4563" {
+		t.Errorf("Base URL on the LAN is %s", base)
+	}
+	request = request.WithContext(context.WithValue(request.Context(), relayConnection{}, true))
+	if base := baseURL(request); base != "https://relay.example.com" {
+		t.Errorf("Base URL through the relay is %s", base)
+	}
+}
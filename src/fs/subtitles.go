@@ -0,0 +1,284 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// largest subtitle file we convert, they are usually well under 1MB
+const maxSubtitleSize = 8 << 20
+
+// subtitleInfo is a sidecar subtitle of a video in a directory listing
+type subtitleInfo struct {
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Endpoint string `json:"endpoint"`
+	// WebVTT version of the subtitle, for the formats we can convert
+	VTT string `json:"vtt,omitempty"`
+}
+
+var (
+	srtTiming     = regexp.MustCompile(`(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})`)
+	assTime       = regexp.MustCompile(`^(\d+):(\d{1,2}):(\d{1,2})[.:](\d{1,3})$`)
+	blankLines    = regexp.MustCompile(`\n\s*\n`)
+	overrideCodes = regexp.MustCompile(`\{[^}]*\}`)
+)
+
+type vttCue struct {
+	start, end float64
+	text       string
+}
+
+func isSubtitle(name string) bool {
+	contentType := getContentType(name)
+	return contentType == "application/x-subtitle" || contentType == "application/x-subrip"
+}
+
+func isConvertibleSubtitle(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".srt", ".ssa", ".ass", ".vtt":
+		return true
+	}
+	return false
+}
+
+// sidecarSubtitles finds the subtitles of the given video among the names of
+// the files in its directory: "Movie.srt", "Movie.en.srt", "Movie.pt-BR.forced.ass"
+func sidecarSubtitles(video string, names []string, share, path string) []subtitleInfo {
+	base := strings.ToLower(strings.TrimSuffix(video, filepath.Ext(video)))
+	if len(path) == 0 {
+		path = "/"
+	}
+	subtitles := make([]subtitleInfo, 0)
+	for _, name := range names {
+		if !isSubtitle(name) {
+			continue
+		}
+		stem := strings.TrimSuffix(name, filepath.Ext(name))
+		language := ""
+		if strings.ToLower(stem) != base {
+			if !strings.HasPrefix(strings.ToLower(stem), base+".") || len(stem) <= len(base)+1 {
+				continue
+			}
+			language = stem[len(base)+1:]
+		}
+		subtitle := subtitleInfo{
+			Name:     name,
+			Language: language,
+			Endpoint: endpointFor("/files", share, filepath.Join(path, name)),
+		}
+		if isConvertibleSubtitle(name) {
+			subtitle.VTT = endpointFor("/subtitles", share, filepath.Join(path, name))
+		}
+		subtitles = append(subtitles, subtitle)
+	}
+	return subtitles
+}
+
+// subtitleText returns the subtitle as UTF-8 text, without byte order mark and
+// with unix line endings. Subtitles that are not UTF-8 are usually Windows-1252
+func subtitleText(data []byte) string {
+	data = []byte(strings.TrimPrefix(string(data), "\ufeff"))
+	if !utf8.Valid(data) {
+		if decoded, err := charmap.Windows1252.NewDecoder().Bytes(data); err == nil {
+			data = decoded
+		}
+	}
+	return strings.Replace(strings.Replace(string(data), "\r\n", "\n", -1), "\r", "\n", -1)
+}
+
+func vttTimestamp(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func cuesToVTT(cues []vttCue) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for _, c := range cues {
+		// a blank line would end the cue early
+		text := strings.TrimSpace(blankLines.ReplaceAllString(c.text, "\n"))
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", vttTimestamp(c.start), vttTimestamp(c.end), text)
+	}
+	return b.String()
+}
+
+func srtSeconds(h, m, s, ms string) float64 {
+	hours, _ := strconv.Atoi(h)
+	minutes, _ := strconv.Atoi(m)
+	secs, _ := strconv.Atoi(s)
+	// "5" after the comma means 500ms
+	millis, _ := strconv.Atoi((ms + "00")[:3])
+	return float64(hours*3600+minutes*60+secs) + float64(millis)/1000
+}
+
+// srtToVTT converts SubRip subtitles to WebVTT
+func srtToVTT(srt string) string {
+	cues := make([]vttCue, 0)
+	// cues are separated by blank lines: sequence number, timing, text
+	for _, block := range blankLines.Split(srt, -1) {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			m := srtTiming.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			cues = append(cues, vttCue{
+				start: srtSeconds(m[1], m[2], m[3], m[4]),
+				end:   srtSeconds(m[5], m[6], m[7], m[8]),
+				// drop SSA style positioning that some SRT files carry
+				text: overrideCodes.ReplaceAllString(strings.Join(lines[i+1:], "\n"), ""),
+			})
+			break
+		}
+	}
+	return cuesToVTT(cues)
+}
+
+func assSeconds(t string) (float64, bool) {
+	m := assTime.FindStringSubmatch(strings.TrimSpace(t))
+	if m == nil {
+		return 0, false
+	}
+	// centiseconds in ASS, but be lenient
+	frac := m[4]
+	if len(frac) == 2 {
+		frac += "0"
+	}
+	return srtSeconds(m[1], m[2], m[3], frac), true
+}
+
+// assToVTT converts the dialogue lines of SSA/ASS subtitles to WebVTT. Styles
+// and effects are dropped
+func assToVTT(ass string) string {
+	cues := make([]vttCue, 0)
+	inEvents := false
+	// default field order of the [Events] section
+	format := []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+	for _, line := range strings.Split(ass, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		if strings.HasPrefix(line, "Format:") {
+			format = strings.Split(strings.ToLower(strings.TrimPrefix(line, "Format:")), ",")
+			for i := range format {
+				format[i] = strings.TrimSpace(format[i])
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, "Dialogue:") {
+			continue
+		}
+		// the text is the last field and may contain commas
+		fields := strings.SplitN(strings.TrimPrefix(line, "Dialogue:"), ",", len(format))
+		if len(fields) != len(format) {
+			continue
+		}
+		var cue vttCue
+		var okStart, okEnd bool
+		for i, name := range format {
+			switch name {
+			case "start":
+				cue.start, okStart = assSeconds(fields[i])
+			case "end":
+				cue.end, okEnd = assSeconds(fields[i])
+			case "text":
+				text := overrideCodes.ReplaceAllString(fields[i], "")
+				text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(text)
+				cue.text = text
+			}
+		}
+		if okStart && okEnd {
+			cues = append(cues, cue)
+		}
+	}
+	// events do not have to be in order, cues do
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].start < cues[j].start })
+	return cuesToVTT(cues)
+}
+
+// serveSubtitle converts an SRT, SSA or ASS subtitle to WebVTT on the fly, for
+// HTML5 and Chromecast players
+func (service *MercuryFsService) serveSubtitle(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	fullPath, err := service.fullPathToFile(share, path)
+	if err != nil || !isConvertibleSubtitle(fullPath) {
+		debug(2, "Subtitle not found: %s", err)
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	fi, err := os.Stat(fullPath)
+	if err != nil || fi.IsDir() || fi.Size() > maxSubtitleSize {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	data, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		debug(2, "Error reading subtitle: %s", err.Error())
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+
+	text := subtitleText(data)
+	var vtt string
+	switch strings.ToLower(filepath.Ext(fullPath)) {
+	case ".srt":
+		vtt = srtToVTT(text)
+	case ".ssa", ".ass":
+		vtt = assToVTT(text)
+	default:
+		vtt = text
+	}
+
+	mtime := fi.ModTime().UTC().Format(http.TimeFormat)
+	etag := `"` + sha1string(path+mtime+"vtt") + `"`
+	if request.Header.Get("If-None-Match") == etag {
+		writer.WriteHeader(http.StatusNotModified)
+		service.accessLog(logging, request, http.StatusNotModified, 0)
+		return
+	}
+	size := int64(len(vtt))
+	writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writer.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	writer.Header().Set("Last-Modified", mtime)
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+	// Chromecast fetches subtitles with CORS
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte(vtt))
+	service.debugInfo.requestServed(size)
+	service.accessLog(logging, request, http.StatusOK, int(size))
+}
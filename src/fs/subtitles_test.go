@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSrtToVTT(t *testing.T) {
+	srt := subtitleText([]byte("\xef\xbb\xbf1\r\n00:00:01,500 --> 00:00:04,000\r\n{\\an8}Hello\r\nthere\r\n\r\n2\r\n00:01:02,05 --> 00:01:03,100\r\n42\r\n"))
+	expected := "WEBVTT\n\n00:00:01.500 --> 00:00:04.000\nHello\nthere\n\n00:01:02.050 --> 00:01:03.100\n42\n"
+	if vtt := srtToVTT(srt); vtt != expected {
+		t.Errorf("Wrong conversion:\n%s\nexpected:\n%s", vtt, expected)
+	}
+}
+
+func TestAssToVTT(t *testing.T) {
+	ass := "[Script Info]\nTitle: test\n\n[Events]\n" +
+		"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+		"Dialogue: 0,0:00:05.00,0:00:06.50,Default,,0,0,0,,Second, with a comma\n" +
+		"Dialogue: 0,0:00:01.25,0:00:02.00,Default,,0,0,0,,{\\i1}First{\\i0}\\Nline\n"
+	expected := "WEBVTT\n\n00:00:01.250 --> 00:00:02.000\nFirst\nline\n\n00:00:05.000 --> 00:00:06.500\nSecond, with a comma\n"
+	if vtt := assToVTT(ass); vtt != expected {
+		t.Errorf("Wrong conversion:\n%s\nexpected:\n%s", vtt, expected)
+	}
+}
+
+func TestSidecarSubtitles(t *testing.T) {
+	names := []string{"Movie.mkv", "Movie.srt", "movie.en.srt", "Movie.pt-BR.forced.ass", "Movie 2.srt", "Other.srt"}
+	subtitles := sidecarSubtitles("Movie.mkv", names, "Videos", "/Movies")
+	if len(subtitles) != 3 {
+		t.Fatalf("Expected 3 subtitles, got %d", len(subtitles))
+	}
+	languages := []string{"", "en", "pt-BR.forced"}
+	for i := range subtitles {
+		if subtitles[i].Language != languages[i] {
+			t.Errorf("Wrong language for %s: %q", subtitles[i].Name, subtitles[i].Language)
+		}
+	}
+	if subtitles[0].VTT != "/subtitles?p=%2FMovies%2FMovie.srt&s=Videos" {
+		t.Errorf("Wrong vtt endpoint: %s", subtitles[0].VTT)
+	}
+}
@@ -0,0 +1,518 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var tagsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS file_tags (
+		share TEXT NOT NULL,
+		path TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (share, path, tag))`,
+	`CREATE INDEX IF NOT EXISTS file_tags_tag ON file_tags (tag)`,
+	`CREATE TABLE IF NOT EXISTS collections (
+		user TEXT NOT NULL,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL,
+		PRIMARY KEY (user, name))`,
+}
+
+const maxTagLength = 64
+
+// collectionQuery selects the files of a smart collection. All the given
+// criteria have to match
+type collectionQuery struct {
+	// the file has all of these tags
+	Tags []string `json:"tags,omitempty"`
+	// prefix of the mime type, e.g. "video" or "image/jpeg"
+	MimeType string `json:"mime_type,omitempty"`
+	// range of modification times
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+	// names of the shares to look in, any readable share if empty
+	Shares []string `json:"shares,omitempty"`
+}
+
+type collection struct {
+	Name  string           `json:"name"`
+	Query *collectionQuery `json:"query"`
+}
+
+// cleanTag returns the tag the way it is stored, or "" if it is not valid
+func cleanTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if len(tag) > maxTagLength {
+		return ""
+	}
+	return tag
+}
+
+func (store *LocalStore) fileTags(share, path string) ([]string, error) {
+	rows, err := store.db.Query("SELECT tag FROM file_tags WHERE share = ? AND path = ? ORDER BY tag", share, storePath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (store *LocalStore) addFileTags(share, path string, tags []string) error {
+	for _, tag := range tags {
+		_, err := store.db.Exec("INSERT OR IGNORE INTO file_tags (share, path, tag) VALUES (?, ?, ?)", share, storePath(path), tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFileTag removes a tag from a file, or all of them if tag is ""
+func (store *LocalStore) removeFileTag(share, path, tag string) error {
+	q := "DELETE FROM file_tags WHERE share = ? AND path = ?"
+	args := []interface{}{share, storePath(path)}
+	if tag != "" {
+		q += " AND tag = ?"
+		args = append(args, tag)
+	}
+	_, err := store.db.Exec(q, args...)
+	return err
+}
+
+// directoryTags returns the tags of the files in a directory, by file name
+func (store *LocalStore) directoryTags(share, dir string) map[string][]string {
+	tags := make(map[string][]string)
+	dir = storePath(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	q := "SELECT path, tag FROM file_tags WHERE share = ? AND substr(path, 1, length(?)) = ? ORDER BY tag"
+	rows, err := store.db.Query(q, share, prefix, prefix)
+	if err != nil {
+		logging.Error("Error reading tags: %s", err.Error())
+		return tags
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path, tag string
+		if rows.Scan(&path, &tag) != nil || filepath.Dir(path) != dir {
+			continue
+		}
+		tags[filepath.Base(path)] = append(tags[filepath.Base(path)], tag)
+	}
+	return tags
+}
+
+// taggedFiles returns share and path of the files that have all the tags
+func (store *LocalStore) taggedFiles(tags []string) ([][2]string, error) {
+	q := "SELECT share, path FROM file_tags WHERE tag IN (?" + strings.Repeat(", ?", len(tags)-1) + ")" +
+		" GROUP BY share, path HAVING COUNT(DISTINCT tag) = ?"
+	args := make([]interface{}, 0)
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+	args = append(args, len(tags))
+	rows, err := store.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make([][2]string, 0)
+	for rows.Next() {
+		var share, path string
+		rows.Scan(&share, &path)
+		files = append(files, [2]string{share, path})
+	}
+	return files, rows.Err()
+}
+
+func (store *LocalStore) collections(user string) ([]*collection, error) {
+	rows, err := store.db.Query("SELECT name, query FROM collections WHERE user = ? ORDER BY name", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	collections := make([]*collection, 0)
+	for rows.Next() {
+		var name, query string
+		rows.Scan(&name, &query)
+		c := &collection{Name: name, Query: new(collectionQuery)}
+		json.Unmarshal([]byte(query), c.Query)
+		collections = append(collections, c)
+	}
+	return collections, rows.Err()
+}
+
+func (store *LocalStore) collection(user, name string) (*collectionQuery, error) {
+	var query string
+	err := store.db.QueryRow("SELECT query FROM collections WHERE user = ? AND name = ?", user, name).Scan(&query)
+	if err != nil {
+		return nil, err
+	}
+	cq := new(collectionQuery)
+	return cq, json.Unmarshal([]byte(query), cq)
+}
+
+func (store *LocalStore) saveCollection(user, name string, cq *collectionQuery) error {
+	query, _ := json.Marshal(cq)
+	_, err := store.db.Exec("INSERT OR REPLACE INTO collections (user, name, query) VALUES (?, ?, ?)", user, name, string(query))
+	return err
+}
+
+func (store *LocalStore) deleteCollection(user, name string) error {
+	_, err := store.db.Exec("DELETE FROM collections WHERE user = ? AND name = ?", user, name)
+	return err
+}
+
+// matches checks the criteria of the query that do not need the tags
+func (cq *collectionQuery) matches(name string, fi os.FileInfo) bool {
+	if cq.MimeType != "" {
+		mimeType := "text/directory"
+		if !fi.IsDir() {
+			mimeType = getContentType(name)
+		}
+		if !strings.HasPrefix(mimeType, cq.MimeType) {
+			return false
+		}
+	}
+	if cq.From != nil && fi.ModTime().Before(*cq.From) {
+		return false
+	}
+	if cq.To != nil && fi.ModTime().After(*cq.To) {
+		return false
+	}
+	return true
+}
+
+// collectionFiles returns the newest files of a collection in the given
+// shares, at most max of them. Without tags, this walks the shares, looking
+// at up to collections.max_walk entries, as there is no index of all files
+func (service *MercuryFsService) collectionFiles(cq *collectionQuery, shares []string, max int) ([]*userFile, error) {
+	if len(cq.Shares) > 0 {
+		wanted := make(map[string]bool)
+		for _, name := range cq.Shares {
+			wanted[name] = true
+		}
+		filtered := make([]string, 0)
+		for _, name := range shares {
+			if wanted[name] {
+				filtered = append(filtered, name)
+			}
+		}
+		shares = filtered
+	}
+	inShares := make(map[string]bool)
+	for _, name := range shares {
+		inShares[name] = true
+	}
+
+	files := make([]*userFile, 0)
+	newest := func() {
+		sort.Slice(files, func(i, j int) bool { return files[i].Time.After(files[j].Time) })
+		if len(files) > max {
+			files = files[:max]
+		}
+	}
+	add := func(share, path string, fi os.FileInfo) {
+		f := &userFile{Share: share, Path: path, Name: filepath.Base(path), Time: fi.ModTime().UTC()}
+		f.MimeType = "text/directory"
+		if !fi.IsDir() {
+			f.MimeType = getContentType(f.Name)
+		}
+		f.Endpoint = endpointFor("/files", share, path)
+		files = append(files, f)
+		// only the newest are kept, as they come in any order
+		if len(files) > 2*max {
+			newest()
+		}
+	}
+
+	if len(cq.Tags) > 0 {
+		tagged, err := service.store.taggedFiles(cq.Tags)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tagged {
+			if !inShares[t[0]] || hiddenIn(t[0]).hides(t[1]) {
+				continue
+			}
+			fullPath, err := service.fullPathToFile(t[0], t[1])
+			if err != nil {
+				continue
+			}
+			if fi, err := os.Stat(fullPath); err == nil && cq.matches(t[1], fi) {
+				add(t[0], t[1], fi)
+			}
+		}
+	} else {
+		errWalked := errors.New("walked far enough")
+		left := config.Int("collections.max_walk", 20000)
+		for _, name := range shares {
+			share := service.Shares.Get(name)
+			if share == nil {
+				continue
+			}
+			root := filepath.Clean(share.GetPath())
+			hidden := hiddenIn(name)
+			err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+				if err != nil || path == root {
+					return nil
+				}
+				if hidden.entry(strings.TrimPrefix(filepath.Dir(path), root), fi.Name()) {
+					if fi.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if left--; left < 0 {
+					return errWalked
+				}
+				if cq.matches(path, fi) {
+					add(name, strings.TrimPrefix(path, root), fi)
+				}
+				return nil
+			})
+			if err == errWalked {
+				debug(2, "Collection walk stopped after collections.max_walk entries, in %s", name)
+				break
+			}
+		}
+	}
+	newest()
+	return files, nil
+}
+
+// tagsAnnotator adds the tags of the entries of a directory listing
+func (service *MercuryFsService) tagsAnnotator(share, path string) func([]fileInfo) {
+	return func(fileInfos []fileInfo) {
+		if service.store == nil {
+			return
+		}
+		tags := service.store.directoryTags(share, path)
+		for i := range fileInfos {
+			fileInfos[i].tags = tags[fileInfos[i].name]
+		}
+	}
+}
+
+// serveFileTags answers with the tags of a file or directory
+func (service *MercuryFsService) serveFileTags(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	if _, err := service.fullPathToFile(share, path); err != nil || service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	tags, err := service.store.fileTags(share, path)
+	if err != nil {
+		logging.Error("Error reading tags: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	result, _ := json.Marshal(tags)
+	service.serveJSON(writer, request, string(result))
+}
+
+// changeFileTags adds tags to a file or directory (POST, with {"tags": [...]})
+// or removes one (DELETE, with a "tag" parameter) or all of them (DELETE)
+func (service *MercuryFsService) changeFileTags(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	fullPath, err := service.fullPathToFile(share, path)
+	if err == nil {
+		_, err = os.Stat(fullPath)
+	}
+	if err != nil || service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	if request.Method == "POST" {
+		defer request.Body.Close()
+		var data struct {
+			Tags []string `json:"tags"`
+		}
+		if json.NewDecoder(request.Body).Decode(&data) != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			service.accessLog(logging, request, http.StatusBadRequest, 0)
+			return
+		}
+		tags := make([]string, 0)
+		for _, tag := range data.Tags {
+			if tag = cleanTag(tag); tag == "" {
+				writer.WriteHeader(http.StatusBadRequest)
+				service.accessLog(logging, request, http.StatusBadRequest, 0)
+				return
+			}
+			tags = append(tags, tag)
+		}
+		err = service.store.addFileTags(share, path, tags)
+	} else {
+		err = service.store.removeFileTag(share, path, cleanTag(q.Query().Get("tag")))
+	}
+	if err != nil {
+		logging.Error("Error changing tags: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+}
+
+// serveAllTags answers with the tags in use in the shares the requester can
+// read, with the number of files that have them
+func (service *MercuryFsService) serveAllTags(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	if service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	q := "SELECT tag, COUNT(*) FROM file_tags"
+	args := make([]interface{}, 0)
+	if shares != nil {
+		q += " WHERE share IN (''" + strings.Repeat(", ?", len(shares)) + ")"
+		for _, name := range shares {
+			args = append(args, name)
+		}
+	}
+	rows, err := service.store.db.Query(q+" GROUP BY tag ORDER BY tag", args...)
+	if err != nil {
+		logging.Error("Error reading tags: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	defer rows.Close()
+	type tagCount struct {
+		Name  string `json:"name"`
+		Files int    `json:"files"`
+	}
+	tags := make([]tagCount, 0)
+	for rows.Next() {
+		var t tagCount
+		rows.Scan(&t.Name, &t.Files)
+		tags = append(tags, t)
+	}
+	result, _ := json.Marshal(tags)
+	service.serveJSON(writer, request, string(result))
+}
+
+// serveCollections lists (GET), saves (PUT, with the query as the body) or
+// deletes (DELETE) the smart collections of the requester
+func (service *MercuryFsService) serveCollections(writer http.ResponseWriter, request *http.Request) {
+	if _, ok := service.readableShares(writer, request); !ok {
+		return
+	}
+	user, _ := service.userKey(request)
+	name := strings.TrimSpace(request.URL.Query().Get("name"))
+	if service.store == nil || (request.Method != "GET" && name == "") {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+
+	var err error
+	switch request.Method {
+	case "GET":
+		var collections []*collection
+		if collections, err = service.store.collections(user); err == nil {
+			result, _ := json.Marshal(collections)
+			service.serveJSON(writer, request, string(result))
+			return
+		}
+	case "PUT":
+		defer request.Body.Close()
+		cq := new(collectionQuery)
+		if json.NewDecoder(request.Body).Decode(cq) != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			service.accessLog(logging, request, http.StatusBadRequest, 0)
+			return
+		}
+		tags := make([]string, 0)
+		for _, tag := range cq.Tags {
+			if tag = cleanTag(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		cq.Tags = tags
+		err = service.store.saveCollection(user, name, cq)
+	case "DELETE":
+		err = service.store.deleteCollection(user, name)
+	}
+	if err != nil {
+		logging.Error("Error with collections: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+}
+
+// serveCollectionFiles answers with the files of a smart collection of the
+// requester, in the shares the requester can read
+func (service *MercuryFsService) serveCollectionFiles(writer http.ResponseWriter, request *http.Request) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	user, _ := service.userKey(request)
+	if service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	cq, err := service.store.collection(user, request.URL.Query().Get("name"))
+	if err != nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	if shares == nil {
+		service.Shares.updateShares()
+		shares = make([]string, 0)
+		for _, share := range service.Shares.Shares {
+			shares = append(shares, share.name)
+		}
+	}
+	files, err := service.collectionFiles(cq, shares, config.Int("collections.max_files", 500))
+	if err != nil {
+		logging.Error("Error with collection: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	result, _ := json.Marshal(files)
+	service.serveJSON(writer, request, string(result))
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileTags(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	store.addFileTags("Pictures", "/2019/beach.jpg", []string{"summer", "family"})
+	store.addFileTags("Pictures", "/2019/party.jpg", []string{"family"})
+	store.addFileTags("Pictures", "/2019/Trip", []string{"summer"})
+	store.addFileTags("Pictures", "/2019/Trip/boat.jpg", []string{"summer"})
+
+	files, err := store.taggedFiles([]string{"summer", "family"})
+	if err != nil || len(files) != 1 || files[0][1] != "/2019/beach.jpg" {
+		t.Errorf("Files tagged summer and family: %v (%v)", files, err)
+	}
+
+	tags := store.directoryTags("Pictures", "/2019")
+	if len(tags) != 3 || len(tags["beach.jpg"]) != 2 || tags["Trip"][0] != "summer" {
+		t.Errorf("Directory tags are %v", tags)
+	}
+
+	// the tags follow a directory that is renamed, with the files in it
+	store.movePath("Pictures", "/2019/Trip", "/2019/Boat Trip")
+	if tags, _ := store.fileTags("Pictures", "/2019/Boat Trip/boat.jpg"); len(tags) != 1 {
+		t.Errorf("Tags did not follow the move: %v", tags)
+	}
+	if tags, _ := store.fileTags("Pictures", "/2019/Trip"); len(tags) != 0 {
+		t.Errorf("Tags left behind by the move: %v", tags)
+	}
+
+	store.forgetPath("Pictures", "/2019/Boat Trip")
+	if files, _ := store.taggedFiles([]string{"summer"}); len(files) != 1 {
+		t.Errorf("Tags of removed directory kept: %v", files)
+	}
+}
+
+func TestFileTagsNonASCII(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	store.addFileTags("Pictures", "/Café/crème.jpg", []string{"food"})
+	if tags := store.directoryTags("Pictures", "/Café"); len(tags["crème.jpg"]) != 1 {
+		t.Errorf("Directory tags are %v", tags)
+	}
+	store.movePath("Pictures", "/Café", "/Cafés")
+	if tags, _ := store.fileTags("Pictures", "/Cafés/crème.jpg"); len(tags) != 1 {
+		t.Errorf("Tags did not follow the move: %v", tags)
+	}
+	store.forgetPath("Pictures", "/Cafés")
+	if files, _ := store.taggedFiles([]string{"food"}); len(files) != 0 {
+		t.Errorf("Tags of removed directory kept: %v", files)
+	}
+}
+
+func TestCollectionQueryMatches(t *testing.T) {
+	from := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	cq := &collectionQuery{MimeType: "image", From: &from}
+
+	path := writeTestFile(t, "photo.jpg", []byte("data"))
+	defer os.Remove(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err.Error())
+	}
+	if !cq.matches("photo.jpg", fi) {
+		t.Errorf("New image does not match %v", cq)
+	}
+	if cq.matches("movie.mkv", fi) {
+		t.Errorf("Video matches %v", cq)
+	}
+	to := from.Add(time.Hour)
+	cq.To = &to
+	if cq.matches("photo.jpg", fi) {
+		t.Errorf("Image out of the date range matches")
+	}
+}
+
+func TestCollectionNewestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amahi-collection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "Pictures"), 0755)
+	// walked in name order, oldest first
+	now := time.Now()
+	for i, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		path := filepath.Join(dir, "Pictures", name)
+		ioutil.WriteFile(path, []byte("data"), 0644)
+		at := now.Add(time.Duration(i-4) * time.Hour)
+		os.Chtimes(path, at, at)
+	}
+	shares, _ := NewHdaShares(dir)
+	service := &MercuryFsService{Shares: shares}
+
+	files, err := service.collectionFiles(&collectionQuery{MimeType: "image"}, []string{"Pictures"}, 2)
+	if err != nil || len(files) != 2 || files[0].Name != "d.jpg" || files[1].Name != "c.jpg" {
+		t.Errorf("Newest files are %+v", files)
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{values: map[string]string{"collections.max_walk": "2"}}
+	if files, _ = service.collectionFiles(&collectionQuery{MimeType: "image"}, []string{"Pictures"}, 10); len(files) != 2 {
+		t.Errorf("Walk not bounded: %+v", files)
+	}
+}
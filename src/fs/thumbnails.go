@@ -0,0 +1,389 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default PDF renderer, from poppler-utils. It renders the first page of
+// {input} into an image named {output} plus an extension
+const defaultPdfRenderer = "pdftoppm -f 1 -l 1 -singlefile -png -scale-to 400 {input} {output}"
+
+const (
+	// providers of ours come before the configured ones unless told otherwise
+	builtinPriority    = 50
+	configuredPriority = 100
+	defaultTimeout     = 30 * time.Second
+	defaultDecodes     = 4
+)
+
+var thumbnailFailuresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS thumbnail_failures (
+		path TEXT PRIMARY KEY,
+		mtime INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		error TEXT NOT NULL)`,
+}
+
+var errThumbnailFailedBefore = errors.New("thumbnail failed before")
+
+// errThumbnailBusy is for files we had no time for, which are not failures
+var errThumbnailBusy = errors.New("too many thumbnails in the making")
+
+// funcDecodes holds a slot for each thumbnail function running, hung or not
+var funcDecodes = make(chan struct{}, defaultDecodes)
+
+// thumbnailProvider makes thumbnails for some types of files
+type thumbnailProvider interface {
+	// Name is used in the logs
+	Name() string
+	// Available tells whether what the provider needs is installed
+	Available() bool
+	// Thumbnail makes the thumbnail of the file at path and saves it at savePath,
+	// giving up when ctx is done
+	Thumbnail(ctx context.Context, path, savePath string) error
+}
+
+// registeredProvider is a provider with the MIME types it handles (or major
+// types followed by a slash, e.g. "image/"), its priority (higher first) and
+// how long it gets per file
+type registeredProvider struct {
+	thumbnailProvider
+	mimeTypes []string
+	priority  int
+	timeout   time.Duration
+}
+
+func (p *registeredProvider) handles(contentType string) bool {
+	for _, t := range p.mimeTypes {
+		if t == contentType || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbnailFailure is a file none of the providers could make a thumbnail of.
+// It is not tried again until it changes
+type thumbnailFailure struct {
+	mtime int64
+	size  int64
+}
+
+// thumbnailRegistry picks the providers for each file, and remembers failures
+type thumbnailRegistry struct {
+	providers []*registeredProvider
+	failures  map[string]thumbnailFailure
+	store     *LocalStore
+	sync.RWMutex
+}
+
+// thumbnails is set up once the configuration is loaded
+var thumbnails = newThumbnailRegistry()
+
+func newThumbnailRegistry() *thumbnailRegistry {
+	return &thumbnailRegistry{failures: make(map[string]thumbnailFailure)}
+}
+
+// register adds a provider, unless what it needs is not installed
+func (r *thumbnailRegistry) register(provider thumbnailProvider, mimeTypes []string, priority int, timeout time.Duration) {
+	if !provider.Available() {
+		logging.Info("Thumbnail provider %s is not available", provider.Name())
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.providers = append(r.providers, &registeredProvider{provider, mimeTypes, priority, timeout})
+	sort.SliceStable(r.providers, func(i, j int) bool { return r.providers[i].priority > r.providers[j].priority })
+}
+
+// providersFor returns the providers for the content type, in priority order
+func (r *thumbnailRegistry) providersFor(contentType string) []*registeredProvider {
+	r.RLock()
+	defer r.RUnlock()
+	providers := make([]*registeredProvider, 0)
+	for _, p := range r.providers {
+		if p.handles(contentType) {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
+
+// setStore keeps the failures in the local store, so they survive restarts
+func (r *thumbnailRegistry) setStore(store *LocalStore) error {
+	if err := store.createTables(thumbnailFailuresSchema...); err != nil {
+		return err
+	}
+	rows, err := store.db.Query("SELECT path, mtime, size FROM thumbnail_failures")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	r.Lock()
+	defer r.Unlock()
+	r.store = store
+	for rows.Next() {
+		var path string
+		var f thumbnailFailure
+		rows.Scan(&path, &f.mtime, &f.size)
+		r.failures[path] = f
+	}
+	return rows.Err()
+}
+
+// failed tells whether the file failed before, as it is now
+func (r *thumbnailRegistry) failed(path string, fi os.FileInfo) bool {
+	r.RLock()
+	defer r.RUnlock()
+	f, ok := r.failures[path]
+	return ok && f.mtime == fi.ModTime().Unix() && f.size == fi.Size()
+}
+
+func (r *thumbnailRegistry) recordFailure(path string, fi os.FileInfo, err error) {
+	f := thumbnailFailure{mtime: fi.ModTime().Unix(), size: fi.Size()}
+	r.Lock()
+	r.failures[path] = f
+	store := r.store
+	r.Unlock()
+	if store != nil {
+		store.db.Exec("INSERT OR REPLACE INTO thumbnail_failures (path, mtime, size, error) VALUES (?, ?, ?, ?)",
+			path, f.mtime, f.size, err.Error())
+	}
+}
+
+func (r *thumbnailRegistry) clearFailure(path string) {
+	r.Lock()
+	_, ok := r.failures[path]
+	delete(r.failures, path)
+	store := r.store
+	r.Unlock()
+	if ok && store != nil {
+		store.db.Exec("DELETE FROM thumbnail_failures WHERE path = ?", path)
+	}
+}
+
+// clearFailures forgets the failures of the files under root
+func (r *thumbnailRegistry) clearFailures(root string) {
+	r.Lock()
+	prefix := root + string(filepath.Separator)
+	for path := range r.failures {
+		if path == root || strings.HasPrefix(path, prefix) {
+			delete(r.failures, path)
+		}
+	}
+	store := r.store
+	r.Unlock()
+	if store != nil {
+		store.db.Exec("DELETE FROM thumbnail_failures WHERE path = ? OR substr(path, 1, length(?)) = ?",
+			root, prefix, prefix)
+	}
+}
+
+// thumbnail makes the thumbnail of a file with the first provider that
+// manages to, and records a failure when none does
+func (r *thumbnailRegistry) thumbnail(path, savePath, contentType string, fi os.FileInfo) error {
+	providers := r.providersFor(contentType)
+	if len(providers) == 0 {
+		return nil
+	}
+	if r.failed(path, fi) {
+		debug(5, "Not retrying thumbnail of %s", path)
+		return errThumbnailFailedBefore
+	}
+	var err error
+	for _, p := range providers {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		err = p.Thumbnail(ctx, path, savePath)
+		cancel()
+		if err == nil {
+			r.clearFailure(path)
+			return nil
+		}
+		debug(3, "Thumbnail provider %s failed on %s: %s", p.Name(), path, err.Error())
+	}
+	if err == errThumbnailBusy {
+		return err
+	}
+	r.recordFailure(path, fi, err)
+	return err
+}
+
+// initThumbnailProviders registers our providers and the configured ones,
+// once the configuration is loaded. A configured provider is named in the
+// thumbnails.providers list, and set up with these options:
+//
+//	thumbnails.<name>.command = renderer {input} {output}
+//	thumbnails.<name>.types = application/msword, video/
+//	thumbnails.<name>.priority = 100
+//	thumbnails.<name>.timeout = 30s
+//
+// The pdf provider can be changed with the same options. Our own providers
+// decode at most thumbnails.max_decodes files at a time
+func initThumbnailProviders() {
+	decodes := config.Int("thumbnails.max_decodes", defaultDecodes)
+	if decodes < 1 {
+		decodes = 1
+	}
+	funcDecodes = make(chan struct{}, decodes)
+	registry := newThumbnailRegistry()
+	registry.register(funcProvider{"image", thumbnailer}, []string{"image/"}, builtinPriority, defaultTimeout)
+	registry.register(funcProvider{"album art", albumArtThumbnailer}, []string{"audio/"}, builtinPriority, defaultTimeout)
+
+	configured := map[string]bool{"pdf": true}
+	names := []string{"pdf"}
+	for _, name := range config.List("thumbnails.providers", nil) {
+		if !configured[name] {
+			configured[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		prefix := "thumbnails." + name + "."
+		command, types, priority := "", []string(nil), configuredPriority
+		if name == "pdf" {
+			command, types, priority = defaultPdfRenderer, []string{"application/pdf"}, builtinPriority
+		}
+		command = config.String(prefix+"command", command)
+		types = config.List(prefix+"types", types)
+		if command == "" || len(types) == 0 {
+			logging.Warning("Thumbnail provider %s needs a command and types", name)
+			continue
+		}
+		registry.register(newCommandProvider(name, command), types,
+			config.Int(prefix+"priority", priority), config.Duration(prefix+"timeout", defaultTimeout))
+	}
+	thumbnails = registry
+}
+
+// funcProvider makes thumbnails with a function of ours
+type funcProvider struct {
+	name      string
+	thumbnail func(path, savePath string) error
+}
+
+func (p funcProvider) Name() string {
+	return p.name
+}
+
+func (p funcProvider) Available() bool {
+	return true
+}
+
+// Thumbnail can't stop the function when ctx is done, but does not wait for
+// it: the function writes to a temporary file, which only becomes the
+// thumbnail if it is done in time. Functions that hang keep their decode slot,
+// so they cannot pile up
+func (p funcProvider) Thumbnail(ctx context.Context, path, savePath string) error {
+	slots := funcDecodes
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return errThumbnailBusy
+	}
+	os.MkdirAll(filepath.Dir(savePath), os.ModePerm)
+	// keep the extension, which tells the format to save in
+	temp := filepath.Join(filepath.Dir(savePath), fmt.Sprintf(".%d-%s", time.Now().UnixNano(), filepath.Base(savePath)))
+	done := make(chan error)
+	abandoned := make(chan struct{})
+	go func() {
+		cacheJobs.niceThread()
+		err := p.thumbnail(path, temp)
+		<-slots
+		select {
+		case done <- err:
+		case <-abandoned:
+			os.Remove(temp)
+		}
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			err = os.Rename(temp, savePath)
+		}
+		if err != nil {
+			os.Remove(temp)
+		}
+		return err
+	case <-ctx.Done():
+		close(abandoned)
+		return ctx.Err()
+	}
+}
+
+// commandProvider renders a picture of the file with an external command.
+// {input} in the command is replaced by the file and {output} by the path of
+// the picture to write, with or without extension: any format imaging reads
+type commandProvider struct {
+	name    string
+	command []string
+}
+
+func newCommandProvider(name, command string) *commandProvider {
+	return &commandProvider{name: name, command: strings.Fields(command)}
+}
+
+func (p *commandProvider) Name() string {
+	return p.name
+}
+
+func (p *commandProvider) Available() bool {
+	if len(p.command) == 0 {
+		return false
+	}
+	_, err := exec.LookPath(p.command[0])
+	return err == nil
+}
+
+func (p *commandProvider) Thumbnail(ctx context.Context, path, savePath string) error {
+	dir, err := ioutil.TempDir("", "amahi-thumbnail")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "thumbnail")
+	args := make([]string, len(p.command))
+	for i, arg := range p.command {
+		args[i] = strings.NewReplacer("{input}", path, "{output}", output).Replace(arg)
+	}
+
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		logging.Error(`Error rendering "%s" with %s: %s %s`, path, p.name, err.Error(), strings.TrimSpace(string(out)))
+		return err
+	}
+
+	// whatever the command wrote
+	pictures, _ := filepath.Glob(output + "*")
+	if len(pictures) == 0 {
+		return errors.New(p.name + " renderer wrote nothing")
+	}
+	img, err := imaging.Open(pictures[0])
+	if err != nil {
+		logging.Error(`Error opening picture of "%s" made by %s: %s`, path, p.name, err.Error())
+		return err
+	}
+	return saveThumbnail(img, path, savePath)
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThumbnailRegistry(t *testing.T) {
+	calls := make([]string, 0)
+	provider := func(name string, err error) thumbnailProvider {
+		return funcProvider{name, func(path, savePath string) error {
+			calls = append(calls, name)
+			if err == nil {
+				ioutil.WriteFile(savePath, []byte("thumbnail"), 0644)
+			}
+			return err
+		}}
+	}
+	r := newThumbnailRegistry()
+	r.register(provider("images", nil), []string{"image/"}, 50, time.Second)
+	r.register(provider("broken", errors.New("broken")), []string{"image/png", "application/pdf"}, 80, time.Second)
+	r.register(newCommandProvider("missing", "no-such-renderer {input} {output}"), []string{"image/"}, 100, time.Second)
+
+	providers := r.providersFor("image/png")
+	if len(providers) != 2 || providers[0].Name() != "broken" || providers[1].Name() != "images" {
+		t.Errorf("Providers for image/png are %v", providers)
+	}
+	if providers := r.providersFor("video/mp4"); len(providers) != 0 {
+		t.Errorf("Providers for video/mp4 are %v", providers)
+	}
+
+	path := writeTestFile(t, "file", []byte("data"))
+	defer os.Remove(path)
+	fi, _ := os.Stat(path)
+
+	// falls back to the next provider
+	if err := r.thumbnail(path, path+".thumb", "image/png", fi); err != nil || len(calls) != 2 {
+		t.Errorf("Thumbnail with fallback: %v, calls %v", err, calls)
+	}
+
+	// a failure is not retried until the file changes
+	calls = calls[:0]
+	r.thumbnail(path, path+".thumb", "application/pdf", fi)
+	if err := r.thumbnail(path, path+".thumb", "application/pdf", fi); err != errThumbnailFailedBefore || len(calls) != 1 {
+		t.Errorf("Failed thumbnail retried: %v, calls %v", err, calls)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	fi, _ = os.Stat(path)
+	r.thumbnail(path, path+".thumb", "application/pdf", fi)
+	if len(calls) != 2 {
+		t.Errorf("Changed file not retried, calls %v", calls)
+	}
+}
+
+func TestFuncProviderTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savePath := filepath.Join(dir, "thumb.jpg")
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	hung := funcProvider{"hung", func(path, savePath string) error {
+		<-release
+		defer close(finished)
+		return ioutil.WriteFile(savePath, []byte("late"), 0644)
+	}}
+
+	saved := funcDecodes
+	defer func() { funcDecodes = saved }()
+	funcDecodes = make(chan struct{}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := hung.Thumbnail(ctx, "file", savePath); err != context.DeadlineExceeded {
+		t.Errorf("Hung thumbnail gave %v", err)
+	}
+
+	// the hung one keeps the only slot
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := hung.Thumbnail(ctx, "file", savePath); err != errThumbnailBusy {
+		t.Errorf("Thumbnail without a slot gave %v", err)
+	}
+
+	// what it writes after the deadline is dropped
+	close(release)
+	<-finished
+	time.Sleep(50 * time.Millisecond)
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("Files left after a timeout: %v", names)
+	}
+	if len(funcDecodes) != 0 {
+		t.Errorf("Slot not given back")
+	}
+}
+
+func TestThumbnailFailuresStored(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+	path := writeTestFile(t, "file", []byte("data"))
+	defer os.Remove(path)
+	fi, _ := os.Stat(path)
+
+	r := newThumbnailRegistry()
+	r.setStore(store)
+	r.recordFailure(path, fi, errors.New("broken"))
+
+	r = newThumbnailRegistry()
+	r.setStore(store)
+	if !r.failed(path, fi) {
+		t.Errorf("Failure not kept in the store")
+	}
+	r.clearFailure(path)
+	r = newThumbnailRegistry()
+	r.setStore(store)
+	if r.failed(path, fi) {
+		t.Errorf("Failure not cleared from the store")
+	}
+
+	// substr counts characters, not bytes
+	r.recordFailure("/Música/a.png", fi, errors.New("broken"))
+	r.clearFailures("/Música")
+	r = newThumbnailRegistry()
+	r.setStore(store)
+	if len(r.failures) != 0 {
+		t.Errorf("Failures under a non-ASCII folder not cleared: %v", r.failures)
+	}
+}
+
+func TestCommandProvider(t *testing.T) {
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	input := writeTestFile(t, "page", picture.Bytes())
+	defer os.Remove(input)
+	savePath := input + ".pdf"
+	defer os.Remove(savePath)
+
+	// a "renderer" that copies the picture, adding the extension
+	p := newCommandProvider("copy", "cp {input} {output}.png")
+	if !p.Available() {
+		t.Skip("cp not available")
+	}
+	if err := p.Thumbnail(context.Background(), input, savePath); err != nil {
+		t.Fatalf("Thumbnail failed: %s", err.Error())
+	}
+	if !exists(savePath) {
+		t.Errorf("No thumbnail saved")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	slow := newCommandProvider("slow", "sleep 5")
+	if err := slow.Thumbnail(ctx, input, savePath); err == nil {
+		t.Errorf("Slow renderer did not time out")
+	}
+}
@@ -0,0 +1,363 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// users can add a second factor to their PIN: time-based one-time codes
+// (RFC 6238) from an authenticator app, with recovery codes in case the app
+// is lost. The secret has to be kept as is to work out the codes, the
+// recovery codes are kept hashed
+var totpSchema = []string{
+	`CREATE TABLE IF NOT EXISTS totp (
+		user_id INTEGER NOT NULL,
+		is_demo INTEGER NOT NULL,
+		secret TEXT NOT NULL,
+		confirmed INTEGER NOT NULL,
+		last_step INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, is_demo))`,
+	`CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+		user_id INTEGER NOT NULL,
+		is_demo INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		PRIMARY KEY (user_id, is_demo, code_hash))`,
+}
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes from the steps before and after are taken, for clocks that drift
+	totpSkew           = 1
+	totpRecoveryCodes  = 10
+	totpIssuer         = "Amahi"
+	totpSecretSize     = 20
+	totpRecoveryLength = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode works out the code of a secret for a time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// totpStep is the time step of a code at a given time
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpMatch returns the step the code is for, around now, or -1 if it is
+// for none of them
+func totpMatch(secret []byte, code string, now time.Time) int64 {
+	step := totpStep(now)
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+			return s
+		}
+	}
+	return -1
+}
+
+// totpURI is what goes in the QR code that authenticator apps scan
+func totpURI(login, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + login)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// normalizeCode drops what people type between the characters of a code
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// totpEnrollment is the second factor of a user
+type totpEnrollment struct {
+	secret    string
+	confirmed bool
+	lastStep  int64
+}
+
+func (store *LocalStore) totpEnrollment(user *HdaUser) *totpEnrollment {
+	e := new(totpEnrollment)
+	err := store.db.QueryRow("SELECT secret, confirmed, last_step FROM totp WHERE user_id = ? AND is_demo = ?",
+		user.id, user.IsDemo).Scan(&e.secret, &e.confirmed, &e.lastStep)
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// startTotp keeps a new secret and recovery codes for the user, which only
+// take effect once confirmed with a code
+func (store *LocalStore) startTotp(user *HdaUser, secret string, recoveryCodes []string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT OR REPLACE INTO totp (user_id, is_demo, secret, confirmed, last_step, created_at) "+
+		"VALUES (?, ?, ?, 0, 0, ?)", user.id, user.IsDemo, secret, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ? AND is_demo = ?", user.id, user.IsDemo); err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		_, err = tx.Exec("INSERT INTO totp_recovery_codes (user_id, is_demo, code_hash) VALUES (?, ?, ?)",
+			user.id, user.IsDemo, hashToken(normalizeCode(code)))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// useTotpStep records the step of a code that was taken, and confirms the
+// enrollment. Codes of that step or older are not taken again, it tells
+// whether the step was taken by someone else first
+func (store *LocalStore) useTotpStep(user *HdaUser, step int64) (bool, error) {
+	result, err := store.db.Exec("UPDATE totp SET confirmed = 1, last_step = ? WHERE user_id = ? AND is_demo = ? AND last_step < ?",
+		step, user.id, user.IsDemo, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// useRecoveryCode removes a recovery code of the user, it tells whether there was one
+func (store *LocalStore) useRecoveryCode(user *HdaUser, code string) bool {
+	result, err := store.db.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ? AND is_demo = ? AND code_hash = ?",
+		user.id, user.IsDemo, hashToken(normalizeCode(code)))
+	if err != nil {
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+func (store *LocalStore) recoveryCodesLeft(user *HdaUser) (n int) {
+	store.db.QueryRow("SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = ? AND is_demo = ?",
+		user.id, user.IsDemo).Scan(&n)
+	return
+}
+
+func (store *LocalStore) deleteTotp(user *HdaUser) error {
+	if _, err := store.db.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ? AND is_demo = ?", user.id, user.IsDemo); err != nil {
+		return err
+	}
+	_, err := store.db.Exec("DELETE FROM totp WHERE user_id = ? AND is_demo = ?", user.id, user.IsDemo)
+	return err
+}
+
+// checkTotp tells whether code is a current code of the enrollment, or one of
+// the recovery codes of the user. Each code is only taken once
+func (store *LocalStore) checkTotp(request *http.Request, user *HdaUser, e *totpEnrollment, code string) bool {
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		secret, err := totpEncoding.DecodeString(e.secret)
+		if err != nil {
+			return false
+		}
+		step := totpMatch(secret, code, time.Now())
+		if step < 0 || step <= e.lastStep {
+			return false
+		}
+		// the enrollment may have been read before another login took the code
+		taken, err := store.useTotpStep(user, step)
+		if err != nil {
+			logging.Error("Error recording TOTP code: %s", err.Error())
+			return false
+		}
+		return taken
+	}
+	if e.confirmed && code != "" && store.useRecoveryCode(user, code) {
+		audit(request, "totp-recovery-used", auditSuccess, user.Login, "%d recovery codes left", store.recoveryCodesLeft(user))
+		return true
+	}
+	return false
+}
+
+// totpRequired tells whether logging in needs a second factor: the user has
+// one, and the request came through the relay, or auth.totp_lan_exempt is off
+func (service *MercuryFsService) totpRequired(request *http.Request, user *HdaUser) *totpEnrollment {
+	if service.store == nil || (!viaRelay(request) && config.Bool("auth.totp_lan_exempt", true)) {
+		return nil
+	}
+	e := service.store.totpEnrollment(user)
+	if e == nil || !e.confirmed {
+		return nil
+	}
+	return e
+}
+
+// totpUser is the user of a session that can have a second factor. The demo
+// user is shared, nobody gets to lock the others out
+func (service *MercuryFsService) totpUser(writer http.ResponseWriter, request *http.Request) *HdaUser {
+	user := service.checkAuthHeader(writer, request)
+	if user == nil {
+		return nil
+	}
+	if user.IsDemo || service.store == nil {
+		http.Error(writer, "Access Forbidden", http.StatusForbidden)
+		service.accessLog(logging, request, http.StatusForbidden, 0)
+		return nil
+	}
+	return user
+}
+
+func (service *MercuryFsService) writeTotpJSON(writer http.ResponseWriter, request *http.Request, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	writer.Write(data)
+	service.accessLog(logging, request, status, len(data))
+	service.debugInfo.requestServed(int64(len(data)))
+}
+
+// serveTotp tells whether the user has a second factor
+func (service *MercuryFsService) serveTotp(writer http.ResponseWriter, request *http.Request) {
+	user := service.totpUser(writer, request)
+	if user == nil {
+		return
+	}
+	e := service.store.totpEnrollment(user)
+	result := map[string]interface{}{"enabled": e != nil && e.confirmed}
+	if e != nil && e.confirmed {
+		result["recovery_codes_left"] = service.store.recoveryCodesLeft(user)
+	}
+	service.writeTotpJSON(writer, request, http.StatusOK, result)
+}
+
+// enrollTotp gives the user a new secret, its URI for a QR code and recovery
+// codes. It takes effect once a code is sent to confirmTotp
+func (service *MercuryFsService) enrollTotp(writer http.ResponseWriter, request *http.Request) {
+	user := service.totpUser(writer, request)
+	if user == nil {
+		return
+	}
+	if e := service.store.totpEnrollment(user); e != nil && e.confirmed {
+		http.Error(writer, "Second factor already enabled", http.StatusConflict)
+		service.accessLog(logging, request, http.StatusConflict, 0)
+		return
+	}
+	b := make([]byte, totpSecretSize)
+	rand.Read(b)
+	secret := totpEncoding.EncodeToString(b)
+	codes := make([]string, totpRecoveryCodes)
+	for i := range codes {
+		c := make([]byte, totpRecoveryLength)
+		rand.Read(c)
+		h := hex.EncodeToString(c)
+		codes[i] = h[:totpRecoveryLength] + "-" + h[totpRecoveryLength:]
+	}
+	if err := service.store.startTotp(user, secret, codes); err != nil {
+		logging.Error("Error saving TOTP secret: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	service.writeTotpJSON(writer, request, http.StatusOK, map[string]interface{}{
+		"secret":         secret,
+		"uri":            totpURI(user.Login, secret),
+		"recovery_codes": codes,
+	})
+}
+
+// totpCodeFrom reads the "code" of a JSON body
+func totpCodeFrom(request *http.Request) string {
+	defer request.Body.Close()
+	var data struct {
+		Code string `json:"code"`
+	}
+	json.NewDecoder(request.Body).Decode(&data)
+	return data.Code
+}
+
+// confirmTotp turns on the second factor with a code from the new secret
+func (service *MercuryFsService) confirmTotp(writer http.ResponseWriter, request *http.Request) {
+	user := service.totpUser(writer, request)
+	if user == nil {
+		return
+	}
+	e := service.store.totpEnrollment(user)
+	if e == nil || e.confirmed {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	if !service.store.checkTotp(request, user, e, totpCodeFrom(request)) {
+		http.Error(writer, "Wrong Code", http.StatusUnprocessableEntity)
+		service.accessLog(logging, request, http.StatusUnprocessableEntity, 0)
+		return
+	}
+	audit(request, "totp-enabled", auditSuccess, user.Login, "second factor confirmed")
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+}
+
+// disableTotp turns off the second factor, given a code or a recovery code
+func (service *MercuryFsService) disableTotp(writer http.ResponseWriter, request *http.Request) {
+	user := service.totpUser(writer, request)
+	if user == nil {
+		return
+	}
+	e := service.store.totpEnrollment(user)
+	if e == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	if e.confirmed && !service.store.checkTotp(request, user, e, totpCodeFrom(request)) {
+		http.Error(writer, "Wrong Code", http.StatusUnprocessableEntity)
+		service.accessLog(logging, request, http.StatusUnprocessableEntity, 0)
+		return
+	}
+	if err := service.store.deleteTotp(user); err != nil {
+		logging.Error("Error removing TOTP secret: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	audit(request, "totp-disabled", auditSuccess, user.Login, "second factor removed")
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238, with 6 digits
+	secret := []byte("12345678901234567890")
+	for when, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924"} {
+		if c := totpCode(secret, totpStep(time.Unix(when, 0))); c != code {
+			t.Errorf("Code at %d is %s, not %s", when, c, code)
+		}
+	}
+	now := time.Unix(1234567890, 0)
+	if totpMatch(secret, totpCode(secret, totpStep(now)-1), now) < 0 {
+		t.Errorf("Code of the previous step not taken")
+	}
+	if totpMatch(secret, totpCode(secret, totpStep(now)-3), now) >= 0 {
+		t.Errorf("Old code taken")
+	}
+}
+
+func TestTotpEnrollment(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+	if logging == nil {
+		// the handlers log their requests
+		initializeLogging(filepath.Join(os.TempDir(), "amahi-test", "test.log"), splitNone, false)
+	}
+	users := NewHdaUsers(false)
+	service := &MercuryFsService{Users: users, store: store, debugInfo: new(debugInfo), info: new(HdaInfo)}
+	user := &HdaUser{id: 7, Login: "ana", UpdatedAt: time.Now()}
+	session := users.newSession(user, "phone", "app", false)
+	call := func(handler http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/totp", strings.NewReader(body))
+		request.Header.Set("Authorization", session.AuthToken)
+		writer := httptest.NewRecorder()
+		handler(writer, request)
+		return writer
+	}
+
+	writer := call(service.enrollTotp, "POST", "")
+	var enrollment struct {
+		Secret        string   `json:"secret"`
+		URI           string   `json:"uri"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(writer.Body.Bytes(), &enrollment)
+	if writer.Code != http.StatusOK || len(enrollment.RecoveryCodes) != totpRecoveryCodes ||
+		!strings.HasPrefix(enrollment.URI, "otpauth://totp/Amahi:ana?") {
+		t.Fatalf("Enrollment gave %d %s", writer.Code, writer.Body.String())
+	}
+	secret, _ := totpEncoding.DecodeString(enrollment.Secret)
+
+	relayed := httptest.NewRequest("POST", "/auth", nil)
+	relayed = relayed.WithContext(context.WithValue(relayed.Context(), relayConnection{}, true))
+	if service.totpRequired(relayed, user) != nil {
+		t.Errorf("Second factor required before it is confirmed")
+	}
+	if writer = call(service.confirmTotp, "POST", `{"code": "000000"}`); writer.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Wrong code confirmed the second factor: %d", writer.Code)
+	}
+	code := totpCode(secret, totpStep(time.Now())-1)
+	if writer = call(service.confirmTotp, "POST", `{"code": "`+code+`"}`); writer.Code != http.StatusOK {
+		t.Fatalf("Confirming gave %d", writer.Code)
+	}
+
+	e := service.totpRequired(relayed, user)
+	if e == nil {
+		t.Fatalf("Second factor not required through the relay")
+	}
+	if service.totpRequired(httptest.NewRequest("POST", "/auth", nil), user) != nil {
+		t.Errorf("Second factor required on the LAN")
+	}
+	if store.checkTotp(relayed, user, e, code) {
+		t.Errorf("Code taken twice")
+	}
+	// two logins at once, with the enrollment read before either took the code
+	code = totpCode(secret, totpStep(time.Now()))
+	if !store.checkTotp(relayed, user, e, code) || store.checkTotp(relayed, user, e, code) {
+		t.Errorf("Code not taken once by logins at the same time")
+	}
+	if !store.checkTotp(relayed, user, e, strings.ToUpper(enrollment.RecoveryCodes[0])) ||
+		store.checkTotp(relayed, user, e, enrollment.RecoveryCodes[0]) {
+		t.Errorf("Recovery code not taken once")
+	}
+
+	if writer = call(service.disableTotp, "DELETE", `{"code": "nope"}`); writer.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Disabled without a code: %d", writer.Code)
+	}
+	if writer = call(service.disableTotp, "DELETE", `{"code": "`+enrollment.RecoveryCodes[1]+`"}`); writer.Code != http.StatusOK {
+		t.Errorf("Disabling gave %d", writer.Code)
+	}
+	if service.totpRequired(relayed, user) != nil {
+		t.Errorf("Second factor required once disabled")
+	}
+}
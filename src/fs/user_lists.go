@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the favorites and the recently opened files of each user
+var userListsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS favorites (
+		user TEXT NOT NULL,
+		share TEXT NOT NULL,
+		path TEXT NOT NULL,
+		added_at INTEGER NOT NULL,
+		PRIMARY KEY (user, share, path))`,
+	`CREATE TABLE IF NOT EXISTS recent_files (
+		user TEXT NOT NULL,
+		share TEXT NOT NULL,
+		path TEXT NOT NULL,
+		opened_at INTEGER NOT NULL,
+		PRIMARY KEY (user, share, path))`,
+}
+
+// userFile is an entry of the favorites or the recently opened files
+type userFile struct {
+	Share    string    `json:"share"`
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	MimeType string    `json:"mime_type"`
+	Endpoint string    `json:"endpoint"`
+	Time     time.Time `json:"time"`
+}
+
+func (store *LocalStore) addFavorite(user, share, path string) error {
+	q := "INSERT OR IGNORE INTO favorites (user, share, path, added_at) VALUES (?, ?, ?, ?)"
+	_, err := store.db.Exec(q, user, share, storePath(path), time.Now().Unix())
+	return err
+}
+
+func (store *LocalStore) removeFavorite(user, share, path string) error {
+	_, err := store.db.Exec("DELETE FROM favorites WHERE user = ? AND share = ? AND path = ?", user, share, storePath(path))
+	return err
+}
+
+// addRecent records that the user opened a file, keeping the latest max ones
+func (store *LocalStore) addRecent(user, share, path string, max int) error {
+	q := "INSERT OR REPLACE INTO recent_files (user, share, path, opened_at) VALUES (?, ?, ?, ?)"
+	_, err := store.db.Exec(q, user, share, storePath(path), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	q = "DELETE FROM recent_files WHERE user = ? AND rowid NOT IN " +
+		"(SELECT rowid FROM recent_files WHERE user = ? ORDER BY opened_at DESC, rowid DESC LIMIT ?)"
+	_, err = store.db.Exec(q, user, user, max)
+	return err
+}
+
+func (store *LocalStore) clearRecent(user string) error {
+	_, err := store.db.Exec("DELETE FROM recent_files WHERE user = ?", user)
+	return err
+}
+
+// userFiles reads the favorites or recent files of a user, newest first
+func (store *LocalStore) userFiles(table, column, user string) ([]*userFile, error) {
+	q := "SELECT share, path, " + column + " FROM " + table + " WHERE user = ? ORDER BY " + column + " DESC, rowid DESC"
+	rows, err := store.db.Query(q, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make([]*userFile, 0)
+	for rows.Next() {
+		f := new(userFile)
+		var t int64
+		if err = rows.Scan(&f.Share, &f.Path, &t); err != nil {
+			return nil, err
+		}
+		f.Time = time.Unix(t, 0).UTC()
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// recordRecent adds a file that was just served to the recent files of the
+// requester. Signed links are not tied to a user, and the requests for later
+// ranges of a file that is being played are not new openings
+func (service *MercuryFsService) recordRecent(request *http.Request, share, path string) {
+	if service.store == nil || service.hasValidSignature(request) {
+		return
+	}
+	if r := request.Header.Get("Range"); r != "" && !strings.HasPrefix(r, "bytes=0-") {
+		return
+	}
+	user, ok := service.userKey(request)
+	if !ok {
+		return
+	}
+	err := service.store.addRecent(user, share, path, config.Int("recent.max", 50))
+	if err != nil {
+		logging.Error("Error recording recent file: %s", err.Error())
+	}
+}
+
+// serveUserFiles answers with the favorites or the recent files of the
+// requester that are still there, in shares the requester can still read
+func (service *MercuryFsService) serveUserFiles(writer http.ResponseWriter, request *http.Request, table, column string) {
+	shares, ok := service.readableShares(writer, request)
+	if !ok {
+		return
+	}
+	user, _ := service.userKey(request)
+	if service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	files, err := service.store.userFiles(table, column, user)
+	if err != nil {
+		logging.Error("Error reading %s: %s", table, err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	readable := make(map[string]bool)
+	for _, name := range shares {
+		readable[name] = true
+	}
+	result := make([]*userFile, 0)
+	for _, f := range files {
+		if (shares != nil && !readable[f.Share]) || hiddenIn(f.Share).hides(f.Path) {
+			continue
+		}
+		fullPath, err := service.fullPathToFile(f.Share, f.Path)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+		f.Name = filepath.Base(f.Path)
+		if fi.IsDir() {
+			f.MimeType = "text/directory"
+		} else {
+			f.MimeType = getContentType(f.Name)
+		}
+		f.Endpoint = endpointFor("/files", f.Share, f.Path)
+		result = append(result, f)
+	}
+	data, _ := json.Marshal(result)
+	service.serveJSON(writer, request, string(data))
+}
+
+func (service *MercuryFsService) serveFavorites(writer http.ResponseWriter, request *http.Request) {
+	service.serveUserFiles(writer, request, "favorites", "added_at")
+}
+
+func (service *MercuryFsService) serveRecent(writer http.ResponseWriter, request *http.Request) {
+	service.serveUserFiles(writer, request, "recent_files", "opened_at")
+}
+
+// changeFavorite adds (POST) or removes (DELETE) a file or directory from the
+// favorites of the requester
+func (service *MercuryFsService) changeFavorite(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL
+	path := q.Query().Get("p")
+	share := q.Query().Get("s")
+
+	user, ok := service.userKey(request)
+	if !ok {
+		http.Error(writer, "Authentication Failed", http.StatusUnauthorized)
+		service.accessLog(logging, request, http.StatusUnauthorized, 0)
+		return
+	}
+	fullPath, err := service.fullPathToFile(share, path)
+	if err == nil && request.Method == "POST" {
+		_, err = os.Stat(fullPath)
+	}
+	if err != nil || service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	if request.Method == "POST" {
+		err = service.store.addFavorite(user, share, path)
+	} else {
+		err = service.store.removeFavorite(user, share, path)
+	}
+	if err != nil {
+		logging.Error("Error changing favorites: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+}
+
+func (service *MercuryFsService) clearRecent(writer http.ResponseWriter, request *http.Request) {
+	if _, ok := service.readableShares(writer, request); !ok {
+		return
+	}
+	user, _ := service.userKey(request)
+	if service.store == nil {
+		http.NotFound(writer, request)
+		service.accessLog(logging, request, http.StatusNotFound, 0)
+		return
+	}
+	if err := service.store.clearRecent(user); err != nil {
+		logging.Error("Error clearing recent files: %s", err.Error())
+		http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+		service.accessLog(logging, request, http.StatusInternalServerError, 0)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	service.accessLog(logging, request, http.StatusOK, 0)
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2013-2019 Amahi
+ *
+ * This file is part of Amahi.
+ *
+ * Amahi is free software released under the GNU GPL v3 license.
+ * See the LICENSE file accompanying this distribution.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecentFiles(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		store.addRecent("user:1", "Docs", fmt.Sprintf("/file%d.txt", i), 3)
+	}
+	store.addRecent("user:2", "Docs", "/other.txt", 3)
+	// opening it again does not make a second entry
+	store.addRecent("user:1", "Docs", "file4.txt", 3)
+
+	files, err := store.userFiles("recent_files", "opened_at", "user:1")
+	if err != nil {
+		t.Fatalf("userFiles failed: %s", err.Error())
+	}
+	if len(files) != 3 {
+		t.Errorf("%d recent files kept instead of 3", len(files))
+	}
+	for _, f := range files {
+		if f.Path == "/file0.txt" || f.Path == "/file1.txt" {
+			t.Errorf("Old recent file %s kept", f.Path)
+		}
+	}
+
+	store.clearRecent("user:1")
+	files, _ = store.userFiles("recent_files", "opened_at", "user:2")
+	if len(files) != 1 {
+		t.Errorf("Recent files of another user cleared")
+	}
+}
+
+func TestFavorites(t *testing.T) {
+	store, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	store.addFavorite("user:1", "Movies", "/Kids")
+	store.addFavorite("user:1", "Movies", "Kids/")
+	store.addFavorite("user:1", "Music", "/Album")
+	store.removeFavorite("user:1", "Music", "/Album")
+
+	files, err := store.userFiles("favorites", "added_at", "user:1")
+	if err != nil {
+		t.Fatalf("userFiles failed: %s", err.Error())
+	}
+	if len(files) != 1 || files[0].Share != "Movies" || files[0].Path != "/Kids" {
+		t.Errorf("Favorites are %v", files)
+	}
+}